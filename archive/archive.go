@@ -0,0 +1,214 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	ErrUnsupported  = errors.New("archive: unsupported format")
+	ErrTooLarge     = errors.New("archive: uncompressed size exceeds limit")
+	ErrTooManyFiles = errors.New("archive: number of files exceeds limit")
+	ErrRatio        = errors.New("archive: compression ratio exceeds limit")
+)
+
+// Limits defuse zip bombs. Zero values mean no limit.
+type Limits struct {
+	MaxSize  int64
+	MaxFiles int
+	MaxRatio int
+}
+
+// File is a regular file extracted from an archive
+type File struct {
+	Name string
+	Body []byte
+}
+
+var formats = map[string]func(data []byte, budget *budget) ([]File, error){
+	"application/zip":    extractZip,
+	"application/x-tar":  extractTar,
+	"application/gzip":   extractGzip,
+	"application/x-gzip": extractGzip,
+
+	"application/x-7z-compressed": extract7z,
+}
+
+// IsArchive reports whether files of the mimetype can be extracted
+func IsArchive(mimetype string) bool {
+	_, ok := formats[mimetype]
+	return ok
+}
+
+// Extract returns all regular files of the archive. Nothing is returned if
+// any of the limits is exceeded.
+func Extract(data []byte, mimetype string, limits Limits) ([]File, error) {
+	extract, ok := formats[mimetype]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	b := &budget{limits: limits, compressed: int64(len(data))}
+	return extract(data, b)
+}
+
+// budget tracks the extracted size and number of files against the limits
+type budget struct {
+	limits     Limits
+	compressed int64
+	size       int64
+	files      int
+}
+
+// remaining returns the number of bytes which may still be extracted, -1
+// means no limit
+func (b *budget) remaining() int64 {
+	max := int64(-1)
+	if b.limits.MaxSize > 0 {
+		max = b.limits.MaxSize - b.size
+	}
+	if b.limits.MaxRatio > 0 {
+		ratioMax := b.compressed*int64(b.limits.MaxRatio) - b.size
+		if max < 0 || ratioMax < max {
+			max = ratioMax
+		}
+	}
+
+	return max
+}
+
+// read reads r completely and fails as soon as a limit is exceeded
+func (b *budget) read(r io.Reader) ([]byte, error) {
+	b.files++
+	if b.limits.MaxFiles > 0 && b.files > b.limits.MaxFiles {
+		return nil, ErrTooManyFiles
+	}
+
+	max := b.remaining()
+	if max >= 0 {
+		r = io.LimitReader(r, max+1)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b.size += int64(len(body))
+
+	if b.limits.MaxSize > 0 && b.size > b.limits.MaxSize {
+		return nil, ErrTooLarge
+	}
+	if b.limits.MaxRatio > 0 && b.size > b.compressed*int64(b.limits.MaxRatio) {
+		return nil, ErrRatio
+	}
+
+	return body, nil
+}
+
+// cleanName removes leading slashes and parent directory references
+func cleanName(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	return strings.TrimPrefix(name, "/")
+}
+
+func extractZip(data []byte, b *budget) ([]File, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+
+	files := make([]File, 0, len(reader.File))
+	for _, f := range reader.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("archive: %s: %w", f.Name, err)
+		}
+
+		body, err := b.read(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, File{Name: cleanName(f.Name), Body: body})
+	}
+
+	return files, nil
+}
+
+func extractTar(data []byte, b *budget) ([]File, error) {
+	return readTar(bytes.NewReader(data), b)
+}
+
+func readTar(r io.Reader, b *budget) ([]File, error) {
+	reader := tar.NewReader(r)
+	files := make([]File, 0)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archive: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		body, err := b.read(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, File{Name: cleanName(header.Name), Body: body})
+	}
+
+	return files, nil
+}
+
+// extractGzip extracts tar.gz archives, other gzip files are returned as a single file
+func extractGzip(data []byte, b *budget) ([]File, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+	defer reader.Close()
+
+	// The size of the tar stream itself counts against the limits as well
+	inner, err := b.read(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if isTar(inner) {
+		b.size = 0
+		b.files = 0
+		return readTar(bytes.NewReader(inner), b)
+	}
+
+	name := reader.Name
+	if name == "" {
+		name = "file"
+	}
+
+	return []File{{Name: cleanName(name), Body: inner}}, nil
+}
+
+// isTar checks for the ustar magic of POSIX and GNU tar headers
+func isTar(data []byte) bool {
+	return len(data) >= 262 && bytes.Equal(data[257:262], []byte("ustar"))
+}
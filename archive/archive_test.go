@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createZip(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+
+	for name, body := range files {
+		w, err := writer.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write(body)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func createTarGz(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	writer := tar.NewWriter(gz)
+
+	for name, body := range files {
+		assert.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg}))
+		_, err := writer.Write(body)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	files := map[string][]byte{
+		"invoices/invoice.pdf": []byte("%PDF-1.4"),
+		"../../etc/passwd":     []byte("root"),
+	}
+
+	tests := []struct {
+		data     []byte
+		mimetype string
+	}{
+		{data: createZip(t, files), mimetype: "application/zip"},
+		{data: createTarGz(t, files), mimetype: "application/gzip"},
+	}
+
+	for _, test := range tests {
+		extracted, err := Extract(test.data, test.mimetype, Limits{})
+		assert.NoError(t, err)
+
+		names := make(map[string]string)
+		for _, f := range extracted {
+			names[f.Name] = string(f.Body)
+		}
+
+		assert.Equal(t, map[string]string{
+			"invoices/invoice.pdf": "%PDF-1.4",
+			"etc/passwd":           "root",
+		}, names)
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	bomb := createZip(t, map[string][]byte{"zeros": make([]byte, 1<<20)})
+
+	_, err := Extract(bomb, "application/zip", Limits{MaxRatio: 100})
+	assert.ErrorIs(t, err, ErrRatio)
+
+	_, err = Extract(bomb, "application/zip", Limits{MaxSize: 1 << 10})
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	many := createZip(t, map[string][]byte{"a": nil, "b": nil, "c": nil})
+	_, err = Extract(many, "application/zip", Limits{MaxFiles: 2})
+	assert.ErrorIs(t, err, ErrTooManyFiles)
+
+	_, err = Extract(bomb, "application/zip", Limits{MaxSize: 2 << 20, MaxRatio: 10000})
+	assert.NoError(t, err)
+
+	_, err = Extract(bomb, "application/vnd.rar", Limits{})
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
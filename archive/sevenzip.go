@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// 7z archives are read with github.com/bodgit/sevenzip, encrypted archives
+// are unsupported
+func extract7z(data []byte, b *budget) (files []File, err error) {
+	// The reader panics on some corrupted headers
+	defer func() {
+		if r := recover(); r != nil {
+			files, err = nil, fmt.Errorf("archive: invalid 7z archive: %v", r)
+		}
+	}()
+
+	reader, err := sevenzip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+
+	files = make([]File, 0, len(reader.File))
+	for _, f := range reader.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("archive: %s: %w", f.Name, err)
+		}
+
+		body, err := b.read(rc)
+		if closeErr := rc.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && f.CRC32 != 0 && crc32.ChecksumIEEE(body) != f.CRC32 {
+			err = errors.New("checksum error")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archive: %s: %w", f.Name, err)
+		}
+
+		files = append(files, File{Name: cleanName(f.Name), Body: body})
+	}
+
+	return files, nil
+}
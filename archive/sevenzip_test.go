@@ -0,0 +1,243 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Property IDs of the 7z header written by create7z
+const (
+	szEnd              = 0x00
+	szHeader           = 0x01
+	szMainStreamsInfo  = 0x04
+	szFilesInfo        = 0x05
+	szPackInfo         = 0x06
+	szUnpackInfo       = 0x07
+	szSubStreamsInfo   = 0x08
+	szSize             = 0x09
+	szCRC              = 0x0a
+	szFolder           = 0x0b
+	szCodersUnpackSize = 0x0c
+	szNumUnpackStream  = 0x0d
+	szEmptyStream      = 0x0e
+	szEmptyFile        = 0x0f
+	szName             = 0x11
+	szWinAttributes    = 0x15
+	szEncodedHeader    = 0x17
+)
+
+var sevenZipSignature = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+
+type sevenZipEntry struct {
+	name string
+	body []byte
+	dir  bool
+}
+
+func write7zNumber(buf *bytes.Buffer, v uint64) {
+	n := 0
+	for n < 8 && v >= 1<<(7*(n+1)) {
+		n++
+	}
+
+	first := byte(uint16(0xff00) >> n)
+	if n < 8 {
+		first |= byte(v >> (8 * n))
+	}
+	buf.WriteByte(first)
+
+	for i := 0; i < n; i++ {
+		buf.WriteByte(byte(v >> (8 * i)))
+	}
+}
+
+func compressLzma2(t *testing.T, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := lzma.Writer2Config{DictCap: 1 << 16}.NewWriter2(buf)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// write7zStreams writes a single LZMA2 folder holding the given streams
+func write7zStreams(buf *bytes.Buffer, packPos int, packed, unpacked []byte, streams [][]byte) {
+	buf.WriteByte(szPackInfo)
+	write7zNumber(buf, uint64(packPos))
+	write7zNumber(buf, 1)
+	buf.WriteByte(szSize)
+	write7zNumber(buf, uint64(len(packed)))
+	buf.WriteByte(szEnd)
+
+	// One coder with the LZMA2 method and a 64 KiB dictionary
+	buf.WriteByte(szUnpackInfo)
+	buf.WriteByte(szFolder)
+	write7zNumber(buf, 1)
+	buf.Write([]byte{0, 1, 0x21, 0x21, 1, 8})
+	buf.WriteByte(szCodersUnpackSize)
+	write7zNumber(buf, uint64(len(unpacked)))
+	buf.WriteByte(szCRC)
+	buf.WriteByte(1)
+	_ = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(unpacked))
+	buf.WriteByte(szEnd)
+
+	if len(streams) > 1 {
+		buf.WriteByte(szSubStreamsInfo)
+		buf.WriteByte(szNumUnpackStream)
+		write7zNumber(buf, uint64(len(streams)))
+		buf.WriteByte(szSize)
+		for _, stream := range streams[:len(streams)-1] {
+			write7zNumber(buf, uint64(len(stream)))
+		}
+		buf.WriteByte(szCRC)
+		buf.WriteByte(1)
+		for _, stream := range streams {
+			_ = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(stream))
+		}
+		buf.WriteByte(szEnd)
+	}
+
+	buf.WriteByte(szEnd)
+}
+
+func write7zProperty(buf *bytes.Buffer, id byte, data []byte) {
+	buf.WriteByte(id)
+	write7zNumber(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func write7zBits(bits []bool) []byte {
+	data := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+// create7z builds a solid archive like 7-Zip does, encodeHeader compresses
+// the header as well
+func create7z(t *testing.T, entries []sevenZipEntry, encodeHeader bool) []byte {
+	unpacked := new(bytes.Buffer)
+	streams := make([][]byte, 0)
+	emptyStreams, emptyFiles := make([]bool, 0), make([]bool, 0)
+	names := []byte{0}
+	// Every attribute is defined and stored inline, like 7-Zip does
+	attributes := []byte{1, 0}
+
+	for _, entry := range entries {
+		empty := entry.dir || len(entry.body) == 0
+		emptyStreams = append(emptyStreams, empty)
+		if empty {
+			emptyFiles = append(emptyFiles, !entry.dir)
+		} else {
+			streams = append(streams, entry.body)
+			unpacked.Write(entry.body)
+		}
+
+		for _, c := range utf16.Encode([]rune(entry.name)) {
+			names = binary.LittleEndian.AppendUint16(names, c)
+		}
+		names = append(names, 0, 0)
+
+		attribute := uint32(0x20)
+		if entry.dir {
+			attribute = 0x10
+		}
+		attributes = binary.LittleEndian.AppendUint32(attributes, attribute)
+	}
+
+	packed := compressLzma2(t, unpacked.Bytes())
+
+	header := new(bytes.Buffer)
+	header.WriteByte(szHeader)
+	header.WriteByte(szMainStreamsInfo)
+	write7zStreams(header, 0, packed, unpacked.Bytes(), streams)
+	header.WriteByte(szFilesInfo)
+	write7zNumber(header, uint64(len(entries)))
+	write7zProperty(header, szEmptyStream, write7zBits(emptyStreams))
+	write7zProperty(header, szEmptyFile, write7zBits(emptyFiles))
+	write7zProperty(header, szName, names)
+	write7zProperty(header, szWinAttributes, attributes)
+	header.WriteByte(szEnd)
+	header.WriteByte(szEnd)
+
+	body := packed
+	if encodeHeader {
+		packedHeader := compressLzma2(t, header.Bytes())
+		encoded := new(bytes.Buffer)
+		encoded.WriteByte(szEncodedHeader)
+		write7zStreams(encoded, len(body), packedHeader, header.Bytes(), nil)
+
+		body = append(body, packedHeader...)
+		header = encoded
+	}
+
+	start := make([]byte, 20)
+	binary.LittleEndian.PutUint64(start, uint64(len(body)))
+	binary.LittleEndian.PutUint64(start[8:], uint64(header.Len()))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(header.Bytes()))
+
+	out := new(bytes.Buffer)
+	out.Write(sevenZipSignature)
+	out.Write([]byte{0, 4})
+	_ = binary.Write(out, binary.LittleEndian, crc32.ChecksumIEEE(start))
+	out.Write(start)
+	out.Write(body)
+	out.Write(header.Bytes())
+	return out.Bytes()
+}
+
+func TestExtract7z(t *testing.T) {
+	entries := []sevenZipEntry{
+		{name: "invoices", dir: true},
+		{name: "invoices/invoice.pdf", body: []byte("%PDF-1.4")},
+		{name: "empty.txt"},
+		{name: "../../etc/passwd", body: []byte("root")},
+	}
+
+	for _, encodeHeader := range []bool{false, true} {
+		extracted, err := Extract(create7z(t, entries, encodeHeader), "application/x-7z-compressed", Limits{})
+		assert.NoError(t, err)
+
+		assert.Equal(t, []File{
+			{Name: "invoices/invoice.pdf", Body: []byte("%PDF-1.4")},
+			{Name: "empty.txt", Body: []byte{}},
+			{Name: "etc/passwd", Body: []byte("root")},
+		}, extracted)
+	}
+}
+
+func TestExtract7zInvalid(t *testing.T) {
+	bomb := create7z(t, []sevenZipEntry{{name: "zeros", body: make([]byte, 1<<20)}}, true)
+
+	_, err := Extract(bomb, "application/x-7z-compressed", Limits{MaxRatio: 100})
+	assert.ErrorIs(t, err, ErrRatio)
+
+	_, err = Extract(bomb, "application/x-7z-compressed", Limits{MaxSize: 1 << 10})
+	assert.ErrorIs(t, err, ErrTooLarge)
+
+	// Flipped bytes are rejected or don't change the files, e.g. in the
+	// version or in the end of the stream which is never read
+	data := create7z(t, []sevenZipEntry{{name: "a.txt", body: []byte("hello world")}}, false)
+	for i := range data {
+		corrupted := bytes.Clone(data)
+		corrupted[i] ^= 0xff
+
+		files, err := Extract(corrupted, "application/x-7z-compressed", Limits{})
+		if err == nil {
+			assert.Equal(t, []File{{Name: "a.txt", Body: []byte("hello world")}}, files, "byte %d", i)
+		}
+	}
+
+	_, err = Extract(data[:len(data)-1], "application/x-7z-compressed", Limits{})
+	assert.Error(t, err)
+}
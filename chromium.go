@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// chromiumOrigin is sent with the DevTools websocket handshake, browsers
+	// started elsewhere need --remote-allow-origins to accept it
+	chromiumOrigin = "http://localhost"
+	// chromiumLoadTimeout limits how long remote content may delay printing
+	chromiumLoadTimeout = 30 * time.Second
+	// chromiumMaxMessage allows large PDFs in a single DevTools response
+	chromiumMaxMessage = 512 << 20
+)
+
+// chromiumBinaries are looked up in PATH when no chromium path is configured
+var chromiumBinaries = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable"}
+
+// chromiumRenderer prints pages with headless Chromium over the DevTools
+// protocol. A browser is started for every document unless url points to a
+// running one, e.g. http://localhost:9222. Requests to other hosts than
+// allowedHosts are failed.
+type chromiumRenderer struct {
+	path         string
+	url          string
+	allowedHosts []string
+}
+
+func (r *chromiumRenderer) Render(ctx context.Context, pages [][]byte, options *PageOptions) ([]byte, error) {
+	html, err := combinePages(pages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine pages: %w", err)
+	}
+
+	browserURL := r.url
+	if browserURL == "" {
+		browser, err := r.launch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer browser.close()
+
+		browserURL = browser.url
+	}
+
+	wsURL, err := debuggerURL(ctx, browserURL)
+	if err != nil {
+		return nil, err
+	}
+
+	devtools, err := dialDevtools(ctx, wsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer devtools.close()
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := devtools.call(ctx, "", "Target.createTarget", map[string]any{"url": "about:blank"}, &target); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = devtools.call(context.WithoutCancel(ctx), "", "Target.closeTarget", map[string]any{"targetId": target.TargetID}, nil)
+	}()
+
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := devtools.call(ctx, "", "Target.attachToTarget", map[string]any{"targetId": target.TargetID, "flatten": true}, &attached); err != nil {
+		return nil, err
+	}
+	session := attached.SessionID
+
+	var tree struct {
+		FrameTree struct {
+			Frame struct {
+				ID string `json:"id"`
+			} `json:"frame"`
+		} `json:"frameTree"`
+	}
+	if err := devtools.call(ctx, session, "Page.enable", nil, nil); err != nil {
+		return nil, err
+	}
+	devtools.handle(session, "Fetch.requestPaused", func(params json.RawMessage) {
+		var paused struct {
+			RequestID string `json:"requestId"`
+			Request   struct {
+				URL string `json:"url"`
+			} `json:"request"`
+		}
+		if err := json.Unmarshal(params, &paused); err != nil {
+			return
+		}
+
+		if r.requestAllowed(paused.Request.URL) {
+			_ = devtools.call(ctx, session, "Fetch.continueRequest", map[string]any{"requestId": paused.RequestID}, nil)
+			return
+		}
+		_ = devtools.call(ctx, session, "Fetch.failRequest", map[string]any{"requestId": paused.RequestID, "errorReason": "BlockedByClient"}, nil)
+	})
+	if err := devtools.call(ctx, session, "Fetch.enable", map[string]any{"patterns": []map[string]any{{"urlPattern": "*"}}}, nil); err != nil {
+		return nil, err
+	}
+	if err := devtools.call(ctx, session, "Emulation.setScriptExecutionDisabled", map[string]any{"value": true}, nil); err != nil {
+		return nil, err
+	}
+	if err := devtools.call(ctx, session, "Page.getFrameTree", nil, &tree); err != nil {
+		return nil, err
+	}
+
+	loaded := devtools.subscribe(session, "Page.loadEventFired")
+	if err := devtools.call(ctx, session, "Page.setDocumentContent", map[string]any{
+		"frameId": tree.FrameTree.Frame.ID,
+		"html":    string(html),
+	}, nil); err != nil {
+		return nil, err
+	}
+
+	// Print anyway if remote content doesn't finish loading in time
+	select {
+	case <-loaded:
+	case <-time.After(chromiumLoadTimeout):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var printed struct {
+		Data string `json:"data"`
+	}
+	if err := devtools.call(ctx, session, "Page.printToPDF", map[string]any{
+		"paperWidth":      options.Width / 25.4,
+		"paperHeight":     options.Height / 25.4,
+		"marginTop":       options.Margins.Top / 25.4,
+		"marginRight":     options.Margins.Right / 25.4,
+		"marginBottom":    options.Margins.Bottom / 25.4,
+		"marginLeft":      options.Margins.Left / 25.4,
+		"printBackground": true,
+	}, &printed); err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(printed.Data)
+}
+
+// requestAllowed reports whether the browser may load rawURL. Pages were
+// rewritten already, this blocks what the rewriter missed.
+func (r *chromiumRenderer) requestAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "data", "about":
+		return true
+	case "http", "https":
+		return hostAllowed(u.Hostname(), r.allowedHosts)
+	}
+
+	return false
+}
+
+// chromiumProcess is a headless browser started for a single document
+type chromiumProcess struct {
+	cmd     *exec.Cmd
+	dataDir string
+	url     string
+}
+
+func (r *chromiumRenderer) launch(ctx context.Context) (*chromiumProcess, error) {
+	path := r.path
+	if path == "" {
+		for _, name := range chromiumBinaries {
+			if found, err := exec.LookPath(name); err == nil {
+				path = found
+				break
+			}
+		}
+		if path == "" {
+			return nil, errors.New("chromium not found")
+		}
+	}
+
+	dataDir, err := os.MkdirTemp("", "mail-downloader-chromium-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chromium profile: %w", err)
+	}
+
+	cmd := exec.Command(path,
+		"--headless=new",
+		"--disable-gpu",
+		"--disable-extensions",
+		"--no-first-run",
+		"--no-default-browser-check",
+		"--remote-debugging-port=0",
+		"--remote-allow-origins="+chromiumOrigin,
+		"--user-data-dir="+dataDir,
+		"about:blank",
+	)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		_ = os.RemoveAll(dataDir)
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		_ = os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("failed to start chromium: %w", err)
+	}
+
+	process := &chromiumProcess{cmd: cmd, dataDir: dataDir}
+
+	// Chromium prints the websocket url of the browser once it listens
+	found := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if url, ok := strings.CutPrefix(scanner.Text(), "DevTools listening on "); ok {
+				found <- url
+				break
+			}
+		}
+		close(found)
+		_, _ = io.Copy(io.Discard, stderr)
+	}()
+
+	select {
+	case url, ok := <-found:
+		if !ok {
+			process.close()
+			return nil, errors.New("chromium exited before listening")
+		}
+		process.url = url
+	case <-ctx.Done():
+		process.close()
+		return nil, ctx.Err()
+	}
+
+	return process, nil
+}
+
+func (process *chromiumProcess) close() {
+	_ = process.cmd.Process.Kill()
+	_ = process.cmd.Wait()
+	_ = os.RemoveAll(process.dataDir)
+}
+
+// debuggerURL returns the websocket url of a browser. Websocket urls are
+// returned as they are, http urls are resolved with /json/version.
+func debuggerURL(ctx context.Context, url string) (string, error) {
+	if strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+		return url, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(url, "/")+"/json/version", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query chromium: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to query chromium: %s", resp.Status)
+	}
+
+	var version struct {
+		WebSocketDebuggerURL string `json:"webSocketDebuggerUrl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return "", fmt.Errorf("failed to query chromium: %w", err)
+	}
+
+	return version.WebSocketDebuggerURL, nil
+}
+
+// devtools is a minimal DevTools protocol client. Responses are matched to
+// calls by id, events are only delivered to subscribers.
+type devtools struct {
+	conn *websocket.Conn
+
+	mu          sync.Mutex
+	id          int64
+	pending     map[int64]chan *devtoolsMessage
+	subscribers map[string]chan struct{}
+	handlers    map[string]func(params json.RawMessage)
+	err         error
+	done        chan struct{}
+}
+
+type devtoolsMessage struct {
+	ID        int64           `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *devtoolsError  `json:"error,omitempty"`
+}
+
+type devtoolsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *devtoolsError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+func dialDevtools(ctx context.Context, url string) (*devtools, error) {
+	config, err := websocket.NewConfig(url, chromiumOrigin)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to chromium: %w", err)
+	}
+	conn.MaxPayloadBytes = chromiumMaxMessage
+
+	devtools := &devtools{
+		conn:        conn,
+		pending:     make(map[int64]chan *devtoolsMessage),
+		subscribers: make(map[string]chan struct{}),
+		handlers:    make(map[string]func(params json.RawMessage)),
+		done:        make(chan struct{}),
+	}
+	go devtools.read()
+
+	return devtools, nil
+}
+
+func (d *devtools) read() {
+	for {
+		message := new(devtoolsMessage)
+		if err := websocket.JSON.Receive(d.conn, message); err != nil {
+			d.mu.Lock()
+			d.err = err
+			d.mu.Unlock()
+			close(d.done)
+			return
+		}
+
+		d.mu.Lock()
+		if message.ID != 0 {
+			if response, ok := d.pending[message.ID]; ok {
+				delete(d.pending, message.ID)
+				response <- message
+			}
+		} else if event, ok := d.subscribers[message.SessionID+" "+message.Method]; ok {
+			delete(d.subscribers, message.SessionID+" "+message.Method)
+			close(event)
+		} else if handler, ok := d.handlers[message.SessionID+" "+message.Method]; ok {
+			// Handlers may call commands, whose responses are read here
+			go handler(message.Params)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// subscribe returns a channel which is closed on the next event of method in session
+func (d *devtools) subscribe(session, method string) <-chan struct{} {
+	event := make(chan struct{})
+
+	d.mu.Lock()
+	d.subscribers[session+" "+method] = event
+	d.mu.Unlock()
+
+	return event
+}
+
+// handle calls handler with the params of every event of method in session
+func (d *devtools) handle(session, method string, handler func(params json.RawMessage)) {
+	d.mu.Lock()
+	d.handlers[session+" "+method] = handler
+	d.mu.Unlock()
+}
+
+// call sends a command and decodes its result into result if it isn't nil
+func (d *devtools) call(ctx context.Context, session, method string, params, result any) error {
+	var raw json.RawMessage
+	if params != nil {
+		var err error
+		if raw, err = json.Marshal(params); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", method, err)
+		}
+	}
+
+	response := make(chan *devtoolsMessage, 1)
+
+	d.mu.Lock()
+	if d.err != nil {
+		d.mu.Unlock()
+		return fmt.Errorf("chromium connection closed: %w", d.err)
+	}
+	d.id++
+	id := d.id
+	d.pending[id] = response
+	d.mu.Unlock()
+
+	request := &devtoolsMessage{ID: id, Method: method, SessionID: session, Params: raw}
+	if err := websocket.JSON.Send(d.conn, request); err != nil {
+		return fmt.Errorf("failed to send %s: %w", method, err)
+	}
+
+	select {
+	case message := <-response:
+		if message.Error != nil {
+			return fmt.Errorf("%s failed: %w", method, message.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(message.Result, result)
+	case <-d.done:
+		return fmt.Errorf("chromium connection closed: %w", d.err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *devtools) close() {
+	_ = d.conn.Close()
+	<-d.done
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// pdfCreator is written to the document information and XMP metadata
+const pdfCreator = "mail-downloader"
+
+func init() {
+	// pdfcpu would create a config directory in the home directory otherwise
+	api.DisableConfigDir()
+}
+
+// pdfPart is a section of a combined PDF, pages start at 1
+type pdfPart struct {
+	Name      string `json:"name"`
+	FirstPage int    `json:"first_page"`
+	LastPage  int    `json:"last_page"`
+}
+
+func pdfConfig() *model.Configuration {
+	conf := model.NewDefaultConfiguration()
+	conf.Cmd = model.MERGECREATE
+	conf.ValidationMode = model.ValidationRelaxed
+	conf.CreateBookmarks = false
+	return conf
+}
+
+// readPdf reads and validates data. pdfcpu panics on some malformed files,
+// which are returned as error instead.
+func readPdf(data []byte) (ctx *model.Context, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ctx, err = nil, fmt.Errorf("invalid PDF: %v", r)
+		}
+	}()
+
+	return api.ReadAndValidate(bytes.NewReader(data), pdfConfig())
+}
+
+// finishPdf applies the combine, PDF/A and embed options of the config to the
+// rendered body, which may be nil. It returns nil if there is nothing to write.
+func (mail *mail) finishPdf(config *Config, body []byte) ([]byte, []pdfPart, error) {
+	if !config.Pdf.Combine && !config.Pdf.PdfA && !config.Pdf.EmbedEml {
+		return body, nil, nil
+	}
+
+	ctx, parts, err := mail.buildPdf(config, body)
+	if err != nil || ctx == nil {
+		return nil, nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := api.WriteContext(ctx, buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to write PDF: %w", err)
+	}
+
+	// pdfcpu stamps the document information with the time of writing, which
+	// the XMP metadata of PDF/A has to match
+	if config.Pdf.PdfA {
+		if err := setXmpDates(ctx, buf.Bytes()); err != nil {
+			return nil, nil, fmt.Errorf("failed to write PDF: %w", err)
+		}
+	}
+
+	if !config.Pdf.Combine {
+		parts = nil
+	}
+
+	return buf.Bytes(), parts, nil
+}
+
+// buildPdf returns the document to write or nil if there is none
+func (mail *mail) buildPdf(config *Config, body []byte) (*model.Context, []pdfPart, error) {
+	ctx, parts, err := mail.appendPdfs(config, body)
+	if err != nil || ctx == nil {
+		return nil, nil, err
+	}
+
+	info := map[string]string{"Title": mail.Subject}
+
+	if config.Pdf.Combine {
+		bookmarks := make([]pdfcpu.Bookmark, len(parts))
+		for i, part := range parts {
+			bookmarks[i] = pdfcpu.Bookmark{Title: part.Name, PageFrom: part.FirstPage}
+		}
+
+		if err := pdfcpu.AddBookmarks(ctx, bookmarks, true); err != nil {
+			return nil, nil, fmt.Errorf("failed to add bookmarks: %w", err)
+		}
+	}
+
+	if config.Pdf.EmbedEml {
+		if err := mail.embedEml(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if config.Pdf.PdfA {
+		if err := mail.archival(ctx, config, info); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := pdfcpu.PropertiesAdd(ctx, info); err != nil {
+		return nil, nil, fmt.Errorf("failed to set document information: %w", err)
+	}
+
+	return ctx, parts, nil
+}
+
+// appendPdfs reads body and, if combine is set, appends all PDF attachments
+// including those extracted from archives. Attachments which can't be read, or
+// aren't PDF/A if pdfa is set, are skipped.
+func (mail *mail) appendPdfs(config *Config, body []byte) (*model.Context, []pdfPart, error) {
+	combine, pdfa := config.Pdf.Combine, config.Pdf.PdfA
+	var ctx *model.Context
+	parts := make([]pdfPart, 0)
+
+	add := func(name string, data []byte, attached bool) error {
+		doc, err := readPdf(data)
+		if err != nil {
+			return err
+		}
+
+		if pdfa && attached {
+			if err := checkPdfA(doc); err != nil {
+				return err
+			}
+		}
+
+		first := 0
+		if ctx == nil {
+			ctx = doc
+			ctx.EnsureVersionForWriting()
+		} else {
+			if doc.XRefTable.Version() == model.V20 && ctx.XRefTable.Version() < model.V20 {
+				return pdfcpu.ErrUnsupportedVersion
+			}
+
+			first = ctx.PageCount
+			if err := pdfcpu.MergeXRefTables(name, doc, ctx, false, false); err != nil {
+				return err
+			}
+		}
+
+		parts = append(parts, pdfPart{Name: name, FirstPage: first + 1, LastPage: first + doc.PageCount})
+		return nil
+	}
+
+	if body != nil {
+		name := mail.Subject
+		if name == "" {
+			name = "Mail"
+		}
+
+		if err := add(name, body, false); err != nil {
+			return nil, nil, fmt.Errorf("failed to read mail PDF: %w", err)
+		}
+	}
+
+	if !combine {
+		return ctx, parts, nil
+	}
+
+	attachments, _ := mail.attachments(config)
+	for _, att := range attachments {
+		if mimeType(att.Mimetype) != "application/pdf" {
+			continue
+		}
+
+		name := att.Filename
+		if att.Origin != "" {
+			name = att.Origin
+		}
+
+		if err := add(name, att.Body, true); err != nil {
+			log.Printf("Skipping PDF attachment %s of mail %d: %v", name, mail.Uid, err)
+		}
+	}
+
+	return ctx, parts, nil
+}
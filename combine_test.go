@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/go-pdf/fpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func createPdf(t *testing.T, pages int) []byte {
+	doc := fpdf.New("P", "mm", "A4", "")
+	for i := 0; i < pages; i++ {
+		doc.AddPage()
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, doc.Output(buf))
+	return buf.Bytes()
+}
+
+// validatePdf checks data against the PDF specification
+func validatePdf(t *testing.T, data []byte, mode int) {
+	conf := pdfConfig()
+	conf.ValidationMode = mode
+	assert.NoError(t, api.Validate(bytes.NewReader(data), conf))
+}
+
+func readTestPdf(t *testing.T, data []byte) (*model.Context, types.Dict) {
+	ctx, err := api.ReadAndValidate(bytes.NewReader(data), pdfConfig())
+	assert.NoError(t, err)
+	root, err := ctx.Catalog()
+	assert.NoError(t, err)
+	return ctx, root
+}
+
+func TestFinishPdfCombine(t *testing.T) {
+	options, err := newPageOptions(new(Config))
+	assert.NoError(t, err)
+
+	body, err := new(nativeRenderer).Render(context.Background(), [][]byte{[]byte("<p>Invoice attached</p>")}, options)
+	assert.NoError(t, err)
+
+	docs := new(bytes.Buffer)
+	writer := zip.NewWriter(docs)
+	w, err := writer.Create("terms.pdf")
+	assert.NoError(t, err)
+	_, err = w.Write(createPdf(t, 1))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	invoice := &mail{
+		Uid:     1,
+		Subject: "Invoice",
+		Attachments: []*attachment{
+			{Filename: "invoice.pdf", Mimetype: "application/pdf", Body: createPdf(t, 2)},
+			{Filename: "logo.png", Mimetype: "image/png", Body: []byte("png")},
+			{Filename: "broken.pdf", Mimetype: "application/pdf", Body: []byte("%PDF-1.4 broken")},
+			{Filename: "docs.zip", Mimetype: "application/zip", Body: docs.Bytes()},
+		},
+	}
+
+	config := new(Config)
+	config.Pdf.Combine = true
+	config.Attachments.Archives.Enabled = true
+
+	combined, parts, err := invoice.finishPdf(config, body)
+	assert.NoError(t, err)
+	assert.Equal(t, []pdfPart{
+		{Name: "Invoice", FirstPage: 1, LastPage: 1},
+		{Name: "invoice.pdf", FirstPage: 2, LastPage: 3},
+		{Name: "docs.zip!/terms.pdf", FirstPage: 4, LastPage: 4},
+	}, parts)
+
+	ctx, _ := readTestPdf(t, combined)
+	assert.Equal(t, 4, ctx.PageCount)
+
+	bookmarks, err := api.Bookmarks(bytes.NewReader(combined), nil)
+	assert.NoError(t, err)
+	assert.Len(t, bookmarks, 3)
+	assert.Equal(t, "invoice.pdf", bookmarks[1].Title)
+	assert.Equal(t, 2, bookmarks[1].PageFrom)
+	assert.Equal(t, "docs.zip!/terms.pdf", bookmarks[2].Title)
+	assert.Equal(t, 4, bookmarks[2].PageFrom)
+
+	// Mails without body and PDF attachments have nothing to combine
+	combined, parts, err = new(mail).finishPdf(config, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, combined)
+	assert.Nil(t, parts)
+}
+
+func TestFinishPdfArchival(t *testing.T) {
+	config := new(Config)
+	config.Pdf.PdfA = true
+
+	invoice := &mail{
+		Uid:       7,
+		Subject:   "Invoice & receipt",
+		MessageID: "abc@vendor",
+		Mailbox:   "INBOX",
+		From:      []*i.Address{{PersonalName: "Vendor", MailboxName: "billing", HostName: "vendor.com"}},
+		Date:      time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		Raw:       []byte("Subject: Invoice\r\n\r\nbody"),
+	}
+
+	data, parts, err := invoice.finishPdf(config, createPdf(t, 1))
+	assert.NoError(t, err)
+	assert.Nil(t, parts)
+	validatePdf(t, data, model.ValidationStrict)
+
+	ctx, root := readTestPdf(t, data)
+	assert.Nil(t, root["Names"])
+
+	stream, _, err := ctx.DereferenceStreamDict(root["Metadata"])
+	assert.NoError(t, err)
+	assert.Nil(t, stream.FilterPipeline)
+	metadata := stream.Raw
+
+	decoder := xml.NewDecoder(bytes.NewReader(metadata))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if err != nil {
+			break
+		}
+	}
+	assert.Contains(t, string(metadata), "<pdfaid:part>2</pdfaid:part>")
+	assert.Contains(t, string(metadata), "Invoice &amp; receipt")
+	assert.Contains(t, string(metadata), "<mail:MessageID>abc@vendor</mail:MessageID>")
+	assert.Contains(t, string(metadata), "<dc:date><rdf:Seq><rdf:li>2024-03-01T10:00:00Z</rdf:li></rdf:Seq></dc:date>")
+
+	intents, err := ctx.DereferenceArray(root["OutputIntents"])
+	assert.NoError(t, err)
+	assert.Len(t, intents, 1)
+	intent, err := ctx.DereferenceDict(intents[0])
+	assert.NoError(t, err)
+	assert.Equal(t, types.Name("GTS_PDFA1"), intent["S"])
+
+	// The document information matches the XMP metadata
+	info, err := ctx.DereferenceDict(*ctx.Info)
+	assert.NoError(t, err)
+	created, ok := types.DateTime(info["CreationDate"].(types.StringLiteral).Value(), false)
+	assert.True(t, ok)
+	assert.Contains(t, string(metadata), "<xmp:CreateDate>"+created.Format(xmpDateLayout)+"</xmp:CreateDate>")
+	assert.Contains(t, string(metadata), "<xmp:ModifyDate>"+created.Format(xmpDateLayout)+"</xmp:ModifyDate>")
+	assert.Contains(t, string(metadata), "<pdf:Producer>pdfcpu "+model.VersionStr+"</pdf:Producer>")
+
+	// Embedding the mail requires PDF/A-3
+	config.Pdf.EmbedEml = true
+	assert.Error(t, config.validate())
+	config.Pdf.PdfAPart = 3
+	assert.NoError(t, config.validate())
+	data, _, err = invoice.finishPdf(config, createPdf(t, 1))
+	assert.NoError(t, err)
+	// Strict validation rejects AFRelationship in PDF 1.7 files, which PDF/A-3
+	// requires
+	validatePdf(t, data, model.ValidationRelaxed)
+
+	ctx, root = readTestPdf(t, data)
+	stream, _, err = ctx.DereferenceStreamDict(root["Metadata"])
+	assert.NoError(t, err)
+	assert.Contains(t, string(stream.Raw), "<pdfaid:part>3</pdfaid:part>")
+
+	attachments, err := ctx.ListAttachments()
+	assert.NoError(t, err)
+	assert.Len(t, attachments, 1)
+	assert.Equal(t, "7.eml", attachments[0].FileName)
+
+	af, err := ctx.DereferenceArray(root["AF"])
+	assert.NoError(t, err)
+	spec, err := ctx.DereferenceDict(af[0])
+	assert.NoError(t, err)
+	assert.Equal(t, types.Name("Source"), spec["AFRelationship"])
+
+	embedded, _, err := ctx.DereferenceStreamDict(spec.DictEntry("EF")["F"])
+	assert.NoError(t, err)
+	assert.Equal(t, types.Name("message/rfc822"), embedded.Dict["Subtype"])
+}
+
+func TestFinishPdfArchivalCombine(t *testing.T) {
+	config := new(Config)
+	config.Pdf.PdfA = true
+
+	archived, _, err := (&mail{Subject: "Terms"}).finishPdf(config, createPdf(t, 1))
+	assert.NoError(t, err)
+
+	invoice := &mail{
+		Uid:     1,
+		Subject: "Invoice",
+		Attachments: []*attachment{
+			{Filename: "invoice.pdf", Mimetype: "application/pdf", Body: createPdf(t, 2)},
+			{Filename: "terms.pdf", Mimetype: "application/pdf", Body: archived},
+		},
+	}
+
+	// Only attachments which are PDF/A themselves are appended
+	config.Pdf.Combine = true
+	data, parts, err := invoice.finishPdf(config, createPdf(t, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, []pdfPart{
+		{Name: "Invoice", FirstPage: 1, LastPage: 1},
+		{Name: "terms.pdf", FirstPage: 2, LastPage: 2},
+	}, parts)
+	validatePdf(t, data, model.ValidationStrict)
+}
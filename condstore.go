@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	i "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// RFC 7162 capabilities and status item
+const (
+	condstoreCapability = "CONDSTORE"
+	qresyncCapability   = "QRESYNC"
+	highestModSeq       = i.StatusItem("HIGHESTMODSEQ")
+)
+
+// modSeqState is the sync state of a mailbox, modseqs are only comparable
+// as long as the UIDVALIDITY stays the same
+type modSeqState struct {
+	UidValidity uint32
+	ModSeq      uint64
+}
+
+func (state modSeqState) String() string {
+	return fmt.Sprintf("modseq:%d:%d", state.UidValidity, state.ModSeq)
+}
+
+func parseModSeqState(s string) (modSeqState, bool) {
+	var state modSeqState
+	if _, err := fmt.Sscanf(s, "modseq:%d:%d", &state.UidValidity, &state.ModSeq); err != nil {
+		return modSeqState{}, false
+	}
+
+	return state, true
+}
+
+// rawCommand is a command without a type in go-imap
+type rawCommand struct {
+	name string
+	args []interface{}
+}
+
+func (cmd *rawCommand) Command() *i.Command {
+	return &i.Command{Name: cmd.name, Arguments: cmd.args}
+}
+
+func (imap *imap) execute(cmd i.Commander, handler responses.Handler) error {
+	status, err := imap.Client.Execute(cmd, handler)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// enableQresync enables QRESYNC, which must happen before selecting a mailbox
+func (imap *imap) enableQresync() error {
+	cmd := &rawCommand{name: "ENABLE", args: []interface{}{i.RawString(qresyncCapability)}}
+	if err := imap.execute(cmd, nil); err != nil {
+		return &ConnectionError{Op: "enable", Err: err}
+	}
+
+	return nil
+}
+
+// modSeqState returns the current state of mailbox, ok is false if the
+// mailbox doesn't support modseqs
+func (imap *imap) modSeqState(mailbox string) (modSeqState, bool, error) {
+	status, err := imap.Client.Status(mailbox, []i.StatusItem{i.StatusUidValidity, highestModSeq})
+	if err != nil {
+		return modSeqState{}, false, &ConnectionError{Op: "status " + mailbox, Err: err}
+	}
+
+	modSeq, err := strconv.ParseUint(gmailString(status.Items[highestModSeq]), 10, 64)
+	if err != nil || modSeq == 0 {
+		return modSeqState{}, false, nil
+	}
+
+	return modSeqState{UidValidity: status.UidValidity, ModSeq: modSeq}, true, nil
+}
+
+// changedSince returns the uids changed since modSeq in the selected mailbox.
+// With QRESYNC the uids expunged since then are returned as well.
+func (imap *imap) changedSince(ctx context.Context, modSeq uint64, qresync bool) ([]uint32, *i.SeqSet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	modifiers := []interface{}{i.RawString("CHANGEDSINCE"), i.RawString(strconv.FormatUint(modSeq, 10))}
+	if qresync {
+		modifiers = append(modifiers, i.RawString("VANISHED"))
+	}
+
+	all := new(i.SeqSet)
+	all.AddRange(1, 0)
+	cmd := &commands.Uid{Cmd: &rawCommand{name: "FETCH", args: []interface{}{
+		all, []interface{}{i.RawString(i.FetchUid)}, modifiers,
+	}}}
+
+	changed := make([]uint32, 0)
+	vanished := new(i.SeqSet)
+	handler := responses.HandlerFunc(func(resp i.Resp) error {
+		name, fields, ok := i.ParseNamedResp(resp)
+		if !ok {
+			return responses.ErrUnhandled
+		}
+
+		switch {
+		case name == "FETCH" && len(fields) > 1:
+			list, _ := fields[1].([]interface{})
+			message := new(i.Message)
+			if err := message.Parse(list); err != nil {
+				return err
+			}
+			changed = append(changed, message.Uid)
+		case name == "VANISHED" && len(fields) > 0:
+			// "VANISHED (EARLIER) 41,43:116"
+			set, err := i.ParseSeqSet(gmailString(fields[len(fields)-1]))
+			if err != nil {
+				return err
+			}
+			vanished.AddSet(set)
+		default:
+			return responses.ErrUnhandled
+		}
+
+		return nil
+	})
+
+	if err := imap.execute(cmd, handler); err != nil {
+		return nil, nil, &ConnectionError{Op: "fetch changes", Err: err}
+	}
+
+	return changed, vanished, nil
+}
+
+// existing returns which of the uids still exist in the selected mailbox
+func (imap *imap) existing(ctx context.Context, uids []uint32) (map[uint32]bool, error) {
+	exists := make(map[uint32]bool, len(uids))
+	if len(uids) == 0 {
+		return exists, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	search := i.NewSearchCriteria()
+	search.Uid = imap.createSeqSet(uids)
+
+	found, err := imap.Client.UidSearch(search)
+	if err != nil {
+		return nil, &ConnectionError{Op: "search", Err: err}
+	}
+
+	for _, uid := range found {
+		exists[uid] = true
+	}
+
+	return exists, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveImap answers the commands used to track changes with canned responses
+func serveImap(conn net.Conn, capabilities string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			fmt.Fprintf(conn, "%s\r\n", line)
+		}
+	}
+
+	reply("* OK [CAPABILITY " + capabilities + "] ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		tag, command := fields[0], strings.ToUpper(strings.Join(fields[1:], " "))
+		switch {
+		case strings.HasPrefix(command, "LOGIN"):
+			reply(tag + " OK logged in")
+		case strings.HasPrefix(command, "CAPABILITY"):
+			reply("* CAPABILITY "+capabilities, tag+" OK done")
+		case strings.HasPrefix(command, "ENABLE"):
+			reply("* ENABLED QRESYNC", tag+" OK done")
+		case strings.HasPrefix(command, "STATUS"):
+			reply("* STATUS INBOX (UIDVALIDITY 7 HIGHESTMODSEQ 200)", tag+" OK done")
+		case strings.HasPrefix(command, "EXAMINE"):
+			reply("* 3 EXISTS", "* OK [UIDVALIDITY 7] ok", "* OK [HIGHESTMODSEQ 200] ok", tag+" OK [READ-ONLY] selected")
+		case strings.HasPrefix(command, "LIST"):
+			reply(`* LIST () "/" INBOX`, tag+" OK done")
+		case strings.HasPrefix(command, "UID SEARCH") && strings.Contains(command, "SINCE"):
+			// 6 is in the range but wasn't downloaded and didn't change
+			reply("* SEARCH 1 2 3 6", tag+" OK done")
+		case strings.HasPrefix(command, "UID SEARCH"):
+			// Known uids which still exist
+			reply("* SEARCH 1", tag+" OK done")
+		case strings.HasPrefix(command, "UID FETCH 1:* (UID) (CHANGEDSINCE 100 VANISHED)"):
+			reply("* VANISHED (EARLIER) 4:5", "* 3 FETCH (UID 3 MODSEQ (150))", tag+" OK done")
+		case strings.HasPrefix(command, "UID FETCH 1:* (UID) (CHANGEDSINCE 100)"):
+			reply("* 2 FETCH (UID 2 MODSEQ (120))", "* 3 FETCH (UID 3 MODSEQ (150))", tag+" OK done")
+		default:
+			reply(tag + " BAD unexpected " + command)
+		}
+	}
+}
+
+func trackChanges(t *testing.T, capabilities string) ([]uint32, *mailList, *imapSource) {
+	serverConn, clientConn := net.Pipe()
+	go serveImap(serverConn, capabilities)
+
+	c, err := client.New(clientConn)
+	assert.NoError(t, err)
+	defer c.Close()
+
+	ctx := context.Background()
+	source := &imapSource{imap: &imap{Username: "user", Client: c}, mailbox: "INBOX"}
+	assert.NoError(t, source.login(ctx))
+	assert.NoError(t, source.open(ctx))
+
+	mailList, err := newMailList(newLocalStorage(t.TempDir()), "user", "imap", "localhost", "mail/user")
+	assert.NoError(t, err)
+	for _, uid := range []uint32{1, 2, 4} {
+		assert.NoError(t, mailList.addMail(ctx, &mail{Uid: uid, Mailbox: "INBOX"}))
+	}
+	// Mails of other mailboxes aren't checked against the selected one
+	for _, uid := range []uint32{2, 4} {
+		assert.NoError(t, mailList.addMail(ctx, &mail{Uid: uid, Mailbox: "Archive"}))
+	}
+	assert.NoError(t, mailList.setSyncState(ctx, "modseq:7:100"))
+	source.Track(mailList)
+
+	uids, err := source.Search(ctx, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+
+	// The state is kept until the mails were processed
+	assert.NoError(t, source.Fetch(ctx, nil, make(chan *mail)))
+	assert.NoError(t, source.Commit(ctx, mailList))
+	assert.Equal(t, "modseq:7:100", mailList.syncState())
+
+	return uids, mailList, source
+}
+
+func TestQresync(t *testing.T) {
+	uids, mailList, _ := trackChanges(t, "IMAP4rev1 CONDSTORE QRESYNC")
+	assert.Equal(t, []uint32{3, 6}, uids)
+
+	deleted := make([]string, 0)
+	for _, jm := range mailList.List {
+		if jm.Deleted {
+			deleted = append(deleted, fmt.Sprintf("%s/%d", jm.Mailbox, jm.Uid))
+		}
+	}
+	assert.Equal(t, []string{"INBOX/4"}, deleted)
+}
+
+func TestCondstore(t *testing.T) {
+	uids, mailList, source := trackChanges(t, "IMAP4rev1 CONDSTORE")
+	assert.Equal(t, []uint32{2, 3, 6}, uids)
+	assert.Equal(t, []uint32{1}, mailList.uids("INBOX"))
+	assert.Equal(t, []uint32{2, 4}, mailList.uids("Archive"))
+
+	// A failed mail keeps the state, it is stored once all mails were processed
+	ctx := context.Background()
+	assert.NoError(t, mailList.addMail(ctx, &mail{Uid: 2, Mailbox: "INBOX"}))
+	assert.NoError(t, mailList.addMail(ctx, &mail{Uid: 6, Mailbox: "INBOX"}))
+	assert.NoError(t, mailList.addFailure(ctx, &mail{Uid: 3, Mailbox: "INBOX"}, errors.New("failed"), ""))
+	assert.NoError(t, source.Commit(ctx, mailList))
+	assert.Equal(t, "modseq:7:100", mailList.syncState())
+
+	assert.NoError(t, mailList.addMail(ctx, &mail{Uid: 3, Mailbox: "INBOX"}))
+	assert.NoError(t, source.Commit(ctx, mailList))
+	assert.Equal(t, "modseq:7:200", mailList.syncState())
+}
+
+func TestGmailOptIn(t *testing.T) {
+	for _, useGmail := range []bool{false, true} {
+		serverConn, clientConn := net.Pipe()
+		go serveImap(serverConn, "IMAP4rev1 X-GM-EXT-1")
+
+		c, err := client.New(clientConn)
+		assert.NoError(t, err)
+
+		// Gmail servers are only treated as such when it is enabled
+		imap := &imap{Username: "user", Client: c, UseGmail: useGmail}
+		assert.NoError(t, imap.login(context.Background()))
+		assert.Equal(t, useGmail, imap.Gmail)
+		c.Close()
+	}
+}
+
+func TestParseModSeqState(t *testing.T) {
+	state, ok := parseModSeqState(modSeqState{UidValidity: 7, ModSeq: 1 << 40}.String())
+	assert.True(t, ok)
+	assert.Equal(t, modSeqState{UidValidity: 7, ModSeq: 1 << 40}, state)
+
+	// States of other sources are ignored
+	_, ok = parseModSeqState("42")
+	assert.False(t, ok)
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
 type Config struct {
 	Imap struct {
 		Username string `yaml:"username"`
@@ -8,11 +15,187 @@ type Config struct {
 		Port     string `yaml:"port"`
 	} `yaml:"imap"`
 
+	Source struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path"`
+	} `yaml:"source"`
+
+	Gmail struct {
+		Enabled          bool   `yaml:"enabled"`
+		Query            string `yaml:"query"`
+		LabelDirectories bool   `yaml:"label_directories"`
+	} `yaml:"gmail"`
+
+	Pop3 struct {
+		Username      string `yaml:"username"`
+		Password      string `yaml:"password"`
+		Server        string `yaml:"server"`
+		Port          string `yaml:"port"`
+		Security      string `yaml:"security"`
+		LeaveOnServer bool   `yaml:"leave_on_server"`
+	} `yaml:"pop3"`
+
+	Jmap struct {
+		Session  string `yaml:"session"`
+		Token    string `yaml:"token"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"jmap"`
+
 	Attachments struct {
 		Mimetypes []string `yaml:"mimetypes"`
+		Archives  struct {
+			Enabled   bool     `yaml:"enabled"`
+			Mimetypes []string `yaml:"mimetypes"`
+			MaxSize   int64    `yaml:"max_size"`
+			MaxFiles  int      `yaml:"max_files"`
+			MaxRatio  int      `yaml:"max_ratio"`
+		} `yaml:"archives"`
 	} `yaml:"attachments"`
 
 	Mails struct {
-		Subjects []string `yaml:"subjects"`
+		Subjects    []string `yaml:"subjects"`
+		RemoteHosts []string `yaml:"remote_hosts"`
+		SaveEml     bool     `yaml:"save_eml"`
+		Header      struct {
+			Enabled  bool     `yaml:"enabled"`
+			Fields   []string `yaml:"fields"`
+			Template string   `yaml:"template"`
+		} `yaml:"header"`
 	} `yaml:"mails"`
+
+	Pdf struct {
+		Renderer    string   `yaml:"renderer"`
+		PageSize    string   `yaml:"page_size"`
+		Orientation string   `yaml:"orientation"`
+		Margins     *Margins `yaml:"margins"`
+		Combine     bool     `yaml:"combine"`
+		PdfA        bool     `yaml:"pdfa"`
+		PdfAPart    int      `yaml:"pdfa_part"`
+		EmbedEml    bool     `yaml:"embed_eml"`
+		Chromium    struct {
+			Path string `yaml:"path"`
+			URL  string `yaml:"url"`
+		} `yaml:"chromium"`
+	} `yaml:"pdf"`
+
+	Export struct {
+		Maildir string `yaml:"maildir"`
+		Mbox    string `yaml:"mbox"`
+		All     bool   `yaml:"all"`
+	} `yaml:"export"`
+
+	Storage struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path"`
+		S3   struct {
+			Endpoint   string `yaml:"endpoint"`
+			Region     string `yaml:"region"`
+			Bucket     string `yaml:"bucket"`
+			Prefix     string `yaml:"prefix"`
+			AccessKey  string `yaml:"access_key"`
+			SecretKey  string `yaml:"secret_key"`
+			PathStyle  bool   `yaml:"path_style"`
+			PartSize   int    `yaml:"part_size"`
+			Encryption string `yaml:"encryption"`
+			KmsKeyID   string `yaml:"kms_key_id"`
+		} `yaml:"s3"`
+
+		Webdav struct {
+			URL      string `yaml:"url"`
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+		} `yaml:"webdav"`
+
+		Sftp struct {
+			Server     string `yaml:"server"`
+			Port       string `yaml:"port"`
+			Username   string `yaml:"username"`
+			Password   string `yaml:"password"`
+			Key        string `yaml:"key"`
+			KnownHosts string `yaml:"known_hosts"`
+			Path       string `yaml:"path"`
+		} `yaml:"sftp"`
+	} `yaml:"storage"`
+
+	Paperless struct {
+		URL   string   `yaml:"url"`
+		Token string   `yaml:"token"`
+		Tags  []string `yaml:"tags"`
+	} `yaml:"paperless"`
+
+	Dedup struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"dedup"`
+
+	Watch struct {
+		Mailboxes    []string      `yaml:"mailboxes"`
+		PollInterval time.Duration `yaml:"poll_interval"`
+	} `yaml:"watch"`
+}
+
+// account returns the name of the output directories, which is the username
+// of the configured source. Local sources are named by their type and the
+// last element of their path, so they never share the metadata of IMAP.
+func (config *Config) account() string {
+	switch {
+	case config.Source.Type == "pop3" && config.Pop3.Username != "":
+		return config.Pop3.Username
+	case config.Source.Type == "jmap" && config.Jmap.Username != "":
+		return config.Jmap.Username
+	case config.Source.Type == "maildir", config.Source.Type == "mbox", config.Source.Type == "eml":
+		return config.Source.Type + "/" + filepath.Base(filepath.Clean(config.Source.Path))
+	}
+
+	return config.Imap.Username
+}
+
+// validate rejects options which can't be combined
+func (config *Config) validate() error {
+	// Exports append to and rename files of the local filesystem
+	if storage := config.Storage.Type; storage != "" && storage != "local" && (config.Export.Maildir != "" || config.Export.Mbox != "") {
+		return fmt.Errorf("maildir and mbox exports aren't supported with %s storage", storage)
+	}
+
+	if config.Pdf.PdfA {
+		switch part := config.pdfaPart(); {
+		case part != 2 && part != 3:
+			return fmt.Errorf("unsupported PDF/A part: %d", part)
+		case part == 2 && config.Pdf.EmbedEml:
+			// PDF/A-2 only allows embedding other PDF/A files
+			return errors.New("embed_eml requires pdfa_part 3")
+		}
+	}
+
+	return nil
+}
+
+// pdfaPart returns the PDF/A part documents are written as, 2 by default
+func (config *Config) pdfaPart() int {
+	if config.Pdf.PdfAPart == 0 {
+		return 2
+	}
+
+	return config.Pdf.PdfAPart
+}
+
+// Margins of generated PDFs in millimeters
+type Margins struct {
+	Top    float64 `yaml:"top"`
+	Right  float64 `yaml:"right"`
+	Bottom float64 `yaml:"bottom"`
+	Left   float64 `yaml:"left"`
+}
+
+type DaemonConfig struct {
+	Listen string      `yaml:"listen"`
+	State  string      `yaml:"state"`
+	Jobs   []DaemonJob `yaml:"jobs"`
+}
+
+type DaemonJob struct {
+	Name     string `yaml:"name"`
+	Config   string `yaml:"config"`
+	Schedule string `yaml:"schedule"`
+	Days     int    `yaml:"days"`
 }
@@ -0,0 +1,176 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five field cron expression (minute hour day-of-month month day-of-week)
+type Schedule struct {
+	Minute     uint64
+	Hour       uint64
+	DayOfMonth uint64
+	Month      uint64
+	DayOfWeek  uint64
+
+	// anyDay is set when day-of-month or day-of-week starts with "*", e.g.
+	// "*/2", in which case both fields must match instead of either of them
+	anyDay bool
+}
+
+type bounds struct {
+	min, max int
+}
+
+var (
+	minuteBounds     = bounds{0, 59}
+	hourBounds       = bounds{0, 23}
+	dayOfMonthBounds = bounds{1, 31}
+	monthBounds      = bounds{1, 12}
+	dayOfWeekBounds  = bounds{0, 7}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := macros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, found %d: %q", len(fields), spec)
+	}
+
+	schedule := new(Schedule)
+	targets := []struct {
+		bits   *uint64
+		bounds bounds
+	}{
+		{&schedule.Minute, minuteBounds},
+		{&schedule.Hour, hourBounds},
+		{&schedule.DayOfMonth, dayOfMonthBounds},
+		{&schedule.Month, monthBounds},
+		{&schedule.DayOfWeek, dayOfWeekBounds},
+	}
+
+	for i, field := range fields {
+		bits, err := parseField(field, targets[i].bounds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", field, err)
+		}
+		*targets[i].bits = bits
+	}
+
+	// Sunday is both 0 and 7
+	if schedule.DayOfWeek&(1<<7) != 0 {
+		schedule.DayOfWeek |= 1
+	}
+
+	schedule.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rangePart, stepPart, ok := strings.Cut(part, "/"); ok {
+			s, err := strconv.Atoi(stepPart)
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			part, step = rangePart, s
+		}
+
+		start, end := b.min, b.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			lo, hi, _ := strings.Cut(part, "-")
+			var err error
+			if start, err = strconv.Atoi(lo); err != nil {
+				return 0, fmt.Errorf("invalid value %q", lo)
+			}
+			if end, err = strconv.Atoi(hi); err != nil {
+				return 0, fmt.Errorf("invalid value %q", hi)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = value, value
+			if step > 1 {
+				end = b.max
+			}
+		}
+
+		if start < b.min || end > b.max || start > end {
+			return 0, fmt.Errorf("value out of range %d-%d", b.min, b.max)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns the first time after t matching the schedule, or the zero
+// time if there is none within the next five years
+func (schedule *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.Month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !schedule.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if schedule.Hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if schedule.Minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (schedule *Schedule) matchDay(t time.Time) bool {
+	dom := schedule.DayOfMonth&(1<<uint(t.Day())) != 0
+	dow := schedule.DayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	if schedule.anyDay {
+		return dom && dow
+	}
+
+	return dom || dow
+}
@@ -0,0 +1,79 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2024, time.January, 15, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{
+			spec:     "* * * * *",
+			expected: time.Date(2024, time.January, 15, 10, 31, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 6 1 * *",
+			expected: time.Date(2024, time.February, 1, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "*/15 * * * *",
+			expected: time.Date(2024, time.January, 15, 10, 45, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 9-17 * * 1-5",
+			expected: time.Date(2024, time.January, 15, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 0 * * 7",
+			expected: time.Date(2024, time.January, 21, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 0 13 * 5",
+			expected: time.Date(2024, time.January, 19, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 0 */2 * 1",
+			expected: time.Date(2024, time.January, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "@yearly",
+			expected: time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec:     "0 0 30 2 *",
+			expected: time.Time{},
+		},
+	}
+
+	for _, test := range tests {
+		schedule, err := Parse(test.spec)
+		assert.NoError(t, err, test.spec)
+		assert.Equal(t, test.expected, schedule.Next(from), test.spec)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+
+	for _, spec := range specs {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/loeffel-io/mail-downloader/cron"
+	"gopkg.in/yaml.v3"
+)
+
+var errJobLocked = errors.New("job is already running")
+
+// jobStatus is the persisted run status of a single daemon job
+type jobStatus struct {
+	Name        string    `json:"name"`
+	Schedule    string    `json:"schedule"`
+	Running     bool      `json:"running"`
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error"`
+	Duration    string    `json:"duration"`
+	NextRun     time.Time `json:"next_run"`
+}
+
+// daemonState holds the status of all jobs and is saved after every change
+type daemonState struct {
+	Jobs map[string]*jobStatus `json:"jobs"`
+	mu   sync.Mutex
+	path string
+}
+
+// daemonJob is a configured job with its parsed schedule and account config
+type daemonJob struct {
+	DaemonJob
+	schedule *cron.Schedule
+	config   *Config
+	lockPath string
+	// account is shared by the jobs of an account, which write the same metadata
+	account *sync.Mutex
+}
+
+func runDaemon(args []string) {
+	// flags
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := flags.String("config", "", "daemon config path")
+	_ = flags.Parse(args)
+
+	daemonConfig, err := loadDaemonConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobs, err := newDaemonJobs(daemonConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	state, err := loadDaemonState(filepath.Join(daemonConfig.State, "daemon.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	new(imap).enableCharsetReader()
+
+	// status endpoint
+	var server *http.Server
+	if daemonConfig.Listen != "" {
+		server = &http.Server{Addr: daemonConfig.Listen, Handler: state.handler()}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Status endpoint error: %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	wg := new(sync.WaitGroup)
+
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job.loop(ctx, state)
+		}()
+	}
+
+	fmt.Printf("Daemon started with %d jobs\n", len(jobs))
+	wg.Wait()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Status endpoint shutdown error: %v", err)
+		}
+	}
+
+	// done
+	fmt.Println("Done")
+}
+
+func loadDaemonConfig(path string) (*DaemonConfig, error) {
+	var config *DaemonConfig
+
+	yamlBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(yamlBytes, &config); err != nil {
+		return nil, err
+	}
+
+	if config.State == "" {
+		config.State = "."
+	}
+
+	return config, nil
+}
+
+func newDaemonJobs(daemonConfig *DaemonConfig) ([]*daemonJob, error) {
+	jobs := make([]*daemonJob, 0, len(daemonConfig.Jobs))
+	names := make(map[string]bool)
+	accounts := make(map[string]*sync.Mutex)
+
+	for _, job := range daemonConfig.Jobs {
+		if job.Name == "" {
+			return nil, errors.New("daemon job without name")
+		}
+
+		if names[job.Name] {
+			return nil, fmt.Errorf("duplicate daemon job: %s", job.Name)
+		}
+		names[job.Name] = true
+
+		schedule, err := cron.Parse(job.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for job %s: %w", job.Name, err)
+		}
+
+		config, err := loadConfig(job.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config for job %s: %w", job.Name, err)
+		}
+
+		if job.Days <= 0 {
+			job.Days = 31
+		}
+
+		if accounts[config.account()] == nil {
+			accounts[config.account()] = new(sync.Mutex)
+		}
+
+		jobs = append(jobs, &daemonJob{
+			DaemonJob: job,
+			schedule:  schedule,
+			config:    config,
+			lockPath:  filepath.Join(daemonConfig.State, job.Name+".lock"),
+			account:   accounts[config.account()],
+		})
+	}
+
+	return jobs, nil
+}
+
+// loop runs the job at every scheduled time until ctx is cancelled
+func (job *daemonJob) loop(ctx context.Context, state *daemonState) {
+	for {
+		next := job.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %s has no upcoming run", job.Name)
+			return
+		}
+
+		state.update(job.Name, func(status *jobStatus) {
+			status.Schedule = job.Schedule
+			status.NextRun = next
+		})
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+			job.run(ctx, state)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (job *daemonJob) run(ctx context.Context, state *daemonState) {
+	unlock, err := acquireLock(job.lockPath)
+	if err != nil {
+		log.Printf("Skipping job %s: %v", job.Name, err)
+		return
+	}
+	defer unlock()
+
+	// Jobs of the same account run one after another
+	job.account.Lock()
+	defer job.account.Unlock()
+
+	start := time.Now()
+	state.update(job.Name, func(status *jobStatus) {
+		status.Running = true
+		status.LastRun = start
+	})
+
+	today := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	from := today.AddDate(0, 0, -job.Days)
+	to := today.AddDate(0, 0, 1)
+
+	log.Printf("Running job %s (%s - %s)", job.Name, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	report := newErrorReport()
+	err = syncMails(ctx, job.config, from, to, false, report)
+	if err == nil && report.len() > 0 {
+		report.write(log.Writer())
+		err = fmt.Errorf("%d messages failed", report.len())
+	}
+
+	state.update(job.Name, func(status *jobStatus) {
+		status.Running = false
+		status.Duration = time.Since(start).Round(time.Second).String()
+		status.LastError = ""
+
+		if err != nil {
+			status.LastError = err.Error()
+			return
+		}
+
+		status.LastSuccess = start
+	})
+
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.Name, err)
+		return
+	}
+
+	log.Printf("Job %s finished", job.Name)
+}
+
+// acquireLock creates the lock file exclusively and returns a function removing it again.
+// Lock files left behind by processes which no longer exist are taken over.
+func acquireLock(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file: %w", err)
+			}
+
+			return func() {
+				if err := os.Remove(path); err != nil {
+					log.Printf("Failed to remove lock file %s: %v", path, err)
+				}
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		if !staleLock(path) {
+			return nil, errJobLocked
+		}
+
+		log.Printf("Removing stale lock file %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale lock file: %w", err)
+		}
+	}
+
+	return nil, errJobLocked
+}
+
+// staleLock reports whether the process which wrote the lock file is gone
+func staleLock(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+
+	return process.Signal(syscall.Signal(0)) != nil
+}
+
+func loadDaemonState(path string) (*daemonState, error) {
+	state := &daemonState{
+		Jobs: make(map[string]*jobStatus),
+		path: path,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read daemon state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse daemon state: %w", err)
+	}
+
+	// A job can't be running when the daemon just started
+	for _, status := range state.Jobs {
+		status.Running = false
+	}
+
+	return state, nil
+}
+
+// update changes the status of a job and saves the state
+func (state *daemonState) update(name string, fn func(status *jobStatus)) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	status, ok := state.Jobs[name]
+	if !ok {
+		status = &jobStatus{Name: name}
+		state.Jobs[name] = status
+	}
+
+	fn(status)
+
+	if err := state.save(); err != nil {
+		log.Printf("Failed to save daemon state: %v", err)
+	}
+}
+
+// save writes the state to disk atomically
+func (state *daemonState) save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal daemon state: %w", err)
+	}
+
+	tmpPath := state.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, state.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save daemon state: %w", err)
+	}
+
+	return nil
+}
+
+// handler serves the job status for health checks
+func (state *daemonState) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		data, err := json.MarshalIndent(state, "", "  ")
+		state.mu.Unlock()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+
+	return mux
+}
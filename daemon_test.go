@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDaemonJobs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	invoices := write("invoices.yml", "imap:\n  username: user@example.com\n")
+	archive := write("archive.yml", "imap:\n  username: user@example.com\nmails:\n  subjects: [\"\"]\n")
+	other := write("other.yml", "imap:\n  username: other@example.com\n")
+
+	jobs, err := newDaemonJobs(&DaemonConfig{State: dir, Jobs: []DaemonJob{
+		{Name: "invoices", Config: invoices, Schedule: "@daily"},
+		{Name: "archive", Config: archive, Schedule: "@weekly", Days: 7},
+		{Name: "other", Config: other, Schedule: "@daily"},
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 3)
+
+	// Jobs of the same account share the lock of the account
+	assert.Same(t, jobs[0].account, jobs[1].account)
+	assert.NotSame(t, jobs[0].account, jobs[2].account)
+	assert.Equal(t, 31, jobs[0].Days)
+	assert.Equal(t, filepath.Join(dir, "archive.lock"), jobs[1].lockPath)
+
+	_, err = newDaemonJobs(&DaemonConfig{State: dir, Jobs: []DaemonJob{
+		{Name: "invoices", Config: invoices, Schedule: "@daily"},
+		{Name: "invoices", Config: archive, Schedule: "@daily"},
+	}})
+	assert.ErrorContains(t, err, "duplicate daemon job")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageIndexPath is shared by all accounts, so duplicates are found across the whole archive
+const messageIndexPath = "mail/messages.json"
+
+// messageLocation is a mailbox where a message was seen
+type messageLocation struct {
+	Account string `json:"account"`
+	Mailbox string `json:"mailbox"`
+	Uid     uint32 `json:"uid"`
+}
+
+// indexedMessage is a logical message, it is processed at its first location only
+type indexedMessage struct {
+	Subject   string            `json:"subject"`
+	Locations []messageLocation `json:"locations"`
+}
+
+// messageIndex maps the Message-ID of all processed mails to their locations.
+// It is loaded once per run and saved at its end.
+type messageIndex struct {
+	Messages map[string]*indexedMessage `json:"messages"`
+	mu       sync.Mutex                 `json:"-"`
+	storage  Storage                    `json:"-"`
+	// added holds the locations recorded since the last save
+	added []addedLocation `json:"-"`
+	// claims holds the messages which are processed right now, released is
+	// signalled when a claim ends
+	claims   map[string]messageLocation `json:"-"`
+	released *sync.Cond                 `json:"-"`
+}
+
+// addedLocation is a location which isn't saved yet
+type addedLocation struct {
+	key      string
+	subject  string
+	location messageLocation
+}
+
+// loadMessageIndex returns the index of the storage, or nil if dedup is disabled
+func loadMessageIndex(config *Config, storage Storage) (*messageIndex, error) {
+	if !config.Dedup.Enabled {
+		return nil, nil
+	}
+
+	messages, err := readMessageIndex(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &messageIndex{Messages: messages, storage: storage, claims: make(map[string]messageLocation)}
+	index.released = sync.NewCond(&index.mu)
+	return index, nil
+}
+
+func readMessageIndex(storage Storage) (map[string]*indexedMessage, error) {
+	index := &messageIndex{Messages: make(map[string]*indexedMessage)}
+
+	data, err := storage.Read(context.Background(), messageIndexPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index.Messages, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message index: %w", err)
+	}
+
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("failed to parse message index: %w", err)
+	}
+
+	if index.Messages == nil {
+		index.Messages = make(map[string]*indexedMessage)
+	}
+
+	return index.Messages, nil
+}
+
+// saveMessageIndex saves index at the end of a run, failures are only logged
+func saveMessageIndex(index *messageIndex) {
+	if index == nil {
+		return
+	}
+
+	if err := index.save(); err != nil {
+		log.Printf("Failed to save message index: %v", err)
+	}
+}
+
+// claim reserves the message of mail for processing. It returns the first
+// location of the message if mail is a duplicate of it, the caller owns the
+// claim otherwise and has to end it with add or release. While another
+// location holds the claim, claim waits until it ended.
+func (index *messageIndex) claim(account string, mail *mail) *messageLocation {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	key := messageKey(mail)
+	location := messageLocation{Account: account, Mailbox: mail.Mailbox, Uid: mail.Uid}
+
+	for {
+		claimer, ok := index.claims[key]
+		if !ok || claimer == location {
+			break
+		}
+		index.released.Wait()
+	}
+
+	// Retries and reruns of the first location process the mail again
+	if message, ok := index.Messages[key]; ok && len(message.Locations) > 0 && message.Locations[0] != location {
+		first := message.Locations[0]
+		return &first
+	}
+
+	index.claims[key] = location
+	return nil
+}
+
+// release ends the claim of mail without recording it, e.g. when its handlers failed
+func (index *messageIndex) release(account string, mail *mail) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	index.unclaim(messageKey(mail), messageLocation{Account: account, Mailbox: mail.Mailbox, Uid: mail.Uid})
+}
+
+// add records where mail was processed and ends its claim
+func (index *messageIndex) add(account string, mail *mail) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	added := addedLocation{
+		key:      messageKey(mail),
+		subject:  mail.Subject,
+		location: messageLocation{Account: account, Mailbox: mail.Mailbox, Uid: mail.Uid},
+	}
+
+	if addLocation(index.Messages, added) {
+		index.added = append(index.added, added)
+	}
+
+	index.unclaim(added.key, added.location)
+}
+
+// unclaim removes the claim of location and wakes up the waiting callers
+func (index *messageIndex) unclaim(key string, location messageLocation) {
+	if claimer, ok := index.claims[key]; ok && claimer == location {
+		delete(index.claims, key)
+		index.released.Broadcast()
+	}
+}
+
+// addLocation adds the location to messages unless it is known and reports whether it was added
+func addLocation(messages map[string]*indexedMessage, added addedLocation) bool {
+	message, ok := messages[added.key]
+	if !ok {
+		message = &indexedMessage{Subject: added.subject}
+		messages[added.key] = message
+	}
+
+	for _, known := range message.Locations {
+		if known == added.location {
+			return false
+		}
+	}
+
+	message.Locations = append(message.Locations, added.location)
+	return true
+}
+
+// save merges the added locations into the stored index, which other runs may
+// have changed in the meantime. It isn't cancelled, like the metadata.
+func (index *messageIndex) save() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if len(index.added) == 0 {
+		return nil
+	}
+
+	messages, err := readMessageIndex(index.storage)
+	if err != nil {
+		return err
+	}
+
+	for _, added := range index.added {
+		addLocation(messages, added)
+	}
+
+	data, err := json.MarshalIndent(&messageIndex{Messages: messages}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal message index: %w", err)
+	}
+
+	if err := index.storage.Write(context.Background(), messageIndexPath, data); err != nil {
+		return fmt.Errorf("failed to save message index: %w", err)
+	}
+
+	index.Messages = messages
+	index.added = nil
+	return nil
+}
+
+// messageKey returns the Message-ID of mail. Mails without one are identified
+// by a hash of their sender, recipients, date and subject.
+func messageKey(mail *mail) string {
+	if id := strings.Trim(strings.TrimSpace(mail.MessageID), "<>"); id != "" {
+		return id
+	}
+
+	hash := sha256.New()
+	for _, addresses := range [][]string{formatAddresses(mail.From), formatAddresses(mail.To), formatAddresses(mail.Cc)} {
+		fmt.Fprintf(hash, "%s\n", strings.ToLower(strings.Join(addresses, ",")))
+	}
+	fmt.Fprintf(hash, "%s\n%s\n", mail.Date.UTC().Format(time.RFC3339), mail.Subject)
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageIndex(t *testing.T) {
+	config := new(Config)
+	storage := newLocalStorage(t.TempDir())
+
+	index, err := loadMessageIndex(config, storage)
+	assert.NoError(t, err)
+	assert.Nil(t, index)
+
+	config.Dedup.Enabled = true
+	index, err = loadMessageIndex(config, storage)
+	assert.NoError(t, err)
+
+	inbox := &mail{Uid: 1, Mailbox: "INBOX", MessageID: "<abc@vendor>", Subject: "Invoice"}
+	sent := &mail{Uid: 7, Mailbox: "Sent", MessageID: "abc@vendor", Subject: "Invoice"}
+	other := &mail{Uid: 3, Mailbox: "INBOX", MessageID: "abc@vendor", Subject: "Invoice"}
+
+	// Nothing is recorded until a location was processed
+	assert.Nil(t, index.claim("a@example.com", inbox))
+	index.release("a@example.com", inbox)
+	assert.Nil(t, index.claim("a@example.com", sent))
+	index.release("a@example.com", sent)
+
+	assert.Nil(t, index.claim("a@example.com", inbox))
+	index.add("a@example.com", inbox)
+	first := &messageLocation{Account: "a@example.com", Mailbox: "INBOX", Uid: 1}
+	assert.Equal(t, first, index.claim("a@example.com", sent))
+	index.add("a@example.com", sent)
+	assert.Equal(t, first, index.claim("b@example.com", other))
+
+	// Reruns process the first location again
+	assert.Nil(t, index.claim("a@example.com", inbox))
+	index.release("a@example.com", inbox)
+
+	// Runs which overlap keep the locations of each other
+	concurrent, err := loadMessageIndex(config, storage)
+	assert.NoError(t, err)
+	concurrent.add("b@example.com", other)
+	assert.NoError(t, concurrent.save())
+
+	assert.NoError(t, index.save())
+
+	data, err := storage.Read(context.Background(), messageIndexPath)
+	assert.NoError(t, err)
+
+	var saved messageIndex
+	assert.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, []messageLocation{
+		{Account: "b@example.com", Mailbox: "INBOX", Uid: 3},
+		{Account: "a@example.com", Mailbox: "INBOX", Uid: 1},
+		{Account: "a@example.com", Mailbox: "Sent", Uid: 7},
+	}, saved.Messages["abc@vendor"].Locations)
+}
+
+func TestMessageIndexClaim(t *testing.T) {
+	config := new(Config)
+	config.Dedup.Enabled = true
+	index, err := loadMessageIndex(config, newLocalStorage(t.TempDir()))
+	assert.NoError(t, err)
+
+	inbox := &mail{Uid: 1, Mailbox: "INBOX", MessageID: "abc@vendor"}
+	filed := &mail{Uid: 9, Mailbox: "Invoices", MessageID: "abc@vendor"}
+
+	claim := func(mail *mail) chan *messageLocation {
+		result := make(chan *messageLocation, 1)
+		go func() { result <- index.claim("a@example.com", mail) }()
+		return result
+	}
+
+	// A copy waits while the message is claimed and becomes the owner once
+	// the claim was released
+	assert.Nil(t, index.claim("a@example.com", inbox))
+	waiting := claim(filed)
+	select {
+	case <-waiting:
+		t.Fatal("claimed twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	index.release("a@example.com", inbox)
+	assert.Nil(t, <-waiting)
+
+	// Once the owner recorded the message, waiting copies are duplicates
+	waiting = claim(inbox)
+	index.add("a@example.com", filed)
+	assert.Equal(t, &messageLocation{Account: "a@example.com", Mailbox: "Invoices", Uid: 9}, <-waiting)
+}
+
+// handlerFunc adapts a function to MailHandler
+type handlerFunc func(mail *mail) error
+
+func (f handlerFunc) Handle(ctx context.Context, config *Config, mail *mail) error {
+	return f(mail)
+}
+
+func TestProcessMailDedup(t *testing.T) {
+	config := new(Config)
+	config.Imap.Username = "a@example.com"
+	config.Dedup.Enabled = true
+
+	index, err := loadMessageIndex(config, newLocalStorage(t.TempDir()))
+	assert.NoError(t, err)
+
+	handled := 0
+	failing := handlerFunc(func(mail *mail) error { return errors.New("failed") })
+	counting := handlerFunc(func(mail *mail) error { handled++; return nil })
+
+	// A location whose handlers failed doesn't make later copies duplicates
+	inbox := &mail{Uid: 1, Mailbox: "INBOX", MessageID: "abc@vendor"}
+	sent := &mail{Uid: 7, Mailbox: "Sent", MessageID: "abc@vendor"}
+	assert.Error(t, processMail(context.Background(), config, []MailHandler{failing}, index, inbox))
+
+	assert.NoError(t, processMail(context.Background(), config, []MailHandler{counting}, index, sent))
+	assert.NoError(t, processMail(context.Background(), config, []MailHandler{counting}, index, inbox))
+	assert.Equal(t, 1, handled)
+}
+
+func TestMessageKey(t *testing.T) {
+	date := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	from := []*i.Address{{MailboxName: "shop", HostName: "example.com"}}
+
+	a := &mail{Uid: 1, Subject: "Invoice", From: from, Date: date}
+	b := &mail{Uid: 2, Subject: "Invoice", From: from, Date: date.In(time.FixedZone("CET", 3600))}
+	c := &mail{Uid: 3, Subject: "Reminder", From: from, Date: date}
+
+	assert.Equal(t, messageKey(a), messageKey(b))
+	assert.NotEqual(t, messageKey(a), messageKey(c))
+	assert.Contains(t, messageKey(a), "sha256:")
+	assert.Equal(t, "abc@vendor", messageKey(&mail{MessageID: " <abc@vendor> "}))
+}
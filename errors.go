@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Error policy: connection errors and cancellation abort the run, message
+// errors skip the message and part errors skip the part. Skipped messages
+// are collected in an errorReport and make the run fail at the end, skipped
+// parts are recorded as warnings of their message.
+
+// ConnectionError is a failure of the IMAP session itself
+type ConnectionError struct {
+	Op  string
+	Err error
+}
+
+func (err *ConnectionError) Error() string {
+	return fmt.Sprintf("connection error during %s: %v", err.Op, err.Err)
+}
+
+func (err *ConnectionError) Unwrap() error {
+	return err.Err
+}
+
+// MessageError is a failure to read or process a single message
+type MessageError struct {
+	Uid uint32
+	Op  string
+	Err error
+}
+
+func (err *MessageError) Error() string {
+	return fmt.Sprintf("message %d: %s: %v", err.Uid, err.Op, err.Err)
+}
+
+func (err *MessageError) Unwrap() error {
+	return err.Err
+}
+
+// PartError is a failure to read a single MIME part of a message
+type PartError struct {
+	Uid  uint32
+	Part string
+	Err  error
+}
+
+func (err *PartError) Error() string {
+	return fmt.Sprintf("message %d part %s: %v", err.Uid, err.Part, err.Err)
+}
+
+func (err *PartError) Unwrap() error {
+	return err.Err
+}
+
+type failure struct {
+	Uid     uint32
+	Subject string
+	Err     error
+}
+
+// errorReport collects the messages which failed during a run
+type errorReport struct {
+	failures []failure
+	mu       sync.Mutex
+}
+
+func newErrorReport() *errorReport {
+	return &errorReport{failures: make([]failure, 0)}
+}
+
+func (report *errorReport) add(mail *mail, err error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	report.failures = append(report.failures, failure{
+		Uid:     mail.Uid,
+		Subject: mail.Subject,
+		Err:     err,
+	})
+}
+
+func (report *errorReport) len() int {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	return len(report.failures)
+}
+
+// write prints all failures ordered by uid
+func (report *errorReport) write(w io.Writer) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	if len(report.failures) == 0 {
+		return
+	}
+
+	sort.SliceStable(report.failures, func(a, b int) bool {
+		return report.failures[a].Uid < report.failures[b].Uid
+	})
+
+	fmt.Fprintf(w, "%d messages failed:\n", len(report.failures))
+	for _, f := range report.failures {
+		fmt.Fprintf(w, "  UID %d (%s): %v\n", f.Uid, f.Subject, f.Err)
+	}
+}
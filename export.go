@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/loeffel-io/mail-downloader/search"
+)
+
+// shouldExport reports whether the mail is written to the archives
+func shouldExport(config *Config, mail *mail) bool {
+	if mail.Raw == nil {
+		return false
+	}
+
+	if config.Export.All {
+		return true
+	}
+
+	s := &search.Search{
+		Search: config.Mails.Subjects,
+		Data:   mail.Subject,
+	}
+
+	return s.Find()
+}
+
+// exportFolder splits the mailbox into safe path elements
+func exportFolder(mail *mail) []string {
+	name := mail.Mailbox
+	if name == "" {
+		name = "INBOX"
+	}
+
+	folder := []string{name}
+	if mail.Delimiter != "" {
+		folder = strings.Split(name, mail.Delimiter)
+	}
+
+	for i, element := range folder {
+		element = sanitizeSubject(element)
+		if element == "" || element == "." || element == ".." {
+			element = "_"
+		}
+		folder[i] = element
+	}
+
+	return folder
+}
+
+// exportDate returns the internal date of the mail, falling back to the date header
+func exportDate(mail *mail) time.Time {
+	if !mail.InternalDate.IsZero() {
+		return mail.InternalDate
+	}
+
+	if !mail.Date.IsZero() {
+		return mail.Date
+	}
+
+	return time.Now()
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maildirFlags maps IMAP flags to Maildir info flags, in the required ASCII order
+var maildirFlags = []struct {
+	imap string
+	info byte
+}{
+	{i.DraftFlag, 'D'},
+	{i.FlaggedFlag, 'F'},
+	{i.AnsweredFlag, 'R'},
+	{i.SeenFlag, 'S'},
+	{i.DeletedFlag, 'T'},
+}
+
+func maildirInfo(flags []string) string {
+	info := []byte("2,")
+	for _, flag := range maildirFlags {
+		if hasFlag(flags, flag.imap) {
+			info = append(info, flag.info)
+		}
+	}
+
+	return string(info)
+}
+
+// MaildirHandler writes mails into a Maildir tree mirroring the mailboxes
+type MaildirHandler struct {
+	hostname string
+	mutex    sync.Mutex
+	// files maps a cur directory to its files by unique name
+	files map[string]map[string]string
+}
+
+func NewMaildirHandler() *MaildirHandler {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	// "/" and ":" are not allowed in the unique name
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return &MaildirHandler{hostname: hostname, files: make(map[string]map[string]string)}
+}
+
+func (h *MaildirHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
+	if !shouldExport(config, mail) {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	dir := filepath.Join(append([]string{config.Export.Maildir}, exportFolder(mail)...)...)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	cur := filepath.Join(dir, "cur")
+	files, err := h.list(cur)
+	if err != nil {
+		return fmt.Errorf("failed to read maildir: %w", err)
+	}
+
+	date := exportDate(mail)
+	unique := fmt.Sprintf("%d.U%d.%s", date.Unix(), mail.Uid, h.hostname)
+	name := unique + ":" + maildirInfo(mail.Flags)
+
+	// Known mails only get their flags updated
+	if existing, ok := files[unique]; ok {
+		if existing != name {
+			if err := os.Rename(filepath.Join(cur, existing), filepath.Join(cur, name)); err != nil {
+				return fmt.Errorf("failed to update maildir flags: %w", err)
+			}
+			files[unique] = name
+		}
+		return nil
+	}
+
+	tmp := filepath.Join(dir, "tmp", unique)
+	if err := os.WriteFile(tmp, mail.Raw, 0o644); err != nil {
+		return fmt.Errorf("failed to write maildir file: %w", err)
+	}
+
+	if err := os.Chtimes(tmp, date, date); err != nil {
+		return fmt.Errorf("failed to set maildir file time: %w", err)
+	}
+
+	if err := os.Rename(tmp, filepath.Join(cur, name)); err != nil {
+		return fmt.Errorf("failed to move maildir file: %w", err)
+	}
+	files[unique] = name
+
+	return nil
+}
+
+// list returns the files of a cur directory, which is only read once
+func (h *MaildirHandler) list(cur string) (map[string]string, error) {
+	if files, ok := h.files[cur]; ok {
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		unique, _, _ := strings.Cut(entry.Name(), ":")
+		files[unique] = entry.Name()
+	}
+
+	h.files[cur] = files
+	return files, nil
+}
+
+// mboxrdFrom matches lines which need another ">" in mboxrd files
+var mboxrdFrom = regexp.MustCompile(`^>*From `)
+
+// mboxHeaders are replaced by the exported flags
+var mboxHeaders = []string{"status", "x-status", "x-mozilla-status", "x-uid"}
+
+// MboxHandler appends mails to one mboxrd file per mailbox
+type MboxHandler struct {
+	mutex sync.Mutex
+	// uids holds the exported mails by file
+	uids map[string]map[uint32]bool
+}
+
+func NewMboxHandler() *MboxHandler {
+	return &MboxHandler{uids: make(map[string]map[uint32]bool)}
+}
+
+func (h *MboxHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
+	if !shouldExport(config, mail) {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	path := filepath.Join(append([]string{config.Export.Mbox}, exportFolder(mail)...)...) + ".mbox"
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	uids, err := h.scan(path)
+	if err != nil {
+		return fmt.Errorf("failed to read mbox: %w", err)
+	}
+
+	if uids[mail.Uid] {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open mbox: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(mail.mboxrd()); err != nil {
+		return fmt.Errorf("failed to write mbox: %w", err)
+	}
+	uids[mail.Uid] = true
+
+	return file.Close()
+}
+
+// scan reads the X-UID headers of an existing mbox file once
+func (h *MboxHandler) scan(path string) (map[uint32]bool, error) {
+	if uids, ok := h.uids[path]; ok {
+		return uids, nil
+	}
+
+	uids := make(map[uint32]bool)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		h.uids[path] = uids
+		return uids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	header := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "From "):
+			header = true
+		case line == "":
+			header = false
+		case header && strings.HasPrefix(line, "X-UID: "):
+			if uid, err := strconv.ParseUint(strings.TrimPrefix(line, "X-UID: "), 10, 32); err == nil {
+				uids[uint32(uid)] = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	h.uids[path] = uids
+	return uids, nil
+}
+
+// mboxrd formats the mail as mboxrd entry with the flags in the headers
+// understood by mutt and Thunderbird
+func (mail *mail) mboxrd() []byte {
+	sender := "MAILER-DAEMON"
+	if len(mail.From) > 0 && mail.From[0].Address() != "" {
+		sender = mail.From[0].Address()
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From %s %s\n", sender, exportDate(mail).UTC().Format(time.ANSIC))
+
+	status := "O"
+	mozilla := 0
+	if hasFlag(mail.Flags, i.SeenFlag) {
+		status = "RO"
+		mozilla |= 0x1
+	}
+
+	xstatus := ""
+	for _, flag := range []struct {
+		imap   string
+		status string
+		bit    int
+	}{
+		{i.AnsweredFlag, "A", 0x2},
+		{i.FlaggedFlag, "F", 0x4},
+		{i.DeletedFlag, "D", 0x8},
+		{i.DraftFlag, "T", 0},
+	} {
+		if hasFlag(mail.Flags, flag.imap) {
+			xstatus += flag.status
+			mozilla |= flag.bit
+		}
+	}
+
+	fmt.Fprintf(buf, "Status: %s\nX-Status: %s\nX-Mozilla-Status: %04x\nX-UID: %d\n", status, xstatus, mozilla, mail.Uid)
+
+	raw := bytes.ReplaceAll(mail.Raw, []byte("\r\n"), []byte("\n"))
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+
+	header, skip := true, false
+	for _, line := range lines {
+		if header {
+			if line == "" {
+				header = false
+			} else if line[0] == ' ' || line[0] == '\t' {
+				// Continuation lines belong to the previous field
+				if skip {
+					continue
+				}
+			} else {
+				name, _, _ := strings.Cut(line, ":")
+				skip = false
+				for _, h := range mboxHeaders {
+					if strings.EqualFold(strings.TrimSpace(name), h) {
+						skip = true
+					}
+				}
+				if skip {
+					continue
+				}
+			}
+		}
+
+		if mboxrdFrom.MatchString(line) {
+			buf.WriteByte('>')
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func exportMail() *mail {
+	return &mail{
+		Uid:          42,
+		Mailbox:      "Archive/2024",
+		Delimiter:    "/",
+		Subject:      "Invoice 42",
+		From:         []*i.Address{{MailboxName: "billing", HostName: "example.com"}},
+		Flags:        []string{i.SeenFlag, i.FlaggedFlag},
+		InternalDate: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		Raw: []byte("From: billing@example.com\r\nStatus: U\r\nX-UID: 7\r\n continued\r\nSubject: Invoice 42\r\n\r\n" +
+			"From here on\r\n>From quoted\r\nFrom: body\r\n"),
+	}
+}
+
+func TestExportFolder(t *testing.T) {
+	assert.Equal(t, []string{"Archive", "2024"}, exportFolder(exportMail()))
+	assert.Equal(t, []string{"INBOX"}, exportFolder(&mail{}))
+	assert.Equal(t, []string{"a_b", "_"}, exportFolder(&mail{Mailbox: "a/b.", Delimiter: "."}))
+}
+
+func TestMaildirHandler(t *testing.T) {
+	config := new(Config)
+	config.Export.Maildir = t.TempDir()
+	config.Mails.Subjects = []string{"invoice"}
+
+	invoice := exportMail()
+	h := NewMaildirHandler()
+	assert.NoError(t, h.Handle(context.Background(), config, invoice))
+	assert.NoError(t, h.Handle(context.Background(), config, &mail{Uid: 43, Subject: "Newsletter", Raw: []byte("x")}))
+
+	dir := filepath.Join(config.Export.Maildir, "Archive", "2024")
+	files, err := filepath.Glob(filepath.Join(dir, "cur", "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasPrefix(filepath.Base(files[0]), "1709287200.U42."))
+	assert.True(t, strings.HasSuffix(files[0], ":2,FS"))
+
+	info, err := os.Stat(files[0])
+	assert.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(invoice.InternalDate))
+
+	// A new run updates the flags instead of adding a copy
+	invoice.Flags = []string{i.SeenFlag, i.AnsweredFlag}
+	assert.NoError(t, NewMaildirHandler().Handle(context.Background(), config, invoice))
+
+	files, err = filepath.Glob(filepath.Join(dir, "cur", "*"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ":2,RS"))
+
+	body, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, invoice.Raw, body)
+}
+
+func TestMboxHandler(t *testing.T) {
+	config := new(Config)
+	config.Export.Mbox = t.TempDir()
+	config.Export.All = true
+
+	assert.NoError(t, NewMboxHandler().Handle(context.Background(), config, exportMail()))
+	// Mails already in the file are skipped
+	assert.NoError(t, NewMboxHandler().Handle(context.Background(), config, exportMail()))
+
+	data, err := os.ReadFile(filepath.Join(config.Export.Mbox, "Archive", "2024.mbox"))
+	assert.NoError(t, err)
+	assert.Equal(t, "From billing@example.com Fri Mar  1 10:00:00 2024\n"+
+		"Status: RO\nX-Status: F\nX-Mozilla-Status: 0005\nX-UID: 42\n"+
+		"From: billing@example.com\nSubject: Invoice 42\n\n"+
+		">From here on\n>>From quoted\nFrom: body\n\n", string(data))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Gmail IMAP extensions, see https://developers.google.com/gmail/imap/imap-extensions
+const (
+	gmailCapability = "X-GM-EXT-1"
+	gmailMsgID      = i.FetchItem("X-GM-MSGID")
+	gmailLabels     = i.FetchItem("X-GM-LABELS")
+)
+
+const (
+	// gmailAllMail is used if the server doesn't mark the mailbox with \All
+	gmailAllMail = "[Gmail]/All Mail"
+	// defaultGmailQuery matches the mails of the INBOX
+	defaultGmailQuery = "in:inbox"
+)
+
+// gmailSystemDirectories are the system labels used as directory, in order of preference
+var gmailSystemDirectories = []struct{ label, directory string }{
+	{`\Inbox`, "Inbox"},
+	{`\Sent`, "Sent"},
+	{`\Draft`, "Drafts"},
+}
+
+// gmailSearch is a SEARCH command with a query in Gmail search syntax
+type gmailSearch struct {
+	query    string
+	criteria *i.SearchCriteria
+}
+
+func (cmd *gmailSearch) Command() *i.Command {
+	args := []interface{}{i.RawString("CHARSET"), i.RawString("UTF-8")}
+	args = append(args, cmd.criteria.Format()...)
+	args = append(args, i.RawString("X-GM-RAW"), cmd.query)
+
+	return &i.Command{Name: "SEARCH", Arguments: args}
+}
+
+// allMailbox returns the name of the mailbox containing all mails, which is localized
+func (imap *imap) allMailbox() (string, error) {
+	mailboxes := make(chan *i.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- imap.Client.List("", "*", mailboxes)
+	}()
+
+	name := ""
+	for info := range mailboxes {
+		for _, attr := range info.Attributes {
+			if attr == i.AllAttr {
+				name = info.Name
+			}
+		}
+	}
+
+	if err := <-done; err != nil {
+		return "", &ConnectionError{Op: "list", Err: err}
+	}
+
+	if name == "" {
+		name = gmailAllMail
+	}
+
+	return name, nil
+}
+
+// gmailSearch returns the uids matching query between from and to
+func (imap *imap) gmailSearch(ctx context.Context, query string, from, to time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	criteria := i.NewSearchCriteria()
+	criteria.Since = from
+	criteria.Before = to
+
+	res := new(responses.Search)
+	status, err := imap.Client.Execute(&commands.Uid{Cmd: &gmailSearch{query: query, criteria: criteria}}, res)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return nil, &ConnectionError{Op: "search", Err: err}
+	}
+
+	return res.Ids, nil
+}
+
+// gmailMessageIDs returns the X-GM-MSGID of the uids
+func (imap *imap) gmailMessageIDs(ctx context.Context, uids []uint32) (map[uint32]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := make(chan *i.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- imap.Client.UidFetch(imap.createSeqSet(uids), []i.FetchItem{i.FetchUid, gmailMsgID}, messages)
+	}()
+
+	ids := make(map[uint32]string, len(uids))
+	for message := range messages {
+		ids[message.Uid] = gmailString(message.Items[gmailMsgID])
+	}
+
+	if err := <-done; err != nil {
+		return nil, &ConnectionError{Op: "fetch", Err: err}
+	}
+
+	return ids, nil
+}
+
+// readGmail sets the Gmail message id and labels of a fetched message
+func (imap *imap) readGmail(mail *mail, message *i.Message) {
+	mail.RemoteID = gmailString(message.Items[gmailMsgID])
+
+	fields, _ := message.Items[gmailLabels].([]interface{})
+	mail.Labels = make([]string, 0, len(fields))
+	for _, field := range fields {
+		label := gmailString(field)
+		// Labels are encoded like mailbox names
+		if decoded, err := utf7.Encoding.NewDecoder().String(label); err == nil {
+			label = decoded
+		}
+		mail.Labels = append(mail.Labels, label)
+	}
+
+	if imap.LabelDirectories {
+		mail.Directory = gmailDirectory(mail.Labels)
+	}
+}
+
+func gmailString(field interface{}) string {
+	if field == nil {
+		return ""
+	}
+
+	if s, err := i.ParseString(field); err == nil {
+		return s
+	}
+
+	return fmt.Sprint(field)
+}
+
+// gmailDirectory returns the first user label, nested labels become nested
+// directories. Mails without one use the Inbox, Sent or Drafts label.
+func gmailDirectory(labels []string) string {
+	user := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if !strings.HasPrefix(label, `\`) {
+			user = append(user, label)
+		}
+	}
+
+	if len(user) > 0 {
+		sort.Strings(user)
+		return strings.Join(exportFolder(&mail{Mailbox: user[0], Delimiter: "/"}), "/")
+	}
+
+	for _, system := range gmailSystemDirectories {
+		for _, label := range labels {
+			if strings.EqualFold(label, system.label) {
+				return system.directory
+			}
+		}
+	}
+
+	return "All Mail"
+}
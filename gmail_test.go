@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGmailSearch(t *testing.T) {
+	criteria := i.NewSearchCriteria()
+	criteria.Since = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	buf := new(bytes.Buffer)
+	cmd := (&commands.Uid{Cmd: &gmailSearch{query: "has:attachment in:inbox", criteria: criteria}}).Command()
+	cmd.Tag = "A1"
+	assert.NoError(t, cmd.WriteTo(i.NewWriter(buf)))
+	assert.Equal(t, "A1 UID SEARCH CHARSET UTF-8 SINCE \"1-Mar-2024\" X-GM-RAW \"has:attachment in:inbox\"\r\n", buf.String())
+}
+
+func TestReadGmail(t *testing.T) {
+	message := &i.Message{Items: map[i.FetchItem]interface{}{
+		gmailMsgID:  "1278455344230334865",
+		gmailLabels: []interface{}{`\Inbox`, "Receipts/2024", "&AMQ-rzte"},
+	}}
+
+	receipt := &mail{
+		Date: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		From: []*i.Address{{HostName: "example.com"}},
+	}
+	imap := &imap{Gmail: true, LabelDirectories: true}
+	imap.readGmail(receipt, message)
+
+	assert.Equal(t, "1278455344230334865", receipt.RemoteID)
+	assert.Equal(t, []string{`\Inbox`, "Receipts/2024", "Ärzte"}, receipt.Labels)
+	assert.Equal(t, "Receipts/2024", receipt.Directory)
+	assert.Equal(t, "mail/user/Receipts/2024/202403/example.com", receipt.getDirectoryName("mail", "user"))
+}
+
+func TestGmailDirectory(t *testing.T) {
+	assert.Equal(t, "Inbox", gmailDirectory([]string{`\Important`, `\Inbox`}))
+	assert.Equal(t, "Sent", gmailDirectory([]string{`\Sent`}))
+	assert.Equal(t, "All Mail", gmailDirectory(nil))
+	assert.Equal(t, "a_b/c", gmailDirectory([]string{"z", "a:b/c", `\Inbox`}))
+}
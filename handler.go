@@ -1,50 +1,71 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
 
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/loeffel-io/mail-downloader/archive"
 	"github.com/loeffel-io/mail-downloader/search"
 )
 
-// MailHandler interface defines the contract for mail content handlers
+// MailHandler interface defines the contract for mail content handlers.
+// Handlers should not give up on a mail half way because ctx was cancelled,
+// callers decide whether the next mail is processed.
 type MailHandler interface {
-	Handle(config *Config, mail *mail) error
+	Handle(ctx context.Context, config *Config, mail *mail) error
 }
 
+// Default limits for files extracted from archive attachments
+const (
+	defaultArchiveMaxSize  = 100 << 20
+	defaultArchiveMaxFiles = 1000
+	defaultArchiveMaxRatio = 100
+)
+
 // AttachmentHandler handles saving email attachments
 type AttachmentHandler struct {
 	username string
+	storage  Storage
 }
 
-func NewAttachmentHandler(username string) *AttachmentHandler {
-	return &AttachmentHandler{username: username}
+func NewAttachmentHandler(username string, storage Storage) *AttachmentHandler {
+	return &AttachmentHandler{username: username, storage: storage}
 }
 
-func (h *AttachmentHandler) Handle(config *Config, mail *mail) error {
+func (h *AttachmentHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
 	dir := mail.getDirectoryName("attachment", h.username)
 
-	for _, attachment := range mail.Attachments {
+	attachments, failed := mail.attachments(config)
+
+	for _, attachment := range attachments {
+		rules := config.Attachments.Mimetypes
+		if attachment.Origin != "" && len(config.Attachments.Archives.Mimetypes) > 0 {
+			rules = config.Attachments.Archives.Mimetypes
+		}
+
 		s := &search.Search{
-			Search: config.Attachments.Mimetypes,
+			Search: rules,
 			Data:   attachment.Mimetype,
 		}
 
-		if !s.Find() {
+		// Archives which couldn't be extracted are kept as they are
+		if !s.Find() && !slices.Contains(failed, attachment) {
 			continue
 		}
 
-		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
-		}
-
-		if err := os.WriteFile(fmt.Sprintf("%s/%s", dir, attachment.Filename), attachment.Body, 0o644); err != nil {
-			if pe, ok := err.(*os.PathError); ok {
+		filename := fmt.Sprintf("%s/%s", dir, attachment.Filename)
+		if err := h.storage.Write(ctx, filename, attachment.Body); err != nil {
+			var pe *os.PathError
+			if errors.As(err, &pe) {
 				if pe.Err == syscall.ENAMETOOLONG {
 					log.Println("path too long: " + err.Error())
 					continue
@@ -52,21 +73,46 @@ func (h *AttachmentHandler) Handle(config *Config, mail *mail) error {
 			}
 			return fmt.Errorf("failed to write attachment: %w", err)
 		}
+
+		title := strings.TrimSuffix(attachment.Filename, filepath.Ext(attachment.Filename))
+		mail.Saved = append(mail.Saved, &savedFile{Path: filename, Title: title, Body: attachment.Body, Origin: attachment.Origin})
 	}
 
 	return nil
 }
 
+func archiveLimits(config *Config) archive.Limits {
+	limits := archive.Limits{
+		MaxSize:  config.Attachments.Archives.MaxSize,
+		MaxFiles: config.Attachments.Archives.MaxFiles,
+		MaxRatio: config.Attachments.Archives.MaxRatio,
+	}
+
+	if limits.MaxSize <= 0 {
+		limits.MaxSize = defaultArchiveMaxSize
+	}
+	if limits.MaxFiles <= 0 {
+		limits.MaxFiles = defaultArchiveMaxFiles
+	}
+	if limits.MaxRatio <= 0 {
+		limits.MaxRatio = defaultArchiveMaxRatio
+	}
+
+	return limits
+}
+
 // PDFHandler handles generating and saving email PDFs
 type PDFHandler struct {
 	username string
+	renderer Renderer
+	storage  Storage
 }
 
-func NewPDFHandler(username string) *PDFHandler {
-	return &PDFHandler{username: username}
+func NewPDFHandler(username string, renderer Renderer, storage Storage) *PDFHandler {
+	return &PDFHandler{username: username, renderer: renderer, storage: storage}
 }
 
-func (h *PDFHandler) Handle(config *Config, mail *mail) error {
+func (h *PDFHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
 	s := &search.Search{
 		Search: config.Mails.Subjects,
 		Data:   mail.Subject,
@@ -76,42 +122,39 @@ func (h *PDFHandler) Handle(config *Config, mail *mail) error {
 		return nil
 	}
 
-	bytes, err := mail.generatePdf()
+	bytes, err := mail.generatePdf(ctx, config, h.renderer)
 	if err != nil {
 		return fmt.Errorf("failed to generate PDF: %w", err)
 	}
 
+	if bytes, mail.PdfParts, err = mail.finishPdf(config, bytes); err != nil {
+		return fmt.Errorf("failed to finish PDF: %w", err)
+	}
+
 	if bytes == nil {
 		return nil
 	}
 
 	mailDir := mail.getDirectoryName("mail", h.username)
-	if err := os.MkdirAll(mailDir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
+	pdfFilename := fmt.Sprintf("%s/%s.pdf", mailDir, mail.getFileName())
 
-	safeSubject := sanitizeSubject(mail.Subject)
-	pdfFilename := fmt.Sprintf("%s/%s-%s-%d.pdf",
-		mailDir,
-		safeSubject,
-		mail.Date.Format("2006-01-02"),
-		mail.Uid,
-	)
-
-	if err = os.WriteFile(pdfFilename, bytes, 0o644); err != nil {
+	if err = h.storage.Write(ctx, pdfFilename, bytes); err != nil {
 		return fmt.Errorf("failed to write PDF: %w", err)
 	}
 
+	mail.Saved = append(mail.Saved, &savedFile{Path: pdfFilename, Title: mail.Subject, Body: bytes})
+
 	return nil
 }
 
 // TextHandler handles saving email text content
 type TextHandler struct {
 	username string
+	storage  Storage
 }
 
-func NewTextHandler(username string) *TextHandler {
-	return &TextHandler{username: username}
+func NewTextHandler(username string, storage Storage) *TextHandler {
+	return &TextHandler{username: username, storage: storage}
 }
 
 func mimeType(mime string) string {
@@ -119,34 +162,25 @@ func mimeType(mime string) string {
 	return strings.TrimSpace(t[0])
 }
 
-func (h *TextHandler) Handle(config *Config, mail *mail) error {
+func (h *TextHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
 	// Skip if no text content
 	if len(mail.Body) == 0 {
 		return nil
 	}
 
 	dir := mail.getDirectoryName("mail", h.username)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	safeSubject := sanitizeSubject(mail.Subject)
-	baseFilename := fmt.Sprintf("%s-%s-%d",
-		safeSubject,
-		mail.Date.Format("2006-01-02"),
-		mail.Uid,
-	)
+	baseFilename := mail.getFileName()
 
 	// Check MIME type and save appropriate content
 	switch mimeType(mail.MimeType) {
 	case "text/plain":
 		filename := fmt.Sprintf("%s/%s.txt", dir, baseFilename)
-		if err := os.WriteFile(filename, mail.Body[0], 0o644); err != nil {
+		if err := h.storage.Write(ctx, filename, mail.Body[0]); err != nil {
 			return fmt.Errorf("failed to write text file: %w", err)
 		}
 	case "text/html":
 		filename := fmt.Sprintf("%s/%s.html", dir, baseFilename)
-		if err := os.WriteFile(filename, mail.Body[0], 0o644); err != nil {
+		if err := h.storage.Write(ctx, filename, mail.Body[0]); err != nil {
 			return fmt.Errorf("failed to write HTML file: %w", err)
 		}
 	case "multipart/alternative", "multipart/mixed":
@@ -158,12 +192,12 @@ func (h *TextHandler) Handle(config *Config, mail *mail) error {
 			switch mimeType(detectedMimeType) {
 			case "text/plain":
 				filename := fmt.Sprintf("%s/%s.txt", dir, baseFilename)
-				if err := os.WriteFile(filename, body, 0o644); err != nil {
+				if err := h.storage.Write(ctx, filename, body); err != nil {
 					return fmt.Errorf("failed to write text file: %w", err)
 				}
 			case "text/html":
 				filename := fmt.Sprintf("%s/%s.html", dir, baseFilename)
-				if err := os.WriteFile(filename, body, 0o644); err != nil {
+				if err := h.storage.Write(ctx, filename, body); err != nil {
 					return fmt.Errorf("failed to write HTML file: %w", err)
 				}
 			default:
@@ -178,6 +212,30 @@ func (h *TextHandler) Handle(config *Config, mail *mail) error {
 	return nil
 }
 
+// EMLHandler handles saving the original message
+type EMLHandler struct {
+	username string
+	storage  Storage
+}
+
+func NewEMLHandler(username string, storage Storage) *EMLHandler {
+	return &EMLHandler{username: username, storage: storage}
+}
+
+func (h *EMLHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
+	if mail.Raw == nil {
+		return nil
+	}
+
+	dir := mail.getDirectoryName("mail", h.username)
+	filename := fmt.Sprintf("%s/%s.eml", dir, mail.getFileName())
+	if err := h.storage.Write(ctx, filename, mail.Raw); err != nil {
+		return fmt.Errorf("failed to write EML file: %w", err)
+	}
+
+	return nil
+}
+
 // sanitizeSubject removes or replaces unsafe characters in email subjects
 func sanitizeSubject(subject string) string {
 	subject = strings.TrimSpace(subject)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// headerFields are shown in the header block when no fields are configured
+var headerFields = []string{"from", "to", "cc", "date", "subject", "message_id", "attachments"}
+
+const defaultHeaderTemplate = `<style>
+.mail-header { font-family: Arial, Helvetica, sans-serif; font-size: 9pt; border-bottom: 1px solid #999; margin: 0 0 12px 0; padding: 0 0 6px 0; }
+.mail-header table { border-collapse: collapse; }
+.mail-header th { color: #555; font-weight: normal; padding: 1px 12px 1px 0; text-align: left; vertical-align: top; white-space: nowrap; }
+.mail-header td { padding: 1px 0; }
+</style>
+<div class="mail-header">
+<table>
+{{- if and .Show.from .From}}<tr><th>From</th><td>{{join .From ", "}}</td></tr>{{end}}
+{{- if and .Show.to .To}}<tr><th>To</th><td>{{join .To ", "}}</td></tr>{{end}}
+{{- if and .Show.cc .Cc}}<tr><th>Cc</th><td>{{join .Cc ", "}}</td></tr>{{end}}
+{{- if .Show.date}}<tr><th>Date</th><td>{{.Date}}</td></tr>{{end}}
+{{- if .Show.subject}}<tr><th>Subject</th><td>{{.Subject}}</td></tr>{{end}}
+{{- if and .Show.message_id .MessageID}}<tr><th>Message-ID</th><td>{{.MessageID}}</td></tr>{{end}}
+{{- if and .Show.attachments .Attachments}}<tr><th>Attachments</th><td>{{join .Attachments ", "}}</td></tr>{{end}}
+</table>
+</div>
+`
+
+// headerData is passed to the header template
+type headerData struct {
+	From        []string
+	To          []string
+	Cc          []string
+	Date        string
+	Subject     string
+	MessageID   string
+	Attachments []string
+	Show        map[string]bool
+}
+
+// renderHeader renders the header block of the mail with the configured template and fields
+func (mail *mail) renderHeader(config *Config) ([]byte, error) {
+	source := defaultHeaderTemplate
+	if path := config.Mails.Header.Template; path != "" {
+		custom, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header template: %w", err)
+		}
+		source = string(custom)
+	}
+
+	tmpl, err := template.New("header").Funcs(template.FuncMap{"join": strings.Join}).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse header template: %w", err)
+	}
+
+	fields := config.Mails.Header.Fields
+	if len(fields) == 0 {
+		fields = headerFields
+	}
+
+	show := make(map[string]bool)
+	for _, field := range fields {
+		show[strings.ToLower(field)] = true
+	}
+
+	// Files extracted from archives are listed as archive.zip!/invoice.pdf
+	all, _ := mail.attachments(config)
+	attachments := make([]string, len(all))
+	for i, att := range all {
+		attachments[i] = att.Filename
+		if att.Origin != "" {
+			attachments[i] = att.Origin
+		}
+	}
+
+	data := &headerData{
+		From:        formatAddresses(mail.From),
+		To:          formatAddresses(mail.To),
+		Cc:          formatAddresses(mail.Cc),
+		Date:        mail.Date.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
+		Subject:     mail.Subject,
+		MessageID:   mail.MessageID,
+		Attachments: attachments,
+		Show:        show,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render header template: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderHeader(t *testing.T) {
+	mail := &mail{
+		Subject:   "Invoice <123>",
+		MessageID: "abc@vendor",
+		From:      []*i.Address{{PersonalName: "Vendor", MailboxName: "billing", HostName: "vendor.com"}},
+		Date:      time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+		Attachments: []*attachment{
+			{Filename: "invoice.pdf"},
+			{Filename: "a.pdf", Origin: "docs.zip!/a.pdf"},
+		},
+	}
+
+	config := new(Config)
+	config.Mails.Header.Fields = []string{"subject", "attachments", "to"}
+
+	header, err := mail.renderHeader(config)
+	assert.NoError(t, err)
+	assert.Contains(t, string(header), "<td>Invoice &lt;123&gt;</td>")
+	assert.Contains(t, string(header), "<td>invoice.pdf, docs.zip!/a.pdf</td>")
+	assert.NotContains(t, string(header), "Message-ID")
+	assert.NotContains(t, string(header), "<th>To</th>")
+
+	path := filepath.Join(t.TempDir(), "header.html")
+	assert.NoError(t, os.WriteFile(path, []byte(`<p>{{.Subject}} {{.Date}}</p>`), 0644))
+	config.Mails.Header.Template = path
+
+	header, err = mail.renderHeader(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Invoice &lt;123&gt; Fri, 01 Mar 2024 10:00:00 &#43;0000</p>", string(header))
+}
+
+func TestPrependHtml(t *testing.T) {
+	page, err := prependHtml([]byte(`<html><body><p>body</p></body></html>`), []byte(`<div>header</div>`))
+	assert.NoError(t, err)
+	assert.Equal(t, `<html><head></head><body><div>header</div><p>body</p></body></html>`, string(page))
+}
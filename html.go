@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	cssURL    = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]*)['"]?\s*\)`)
+	cssImport = regexp.MustCompile(`(?i)@import\s+(['"])([^'"]*)['"]`)
+	cssString = regexp.MustCompile(`(['"])([^'"]*)['"]`)
+	// cssEscape matches hex escapes with their optional trailing space and
+	// escaped characters
+	cssEscape = regexp.MustCompile(`\\(?:([0-9a-fA-F]{1,6})[ \t\n\f]?|([^0-9a-fA-F\r\n\f]))`)
+	// urlLike matches strings with a scheme or a network path, e.g. in image-set()
+	urlLike = regexp.MustCompile(`(?i)^\s*(//|[a-z][a-z0-9+.-]*:\S)`)
+)
+
+// blockedElements load or navigate to content the rewriter can't inspect
+var blockedElements = map[string]bool{
+	"iframe": true,
+	"frame":  true,
+	"object": true,
+	"embed":  true,
+	"applet": true,
+}
+
+// urlAttributes are loaded by the renderer, links (a href) are not
+var urlAttributes = map[string]bool{
+	"src":        true,
+	"background": true,
+	"poster":     true,
+	"data":       true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+}
+
+// htmlRewriter resolves cid: references against the parts of a mail and blocks
+// remote content from hosts which aren't allowed
+type htmlRewriter struct {
+	parts        map[string]*mimePart
+	allowedHosts []string
+}
+
+func (mail *mail) newHtmlRewriter(allowedHosts []string) *htmlRewriter {
+	parts := make(map[string]*mimePart)
+
+	for _, part := range mail.Parts {
+		id := strings.Trim(strings.TrimSpace(part.Header.Get("Content-Id")), "<>")
+		if id == "" || part.Body == nil {
+			continue
+		}
+
+		if _, ok := parts[id]; !ok {
+			parts[id] = part
+		}
+	}
+
+	return &htmlRewriter{parts: parts, allowedHosts: allowedHosts}
+}
+
+// rewrite returns the html with all resolved and blocked urls replaced
+func (rewriter *htmlRewriter) rewrite(body []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	rewriter.rewriteNode(doc)
+
+	buf := new(bytes.Buffer)
+	if err := html.Render(buf, doc); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (rewriter *htmlRewriter) rewriteNode(node *html.Node) {
+	switch node.Type {
+	case html.ElementNode:
+		if blockedElements[node.Data] || isRefresh(node) {
+			node.Parent.RemoveChild(node)
+			return
+		}
+
+		for i, attr := range node.Attr {
+			key := strings.ToLower(attr.Key)
+
+			switch {
+			case urlAttributes[key]:
+				node.Attr[i].Val = rewriter.resolve(attr.Val)
+			case key == "srcset":
+				node.Attr[i].Val = rewriter.resolveSrcset(attr.Val)
+			case key == "href" && node.Data != "a" && node.Data != "area":
+				node.Attr[i].Val = rewriter.resolve(attr.Val)
+			case key == "style":
+				node.Attr[i].Val = rewriter.resolveCss(attr.Val)
+			}
+		}
+	case html.TextNode:
+		if node.Parent != nil && node.Parent.Data == "style" {
+			node.Data = rewriter.resolveCss(node.Data)
+		}
+	}
+
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		rewriter.rewriteNode(child)
+		child = next
+	}
+}
+
+// isRefresh reports whether node is a <meta http-equiv="refresh"> element
+func isRefresh(node *html.Node) bool {
+	if node.Data != "meta" {
+		return false
+	}
+
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, "http-equiv") && strings.EqualFold(strings.TrimSpace(attr.Val), "refresh") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve returns a data uri for cid: urls, an empty string for blocked urls
+// and the unchanged value for everything else
+func (rewriter *htmlRewriter) resolve(value string) string {
+	trimmed := strings.TrimSpace(value)
+	lower := strings.ToLower(trimmed)
+
+	switch {
+	case strings.HasPrefix(lower, "cid:"):
+		id, err := url.PathUnescape(trimmed[len("cid:"):])
+		if err != nil {
+			id = trimmed[len("cid:"):]
+		}
+
+		part, ok := rewriter.parts[strings.Trim(id, "<>")]
+		if !ok {
+			return ""
+		}
+
+		return "data:" + part.ContentType + ";base64," + base64.StdEncoding.EncodeToString(part.Body)
+	case strings.HasPrefix(lower, "data:"), strings.HasPrefix(lower, "#"):
+		return value
+	}
+
+	u, err := url.Parse(trimmed)
+	if err != nil {
+		return ""
+	}
+
+	// relative urls can't be resolved from a mail
+	if u.Scheme == "" && u.Host == "" {
+		return value
+	}
+
+	if (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https") && hostAllowed(u.Hostname(), rewriter.allowedHosts) {
+		return value
+	}
+
+	return ""
+}
+
+func (rewriter *htmlRewriter) resolveSrcset(value string) string {
+	candidates := strings.Split(value, ",")
+	resolved := make([]string, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+
+		fields[0] = rewriter.resolve(fields[0])
+		if fields[0] == "" {
+			continue
+		}
+
+		resolved = append(resolved, strings.Join(fields, " "))
+	}
+
+	return strings.Join(resolved, ", ")
+}
+
+// resolveCss resolves the urls of a stylesheet. Escapes are decoded first, so
+// e.g. u\72l( can't hide an url from the rewriter.
+func (rewriter *htmlRewriter) resolveCss(css string) string {
+	css = unescapeCss(css)
+
+	css = cssImport.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssImport.FindStringSubmatch(match)
+		return "@import " + groups[1] + rewriter.resolve(groups[2]) + groups[1]
+	})
+
+	css = cssURL.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURL.FindStringSubmatch(match)
+		return "url(" + groups[1] + rewriter.resolve(groups[2]) + groups[1] + ")"
+	})
+
+	// Strings are urls in image-set() and similar functions
+	return cssString.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssString.FindStringSubmatch(match)
+		if !urlLike.MatchString(groups[2]) {
+			return match
+		}
+		return groups[1] + rewriter.resolve(groups[2]) + groups[1]
+	})
+}
+
+// unescapeCss decodes css escapes. Quotes, backslashes and control characters
+// stay escaped, so strings keep their bounds.
+func unescapeCss(css string) string {
+	return cssEscape.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssEscape.FindStringSubmatch(match)
+
+		r, _ := utf8.DecodeRuneInString(groups[2])
+		if groups[1] != "" {
+			code, _ := strconv.ParseUint(groups[1], 16, 32)
+			if code == 0 || code > unicode.MaxRune || (code >= 0xd800 && code <= 0xdfff) {
+				return string(unicode.ReplacementChar)
+			}
+			r = rune(code)
+		}
+
+		if r == '"' || r == '\'' || r == '\\' || unicode.IsControl(r) {
+			return match
+		}
+
+		return string(r)
+	})
+}
+
+// hostAllowed matches host against exact hosts and "*.example.com" patterns
+func hostAllowed(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+
+		if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prependHtml inserts the html fragment at the beginning of the body of page
+func prependHtml(page, fragment []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil, err
+	}
+
+	body := findElement(doc, "body")
+	if body == nil {
+		return nil, errors.New("html without body")
+	}
+
+	nodes, err := html.ParseFragment(bytes.NewReader(fragment), body)
+	if err != nil {
+		return nil, err
+	}
+
+	first := body.FirstChild
+	for _, node := range nodes {
+		body.InsertBefore(node, first)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := html.Render(buf, doc); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func findElement(node *html.Node, name string) *html.Node {
+	if node.Type == html.ElementNode && node.Data == name {
+		return node
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, name); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+// combinePages merges html pages into a single document. The bodies of later
+// pages start on a new sheet and their styles are moved into the first head.
+func combinePages(pages [][]byte) ([]byte, error) {
+	if len(pages) == 1 {
+		return pages[0], nil
+	}
+
+	doc, err := html.Parse(bytes.NewReader(pages[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	head, body := findElement(doc, "head"), findElement(doc, "body")
+	if head == nil || body == nil {
+		return nil, errors.New("html without body")
+	}
+
+	for _, page := range pages[1:] {
+		other, err := html.Parse(bytes.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+
+		if otherHead := findElement(other, "head"); otherHead != nil {
+			for child := otherHead.FirstChild; child != nil; {
+				next := child.NextSibling
+				if child.Type == html.ElementNode && (child.Data == "style" || child.Data == "link") {
+					otherHead.RemoveChild(child)
+					head.AppendChild(child)
+				}
+				child = next
+			}
+		}
+
+		wrapper := &html.Node{
+			Type: html.ElementNode,
+			Data: "div",
+			Attr: []html.Attribute{{Key: "style", Val: "break-before: page"}},
+		}
+		body.AppendChild(wrapper)
+
+		if otherBody := findElement(other, "body"); otherBody != nil {
+			for otherBody.FirstChild != nil {
+				child := otherBody.FirstChild
+				otherBody.RemoveChild(child)
+				wrapper.AppendChild(child)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := html.Render(buf, doc); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
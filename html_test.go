@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHtmlRewriter(t *testing.T) {
+	var header message.Header
+	header.Set("Content-Id", "<logo@vendor>")
+
+	mail := &mail{Parts: []*mimePart{
+		{Path: "2", Header: header, ContentType: "image/png", Body: []byte("png")},
+	}}
+
+	rewriter := mail.newHtmlRewriter([]string{"cdn.vendor.com", "*.images.com"})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    `<img src="cid:logo@vendor">`,
+			expected: `<img src="data:image/png;base64,cG5n"/>`,
+		},
+		{
+			input:    `<img src="cid:missing">`,
+			expected: `<img src=""/>`,
+		},
+		{
+			input:    `<img src="https://tracker.com/pixel.gif">`,
+			expected: `<img src=""/>`,
+		},
+		{
+			input:    `<img src="https://cdn.vendor.com/logo.png">`,
+			expected: `<img src="https://cdn.vendor.com/logo.png"/>`,
+		},
+		{
+			input:    `<img src="//a.images.com/x.png">`,
+			expected: `<img src="//a.images.com/x.png"/>`,
+		},
+		{
+			input:    `<img src="file:///etc/passwd">`,
+			expected: `<img src=""/>`,
+		},
+		{
+			input:    `<a href="https://vendor.com/invoice">invoice</a>`,
+			expected: `<a href="https://vendor.com/invoice">invoice</a>`,
+		},
+		{
+			input:    `<link rel="stylesheet" href="https://fonts.com/font.css">`,
+			expected: `<link rel="stylesheet" href=""/>`,
+		},
+		{
+			input:    `<div style="background: url('https://tracker.com/bg.png')"></div>`,
+			expected: `<div style="background: url(&#39;&#39;)"></div>`,
+		},
+		{
+			input:    `<style>@import "https://tracker.com/a.css"; td { background: url(cid:logo@vendor) }</style>`,
+			expected: `<style>@import ""; td { background: url(data:image/png;base64,cG5n) }</style>`,
+		},
+		{
+			input:    `<img srcset="https://tracker.com/a.png 1x, cid:logo@vendor 2x">`,
+			expected: `<img srcset="data:image/png;base64,cG5n 2x"/>`,
+		},
+		{
+			input:    `<iframe srcdoc="&lt;img src=https://tracker.com/a.png&gt;"></iframe><p>text</p>`,
+			expected: `<p>text</p>`,
+		},
+		{
+			input:    `<object data="https://tracker.com/a.svg"><embed src="https://tracker.com/a.swf"/></object>`,
+			expected: ``,
+		},
+		{
+			input:    `<meta http-equiv="Refresh" content="0; url=https://tracker.com/"><meta charset="utf-8">`,
+			expected: `<meta charset="utf-8"/>`,
+		},
+		{
+			input:    `<div style="background-image: image-set(&#34;https://tracker.com/a.png&#34; 1x, 'https://cdn.vendor.com/b.png' 2x)"></div>`,
+			expected: `<div style="background-image: image-set(&#34;&#34; 1x, &#39;https://cdn.vendor.com/b.png&#39; 2x)"></div>`,
+		},
+		{
+			input:    `<div style="background: u\72l(https://tracker.com/a.png)"></div>`,
+			expected: `<div style="background: url()"></div>`,
+		},
+		{
+			input:    `<style>td { background: \75 \72 \6c (https://tracker.com/a.png); content: "\"a\"" }</style>`,
+			expected: `<style>td { background: url(); content: "\"a\"" }</style>`,
+		},
+	}
+
+	for _, test := range tests {
+		output, err := rewriter.rewrite([]byte(test.input))
+		assert.NoError(t, err)
+
+		body := string(output)
+		body = body[strings.Index(body, "<body>")+len("<body>") : strings.Index(body, "</body>")]
+		if strings.HasPrefix(test.input, "<link") || strings.HasPrefix(test.input, "<style") || strings.HasPrefix(test.input, "<meta") {
+			body = string(output)
+			body = body[strings.Index(body, "<head>")+len("<head>") : strings.Index(body, "</head>")]
+		}
+
+		assert.Equal(t, test.expected, body, test.input)
+	}
+}
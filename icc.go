@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// srgbProfile returns an ICC v2 display profile for sRGB, as needed for the
+// output intent of PDF/A documents
+func srgbProfile() []byte {
+	type tag struct {
+		signature string
+		data      []byte
+	}
+
+	// Tone reproduction curve shared by all channels
+	curve := new(bytes.Buffer)
+	curve.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(curve, binary.BigEndian, uint32(1024))
+	for i := 0; i < 1024; i++ {
+		v := float64(i) / 1023
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(curve, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+
+	tags := []tag{
+		{"desc", iccDescription("sRGB")},
+		{"cprt", iccText("No copyright, use freely")},
+		{"wtpt", iccXYZ(0.9642, 1, 0.8249)},
+		{"rXYZ", iccXYZ(0.4360747, 0.2225045, 0.0139322)},
+		{"gXYZ", iccXYZ(0.3850649, 0.7168786, 0.0971045)},
+		{"bXYZ", iccXYZ(0.1430804, 0.0606169, 0.7141733)},
+		{"rTRC", curve.Bytes()},
+		{"gTRC", curve.Bytes()},
+		{"bTRC", curve.Bytes()},
+	}
+
+	table := new(bytes.Buffer)
+	data := new(bytes.Buffer)
+	offset := 128 + 4 + 12*len(tags)
+	starts := make([]int, len(tags))
+
+	binary.Write(table, binary.BigEndian, uint32(len(tags)))
+	for i, t := range tags {
+		starts[i] = -1
+		// Identical data is only stored once
+		for j := 0; j < i; j++ {
+			if bytes.Equal(tags[j].data, t.data) {
+				starts[i] = starts[j]
+				break
+			}
+		}
+
+		if starts[i] < 0 {
+			starts[i] = offset + data.Len()
+			data.Write(t.data)
+			for data.Len()%4 != 0 {
+				data.WriteByte(0)
+			}
+		}
+
+		table.WriteString(t.signature)
+		binary.Write(table, binary.BigEndian, uint32(starts[i]))
+		binary.Write(table, binary.BigEndian, uint32(len(t.data)))
+	}
+
+	header := make([]byte, 128)
+	binary.BigEndian.PutUint32(header[0:], uint32(offset+data.Len()))
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntrRGB XYZ ")
+	binary.BigEndian.PutUint16(header[24:], 2024)
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	copy(header[68:], iccXYZ(0.9642, 1, 0.8249)[8:])
+
+	profile := append(header, table.Bytes()...)
+	return append(profile, data.Bytes()...)
+}
+
+func iccFixed(v float64) uint32 {
+	return uint32(int32(math.Round(v * 65536)))
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("XYZ \x00\x00\x00\x00")
+	for _, v := range []float64{x, y, z} {
+		binary.Write(buf, binary.BigEndian, iccFixed(v))
+	}
+	return buf.Bytes()
+}
+
+func iccText(text string) []byte {
+	return []byte("text\x00\x00\x00\x00" + text + "\x00")
+}
+
+func iccDescription(text string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("desc\x00\x00\x00\x00")
+	binary.Write(buf, binary.BigEndian, uint32(len(text)+1))
+	buf.WriteString(text + "\x00")
+	// Empty unicode and ScriptCode descriptions
+	buf.Write(make([]byte, 4+4+2+1+67))
+	return buf.Bytes()
+}
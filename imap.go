@@ -1,7 +1,9 @@
 package main
 
 import (
-	"log"
+	"context"
+	"io"
+	"net"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -10,24 +12,45 @@ import (
 	id "github.com/emersion/go-imap-id"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/charset"
-	m "github.com/emersion/go-message/mail"
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/pkg/errors"
 	"golang.org/x/text/encoding/charmap"
 )
 
+// fetchBatchSize limits how many messages are requested per UID FETCH, so
+// a cancelled run only has to drain the current batch before logging out
+const fetchBatchSize = 50
+
 type imap struct {
 	Username string
 	Password string
 	Server   string
 	Port     string
 	Client   *client.Client
+	// Delimiter separates the levels of the selected mailbox name
+	Delimiter string
+	// UseGmail enables the Gmail extensions if the server supports them
+	UseGmail bool
+	// Gmail is set if the Gmail extensions are used
+	Gmail bool
+	// LabelDirectories stores Gmail mails below their label
+	LabelDirectories bool
+}
+
+// contextDialer adapts a context aware dialer to the go-imap Dialer interface
+type contextDialer struct {
+	ctx context.Context
+	*net.Dialer
+}
+
+func (dialer *contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialer.DialContext(dialer.ctx, network, addr)
 }
 
-func (imap *imap) connect() error {
-	c, err := client.DialTLS(imap.Server+":"+imap.Port, nil)
+func (imap *imap) connect(ctx context.Context) error {
+	dialer := &contextDialer{ctx: ctx, Dialer: new(net.Dialer)}
+	c, err := client.DialWithDialerTLS(dialer, imap.Server+":"+imap.Port, nil)
 	if err != nil {
-		return err
+		return &ConnectionError{Op: "connect", Err: err}
 	}
 
 	// Enable ID extension support
@@ -37,27 +60,89 @@ func (imap *imap) connect() error {
 		id.FieldVersion: "1.0.0",
 	})
 	if err != nil {
-		return err
+		return &ConnectionError{Op: "id", Err: err}
 	}
 
 	imap.Client = c
 	return nil
 }
 
-func (imap *imap) login() error {
-	return imap.Client.Login(imap.Username, imap.Password)
+func (imap *imap) login(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := imap.Client.Login(imap.Username, imap.Password); err != nil {
+		return &ConnectionError{Op: "login", Err: err}
+	}
+
+	if !imap.UseGmail {
+		return nil
+	}
+
+	gmail, err := imap.Client.Support(gmailCapability)
+	if err != nil {
+		return &ConnectionError{Op: "capability", Err: err}
+	}
+	imap.Gmail = gmail
+
+	return nil
+}
+
+func (imap *imap) logout() error {
+	return imap.Client.Logout()
 }
 
-func (imap *imap) selectMailbox(mailbox string) (*i.MailboxStatus, error) {
-	return imap.Client.Select(mailbox, true)
+func (imap *imap) selectMailbox(ctx context.Context, mailbox string) (*i.MailboxStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	status, err := imap.Client.Select(mailbox, true)
+	if err != nil {
+		return nil, &ConnectionError{Op: "select " + mailbox, Err: err}
+	}
+
+	delimiter, err := imap.delimiter(mailbox)
+	if err != nil {
+		return nil, &ConnectionError{Op: "list " + mailbox, Err: err}
+	}
+	imap.Delimiter = delimiter
+
+	return status, nil
 }
 
-func (imap *imap) search(from, to time.Time) ([]uint32, error) {
+// delimiter returns the hierarchy delimiter of mailbox, which is empty for flat servers
+func (imap *imap) delimiter(mailbox string) (string, error) {
+	mailboxes := make(chan *i.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- imap.Client.List("", mailbox, mailboxes)
+	}()
+
+	delimiter := ""
+	for info := range mailboxes {
+		delimiter = info.Delimiter
+	}
+
+	return delimiter, <-done
+}
+
+func (imap *imap) search(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	search := i.NewSearchCriteria()
 	search.Since = from
 	search.Before = to
 
-	return imap.Client.UidSearch(search)
+	uids, err := imap.Client.UidSearch(search)
+	if err != nil {
+		return nil, &ConnectionError{Op: "search", Err: err}
+	}
+
+	return uids, nil
 }
 
 func (imap *imap) createSeqSet(uids []uint32) *i.SeqSet {
@@ -85,7 +170,25 @@ func (imap *imap) fixUtf(str string) string {
 	return strings.Map(callable, str)
 }
 
-func (imap *imap) fetchMessages(seqset *i.SeqSet, mailsChan chan *mail) error {
+// fetchMessages fetches the given uids in batches and sends them to mailsChan.
+// Once ctx is cancelled the message being read is finished, the rest of the
+// current batch is drained and ctx.Err() is returned.
+func (imap *imap) fetchMessages(ctx context.Context, uids []uint32, mailsChan chan *mail) error {
+	for start := 0; start < len(uids); start += fetchBatchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := min(start+fetchBatchSize, len(uids))
+		if err := imap.fetchBatch(ctx, imap.createSeqSet(uids[start:end]), mailsChan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (imap *imap) fetchBatch(ctx context.Context, seqset *i.SeqSet, mailsChan chan *mail) error {
 	messages := make(chan *i.Message)
 	section := new(i.BodySectionName)
 	items := []i.FetchItem{
@@ -93,78 +196,96 @@ func (imap *imap) fetchMessages(seqset *i.SeqSet, mailsChan chan *mail) error {
 		i.FetchEnvelope,
 		i.FetchBody,
 		i.FetchBodyStructure,
+		i.FetchFlags,
+		i.FetchInternalDate,
+	}
+	if imap.Gmail {
+		items = append(items, gmailMsgID, gmailLabels)
 	}
 
+	done := make(chan error, 1)
 	go func() {
-		if err := imap.Client.UidFetch(seqset, items, messages); err != nil {
-			log.Println(err)
-		}
+		done <- imap.Client.UidFetch(seqset, items, messages)
 	}()
 
 	for message := range messages {
-		mail := new(mail)
-		mail.fetchMeta(message)
-
-		// Get MIME type from the message structure
-		if message.BodyStructure != nil {
-			mail.MimeType = message.BodyStructure.MIMEType + "/" + message.BodyStructure.MIMESubType
+		// The client blocks until all messages are read, so drain them after cancellation
+		if ctx.Err() != nil {
+			continue
 		}
 
-		reader := message.GetBody(section)
+		mailsChan <- imap.readMessage(message, section)
+	}
 
-		if reader == nil {
-			return errors.New("no reader")
-		}
+	if err := <-done; err != nil {
+		return &ConnectionError{Op: "fetch", Err: err}
+	}
+
+	return ctx.Err()
+}
 
-		mailReader, err := m.CreateReader(reader)
+// readMessage parses a fetched message. Failures are recorded as MessageError in mail.Error.
+func (imap *imap) readMessage(message *i.Message, section *i.BodySectionName) *mail {
+	mail := new(mail)
+	mail.fetchMeta(message)
+	if imap.Gmail {
+		imap.readGmail(mail, message)
+	}
 
-		if err != nil {
-			mail.Error = err
-			mailsChan <- mail
+	// Get MIME type from the message structure
+	if message.BodyStructure != nil {
+		mail.MimeType = message.BodyStructure.MIMEType + "/" + message.BodyStructure.MIMESubType
+	}
 
-			if mailReader != nil {
-				if err := mailReader.Close(); err != nil {
-					log.Fatal(err)
-				}
-			}
+	if mailbox := imap.Client.Mailbox(); mailbox != nil {
+		mail.Mailbox = mailbox.Name
+		mail.Delimiter = imap.Delimiter
+	}
 
-			continue
-		}
+	reader := message.GetBody(section)
 
-		// Initialize MultipartMimeType and AttachmentMimeType slices before fetching body
-		mail.MultipartMimeType = make([]string, 0)
-		mail.AttachmentMimeType = make([]string, 0)
+	if reader == nil {
+		mail.Error = &MessageError{Uid: mail.Uid, Op: "read body", Err: errors.New("no reader")}
+		return mail
+	}
 
-		mail.Error = mail.fetchBody(mailReader)
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		mail.Error = &MessageError{Uid: mail.Uid, Op: "read body", Err: err}
+		return mail
+	}
+	mail.Raw = raw
 
-		// Detect MIME types for each body part
-		for _, body := range mail.Body {
-			if len(body) > 0 {
-				mtype := mimetype.Detect(body)
-				if mtype != nil {
-					mail.MultipartMimeType = append(mail.MultipartMimeType, mtype.String())
-				}
-			}
-		}
+	if err := mail.parse(raw); err != nil {
+		mail.Error = &MessageError{Uid: mail.Uid, Op: "parse", Err: err}
+		return mail
+	}
 
-		// Detect MIME types for each attachment
-		for _, attachment := range mail.Attachments {
-			if len(attachment.Body) > 0 {
-				mtype := mimetype.Detect(attachment.Body)
-				if mtype != nil {
-					mail.AttachmentMimeType = append(mail.AttachmentMimeType, mtype.String())
-				}
-			}
-		}
+	return mail
+}
 
-		mailsChan <- mail
+// searchFrom returns all uids greater than or equal to uid in the selected mailbox
+func (imap *imap) searchFrom(ctx context.Context, uid uint32) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	search := i.NewSearchCriteria()
+	search.Uid = new(i.SeqSet)
+	search.Uid.AddRange(uid, 0)
 
-		if mailReader != nil {
-			if err := mailReader.Close(); err != nil {
-				log.Fatal(err)
-			}
+	uids, err := imap.Client.UidSearch(search)
+	if err != nil {
+		return nil, &ConnectionError{Op: "search", Err: err}
+	}
+
+	// "uid:*" always matches the last message, even if its uid is lower
+	filtered := make([]uint32, 0, len(uids))
+	for _, u := range uids {
+		if u >= uid {
+			filtered = append(filtered, u)
 		}
 	}
 
-	return nil
+	return filtered, nil
 }
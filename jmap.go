@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	i "github.com/emersion/go-imap"
+)
+
+// JMAP capabilities (RFC 8620, RFC 8621)
+const (
+	jmapCore = "urn:ietf:params:jmap:core"
+	jmapMail = "urn:ietf:params:jmap:mail"
+)
+
+// jmapPageSize limits the ids per Email/query and Email/get call
+const jmapPageSize = 256
+
+// jmapKeywords maps JMAP keywords to IMAP flags
+var jmapKeywords = map[string]string{
+	"$seen":     i.SeenFlag,
+	"$flagged":  i.FlaggedFlag,
+	"$answered": i.AnsweredFlag,
+	"$draft":    i.DraftFlag,
+}
+
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+// jmapInvocation is a method call or response, serialized as [name, arguments, id]
+type jmapInvocation struct {
+	Name string
+	Args any
+	ID   string
+}
+
+func (inv jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.ID})
+}
+
+func (inv *jmapInvocation) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid invocation: %s", data)
+	}
+
+	var args json.RawMessage = fields[1]
+	inv.Args = args
+	if err := json.Unmarshal(fields[0], &inv.Name); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(fields[2], &inv.ID)
+}
+
+// jmapMethodError is returned for "error" responses
+type jmapMethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *jmapMethodError) Error() string {
+	if e.Description != "" {
+		return e.Type + ": " + e.Description
+	}
+
+	return e.Type
+}
+
+type jmapEmail struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+}
+
+type jmapMailbox struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+}
+
+// jmap is a minimal JMAP mail client
+type jmap struct {
+	SessionURL string
+	Token      string
+	Username   string
+	Password   string
+	client     *http.Client
+	session    *jmapSession
+	accountID  string
+}
+
+func (j *jmap) request(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+j.Token)
+	} else {
+		req.SetBasicAuth(j.Username, j.Password)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+// connect fetches the session resource
+func (j *jmap) connect(ctx context.Context) error {
+	data, err := j.request(ctx, http.MethodGet, j.SessionURL, nil)
+	if err != nil {
+		return &ConnectionError{Op: "session", Err: err}
+	}
+
+	session := new(jmapSession)
+	if err := json.Unmarshal(data, session); err != nil {
+		return &ConnectionError{Op: "session", Err: err}
+	}
+
+	j.accountID = session.PrimaryAccounts[jmapMail]
+	if j.accountID == "" {
+		return &ConnectionError{Op: "session", Err: errors.New("no mail account")}
+	}
+
+	// Relative URLs are resolved against the session URL
+	base, err := url.Parse(j.SessionURL)
+	if err != nil {
+		return &ConnectionError{Op: "session", Err: err}
+	}
+
+	api, err := base.Parse(session.APIURL)
+	if err != nil {
+		return &ConnectionError{Op: "session", Err: err}
+	}
+	session.APIURL = api.String()
+
+	if !strings.HasPrefix(session.DownloadURL, "http") {
+		session.DownloadURL = base.Scheme + "://" + base.Host + session.DownloadURL
+	}
+
+	j.session = session
+	return nil
+}
+
+// call runs a single method and decodes its response into result
+func (j *jmap) call(ctx context.Context, method string, args map[string]any, result any) error {
+	args["accountId"] = j.accountID
+	body, err := json.Marshal(map[string]any{
+		"using":       []string{jmapCore, jmapMail},
+		"methodCalls": []jmapInvocation{{Name: method, Args: args, ID: "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := j.request(ctx, http.MethodPost, j.session.APIURL, body)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		MethodResponses []jmapInvocation `json:"methodResponses"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return err
+	}
+
+	if len(response.MethodResponses) != 1 {
+		return fmt.Errorf("expected 1 method response, got %d", len(response.MethodResponses))
+	}
+
+	invocation := response.MethodResponses[0]
+	raw := invocation.Args.(json.RawMessage)
+	if invocation.Name == "error" {
+		methodErr := new(jmapMethodError)
+		if err := json.Unmarshal(raw, methodErr); err != nil {
+			return err
+		}
+		return methodErr
+	}
+
+	return json.Unmarshal(raw, result)
+}
+
+// download returns the content of a blob
+func (j *jmap) download(ctx context.Context, blobID string) ([]byte, error) {
+	link := strings.NewReplacer(
+		"{accountId}", url.PathEscape(j.accountID),
+		"{blobId}", url.PathEscape(blobID),
+		"{name}", "mail.eml",
+		"{type}", url.QueryEscape("message/rfc822"),
+	).Replace(j.session.DownloadURL)
+
+	return j.request(ctx, http.MethodGet, link, nil)
+}
+
+// mailboxes returns the full names of all mailboxes by id, levels are separated by "/"
+func (j *jmap) mailboxes(ctx context.Context) (map[string]string, error) {
+	var result struct {
+		List []jmapMailbox `json:"list"`
+	}
+	if err := j.call(ctx, "Mailbox/get", map[string]any{"ids": nil}, &result); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]jmapMailbox, len(result.List))
+	for _, mailbox := range result.List {
+		byID[mailbox.ID] = mailbox
+	}
+
+	names := make(map[string]string, len(result.List))
+	for _, mailbox := range result.List {
+		name := mailbox.Name
+		// Limit the depth in case of a broken hierarchy
+		for parent, depth := mailbox.ParentID, 0; parent != "" && depth < len(byID); depth++ {
+			name = byID[parent].Name + "/" + name
+			parent = byID[parent].ParentID
+		}
+		names[mailbox.ID] = name
+	}
+
+	return names, nil
+}
+
+// state returns the current Email state
+func (j *jmap) state(ctx context.Context) (string, error) {
+	var result struct {
+		State string `json:"state"`
+	}
+	err := j.call(ctx, "Email/get", map[string]any{"ids": []string{}}, &result)
+	return result.State, err
+}
+
+// query returns the ids of all emails received between from and to. Servers
+// may return less ids than requested, so pages are read up to the total.
+func (j *jmap) query(ctx context.Context, from, to time.Time) ([]string, error) {
+	ids := make([]string, 0)
+	for {
+		var result struct {
+			IDs   []string `json:"ids"`
+			Total *int     `json:"total"`
+		}
+		err := j.call(ctx, "Email/query", map[string]any{
+			"filter": map[string]any{
+				"after":  from.UTC().Format(time.RFC3339),
+				"before": to.UTC().Format(time.RFC3339),
+			},
+			"sort":           []map[string]any{{"property": "receivedAt", "isAscending": true}},
+			"position":       len(ids),
+			"limit":          jmapPageSize,
+			"calculateTotal": true,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, result.IDs...)
+		if len(result.IDs) == 0 || (result.Total != nil && len(ids) >= *result.Total) {
+			return ids, nil
+		}
+	}
+}
+
+// changes returns the ids of all emails created since state and the new state
+func (j *jmap) changes(ctx context.Context, state string) ([]string, string, error) {
+	ids := make([]string, 0)
+	for {
+		var result struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+		}
+		if err := j.call(ctx, "Email/changes", map[string]any{"sinceState": state}, &result); err != nil {
+			return nil, "", err
+		}
+
+		ids = append(ids, result.Created...)
+		state = result.NewState
+		if !result.HasMoreChanges {
+			return ids, state, nil
+		}
+	}
+}
+
+// emails returns the properties needed to download the emails
+func (j *jmap) emails(ctx context.Context, ids []string) ([]*jmapEmail, error) {
+	emails := make([]*jmapEmail, 0, len(ids))
+	for start := 0; start < len(ids); start += jmapPageSize {
+		var result struct {
+			List []*jmapEmail `json:"list"`
+		}
+		err := j.call(ctx, "Email/get", map[string]any{
+			"ids":        ids[start:min(start+jmapPageSize, len(ids))],
+			"properties": []string{"id", "blobId", "receivedAt", "mailboxIds", "keywords"},
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, result.List...)
+	}
+
+	return emails, nil
+}
+
+// jmapSource reads the emails of a JMAP account. Once all emails of a run were
+// processed, only emails created since its state are considered. Uids are assigned like for
+// POP3 and stay the same for an email id.
+type jmapSource struct {
+	*jmap
+	mailList  *mailList
+	known     map[string]uint32
+	last      uint32
+	names     map[string]string
+	emails    map[uint32]*jmapEmail
+	nextState string
+	// outOfRange is set if Search left out emails outside of the date range,
+	// the state isn't stored then so a later run with their dates finds them
+	outOfRange bool
+}
+
+func newJmapSource(config *Config) *jmapSource {
+	return &jmapSource{
+		jmap: &jmap{
+			SessionURL: config.Jmap.Session,
+			Token:      config.Jmap.Token,
+			Username:   config.Jmap.Username,
+			Password:   config.Jmap.Password,
+			client:     &http.Client{Timeout: 5 * time.Minute},
+		},
+		known:  make(map[string]uint32),
+		emails: make(map[uint32]*jmapEmail),
+	}
+}
+
+func (s *jmapSource) Open(ctx context.Context) error {
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+
+	names, err := s.mailboxes(ctx)
+	if err != nil {
+		return &ConnectionError{Op: "mailboxes", Err: err}
+	}
+
+	s.names = names
+	return nil
+}
+
+func (s *jmapSource) Track(mailList *mailList) {
+	s.mailList = mailList
+	s.known, s.last = mailList.remoteIDs()
+}
+
+func (s *jmapSource) Search(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ids, err := s.search(ctx, from, to)
+	if err != nil {
+		return nil, &ConnectionError{Op: "search", Err: err}
+	}
+
+	emails, err := s.jmap.emails(ctx, ids)
+	if err != nil {
+		return nil, &ConnectionError{Op: "get", Err: err}
+	}
+
+	sort.SliceStable(emails, func(a, b int) bool {
+		return emails[a].ReceivedAt.Before(emails[b].ReceivedAt)
+	})
+
+	uids := make([]uint32, 0, len(emails))
+	for _, email := range emails {
+		if _, ok := s.known[email.ID]; ok {
+			continue
+		}
+
+		if email.ReceivedAt.Before(from) || !email.ReceivedAt.Before(to) {
+			s.outOfRange = true
+			continue
+		}
+
+		s.last++
+		s.emails[s.last] = email
+		uids = append(uids, s.last)
+	}
+
+	return uids, nil
+}
+
+// search returns the created emails if the state of the last run is still
+// valid and queries the date range otherwise
+func (s *jmapSource) search(ctx context.Context, from, to time.Time) ([]string, error) {
+	if s.mailList != nil {
+		if state := s.mailList.syncState(); state != "" {
+			ids, next, err := s.changes(ctx, state)
+			var methodErr *jmapMethodError
+			if err == nil {
+				s.nextState = next
+				return ids, nil
+			}
+			if !errors.As(err, &methodErr) || methodErr.Type != "cannotCalculateChanges" {
+				return nil, err
+			}
+		}
+	}
+
+	// The state is taken first, so emails arriving during the query come up again
+	state, err := s.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.nextState = state
+
+	return s.query(ctx, from, to)
+}
+
+// Fetch downloads the emails, the new state is stored by Commit
+func (s *jmapSource) Fetch(ctx context.Context, uids []uint32, mailsChan chan *mail) error {
+	for _, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		email, ok := s.emails[uid]
+		if !ok {
+			mailsChan <- &mail{Uid: uid, Error: &MessageError{Uid: uid, Op: "read body", Err: errors.New("unknown uid")}}
+			continue
+		}
+
+		mail := &mail{Uid: uid, RemoteID: email.ID, InternalDate: email.ReceivedAt, Delimiter: "/"}
+		mail.Mailbox = s.mailboxName(email)
+		mail.Flags = make([]string, 0)
+		for keyword, set := range email.Keywords {
+			if flag, ok := jmapKeywords[keyword]; ok && set {
+				mail.Flags = append(mail.Flags, flag)
+			}
+		}
+		sort.Strings(mail.Flags)
+
+		raw, err := s.download(ctx, email.BlobID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			mail.Error = &MessageError{Uid: uid, Op: "download", Err: err}
+			mailsChan <- mail
+			continue
+		}
+
+		mail.load(raw)
+		mailsChan <- mail
+	}
+
+	return nil
+}
+
+// Commit stores the new state once every email found by Search was processed
+// and none was left out because of its date.
+// Otherwise the previous state is kept and the next run looks at the same
+// changes again, the known emails among them are skipped.
+func (s *jmapSource) Commit(ctx context.Context, mailList *mailList) error {
+	if s.nextState == "" || s.outOfRange {
+		return nil
+	}
+
+	handled := mailList.handled("")
+	for uid := range s.emails {
+		if _, ok := handled[uid]; !ok {
+			return nil
+		}
+	}
+
+	return mailList.setSyncState(ctx, s.nextState)
+}
+
+// mailboxName returns the first mailbox of the email by name
+func (s *jmapSource) mailboxName(email *jmapEmail) string {
+	names := make([]string, 0, len(email.MailboxIDs))
+	for id, set := range email.MailboxIDs {
+		if set {
+			names = append(names, s.names[id])
+		}
+	}
+
+	if len(names) == 0 {
+		return "INBOX"
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
+
+// Retry looks up the failed mails by their email id
+func (s *jmapSource) Retry(ctx context.Context, mailbox string, failures []failedMail) ([]uint32, error) {
+	ids := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		if failure.RemoteID != "" {
+			ids = append(ids, failure.RemoteID)
+		}
+	}
+
+	emails, err := s.jmap.emails(ctx, ids)
+	if err != nil {
+		return nil, &ConnectionError{Op: "get", Err: err}
+	}
+
+	byID := make(map[string]*jmapEmail, len(emails))
+	for _, email := range emails {
+		byID[email.ID] = email
+	}
+
+	uids := make([]uint32, 0, len(failures))
+	for _, failure := range failures {
+		email, ok := byID[failure.RemoteID]
+		if !ok {
+			continue
+		}
+
+		s.emails[failure.Uid] = email
+		uids = append(uids, failure.Uid)
+	}
+
+	return uids, nil
+}
+
+func (s *jmapSource) Close() error {
+	return nil
+}
+
+func (s *jmapSource) Vendor() string {
+	return "jmap"
+}
+
+func (s *jmapSource) Server() string {
+	return s.SessionURL
+}
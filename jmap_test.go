@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+// jmapQueryLimit is lower than jmapPageSize, like servers which cap the limit
+const jmapQueryLimit = 2
+
+// jmapServer is a JMAP stub with one account. Its state is the number of emails.
+type jmapServer struct {
+	mutex  sync.Mutex
+	emails []*jmapEmail
+	blobs  map[string]string
+}
+
+func (s *jmapServer) add(id string, receivedAt time.Time, keywords map[string]bool, raw string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.emails = append(s.emails, &jmapEmail{
+		ID: id, BlobID: "blob-" + id, ReceivedAt: receivedAt, MailboxIDs: map[string]bool{"m2": true}, Keywords: keywords,
+	})
+	s.blobs["blob-"+id] = raw
+}
+
+func (s *jmapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/session":
+		json.NewEncoder(w).Encode(map[string]any{
+			"apiUrl":          "/api",
+			"downloadUrl":     "/download/{accountId}/{blobId}/{name}?type={type}",
+			"primaryAccounts": map[string]string{jmapMail: "acc"},
+		})
+	case strings.HasPrefix(r.URL.Path, "/download/acc/"):
+		blob, ok := s.blobs[strings.Split(r.URL.Path, "/")[3]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(blob))
+	case r.URL.Path == "/api":
+		var request struct {
+			MethodCalls []jmapInvocation `json:"methodCalls"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		call := request.MethodCalls[0]
+		var args map[string]any
+		json.Unmarshal(call.Args.(json.RawMessage), &args)
+
+		name, result := call.Name, s.method(call.Name, args)
+		if _, ok := result["type"]; ok {
+			name = "error"
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"methodResponses": []jmapInvocation{{Name: name, Args: result, ID: call.ID}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *jmapServer) method(name string, args map[string]any) map[string]any {
+	state := strconv.Itoa(len(s.emails))
+	switch name {
+	case "Mailbox/get":
+		return map[string]any{"list": []jmapMailbox{{ID: "m1", Name: "Archive"}, {ID: "m2", Name: "2024", ParentID: "m1"}}}
+	case "Email/get":
+		list := make([]*jmapEmail, 0)
+		for _, id := range args["ids"].([]any) {
+			for _, email := range s.emails {
+				if email.ID == id {
+					list = append(list, email)
+				}
+			}
+		}
+		return map[string]any{"state": state, "list": list}
+	case "Email/query":
+		filter := args["filter"].(map[string]any)
+		after, _ := time.Parse(time.RFC3339, filter["after"].(string))
+		before, _ := time.Parse(time.RFC3339, filter["before"].(string))
+		ids := make([]string, 0)
+		for _, email := range s.emails {
+			if !email.ReceivedAt.Before(after) && email.ReceivedAt.Before(before) {
+				ids = append(ids, email.ID)
+			}
+		}
+		position := min(int(args["position"].(float64)), len(ids))
+		return map[string]any{"ids": ids[position:min(position+jmapQueryLimit, len(ids))], "total": len(ids)}
+	case "Email/changes":
+		since, err := strconv.Atoi(args["sinceState"].(string))
+		if err != nil || since > len(s.emails) {
+			return map[string]any{"type": "cannotCalculateChanges"}
+		}
+		created := make([]string, 0)
+		for _, email := range s.emails[since:] {
+			created = append(created, email.ID)
+		}
+		return map[string]any{"newState": state, "hasMoreChanges": false, "created": created}
+	default:
+		return map[string]any{"type": "unknownMethod"}
+	}
+}
+
+func fetchJmap(t *testing.T, config *Config, mailList *mailList, from, to time.Time) []*mail {
+	ctx := context.Background()
+	source := newJmapSource(config)
+	assert.NoError(t, source.Open(ctx))
+	source.Track(mailList)
+
+	uids, err := source.Search(ctx, from, to)
+	assert.NoError(t, err)
+
+	mailsChan := make(chan *mail, len(uids))
+	assert.NoError(t, source.Fetch(ctx, uids, mailsChan))
+	close(mailsChan)
+
+	mails := make([]*mail, 0)
+	for mail := range mailsChan {
+		if mail.Error != nil {
+			assert.NoError(t, mailList.addFailure(ctx, mail, mail.Error, ""))
+			continue
+		}
+		assert.NoError(t, mailList.addMail(ctx, mail))
+		mails = append(mails, mail)
+	}
+
+	assert.NoError(t, source.Commit(ctx, mailList))
+	return mails
+}
+
+func TestJmapSource(t *testing.T) {
+	stub := &jmapServer{blobs: make(map[string]string)}
+	stub.add("e1", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), map[string]bool{"$seen": true, "$flagged": true},
+		"From: shop@example.com\r\nSubject: Invoice\r\n\r\nTotal\r\n")
+	stub.add("e2", time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC), nil, "Subject: Old\r\n\r\nold\r\n")
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	config := new(Config)
+	config.Jmap.Session = server.URL + "/session"
+	config.Jmap.Token = "token"
+
+	mailList, err := newMailList(newLocalStorage(t.TempDir()), "user", "jmap", config.Jmap.Session, "mail/user")
+	assert.NoError(t, err)
+
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	mails := fetchJmap(t, config, mailList, from, to)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, uint32(1), mails[0].Uid)
+	assert.Equal(t, "e1", mails[0].RemoteID)
+	assert.Equal(t, "Archive/2024", mails[0].Mailbox)
+	assert.Equal(t, "Invoice", mails[0].Subject)
+	assert.Equal(t, []string{i.FlaggedFlag, i.SeenFlag}, mails[0].Flags)
+	assert.Equal(t, "2", mailList.syncState())
+
+	// Only created emails are fetched with the stored state
+	stub.add("e3", time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC), nil, "Subject: New\r\n\r\nnew\r\n")
+	mails = fetchJmap(t, config, mailList, from, to)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, uint32(2), mails[0].Uid)
+	assert.Equal(t, "e3", mails[0].RemoteID)
+	assert.Equal(t, "3", mailList.syncState())
+
+	// An invalid state falls back to a query which skips known emails
+	assert.NoError(t, mailList.setSyncState(context.Background(), "99"))
+	stub.add("e4", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), nil, "Subject: Newer\r\n\r\nnewer\r\n")
+	mails = fetchJmap(t, config, mailList, from, to)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, "e4", mails[0].RemoteID)
+	assert.Equal(t, "4", mailList.syncState())
+
+	// The state isn't moved past emails which couldn't be downloaded
+	stub.add("e5", time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC), nil, "")
+	delete(stub.blobs, "blob-e5")
+	stub.add("e6", time.Date(2024, 6, 2, 10, 0, 0, 0, time.UTC), nil, "Subject: Newest\r\n\r\nnewest\r\n")
+	mails = fetchJmap(t, config, mailList, from, to)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, "e6", mails[0].RemoteID)
+	assert.Equal(t, "4", mailList.syncState())
+	assert.Len(t, mailList.failures(), 1)
+
+	// Queries read every page when the server returns less than requested
+	source := newJmapSource(config)
+	assert.NoError(t, source.Open(context.Background()))
+	ids, err := source.query(context.Background(), from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e1", "e3", "e4", "e5", "e6"}, ids)
+
+	config.Jmap.Token = "wrong"
+	assert.Error(t, newJmapSource(config).Open(context.Background()))
+}
+
+func TestJmapSourceRanges(t *testing.T) {
+	stub := &jmapServer{blobs: make(map[string]string)}
+	stub.add("e1", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), nil, "Subject: Invoice\r\n\r\nTotal\r\n")
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	config := new(Config)
+	config.Jmap.Session = server.URL + "/session"
+	config.Jmap.Token = "token"
+
+	mailList, err := newMailList(newLocalStorage(t.TempDir()), "user", "jmap", config.Jmap.Session, "mail/user")
+	assert.NoError(t, err)
+
+	year2024 := []time.Time{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	year2023 := []time.Time{time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	mails := fetchJmap(t, config, mailList, year2024[0], year2024[1])
+	assert.Len(t, mails, 1)
+	assert.Equal(t, "1", mailList.syncState())
+
+	// An email created with an older date is left out, so the state stays
+	stub.add("e2", time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC), nil, "Subject: Imported\r\n\r\nold\r\n")
+	mails = fetchJmap(t, config, mailList, year2024[0], year2024[1])
+	assert.Empty(t, mails)
+	assert.Equal(t, "1", mailList.syncState())
+
+	// A later run over its dates still finds it
+	mails = fetchJmap(t, config, mailList, year2023[0], year2023[1])
+	assert.Len(t, mails, 1)
+	assert.Equal(t, "e2", mails[0].RemoteID)
+	assert.Equal(t, "2", mailList.syncState())
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// localMail locates a mail of a local source. Key identifies it across runs
+// and is recorded as remote id.
+type localMail struct {
+	Key       string
+	Mailbox   string
+	Delimiter string
+	Date      time.Time
+	Flags     []string
+	read      func() ([]byte, error)
+}
+
+// localSource reads Maildir, mbox and .eml files. Mails keep the uid they got
+// in the metadata when they were first seen, new ones are numbered after the
+// highest uid in use.
+type localSource struct {
+	vendor string
+	path   string
+	list   func(path string) ([]*localMail, error)
+	mails  map[string]*localMail
+	order  []*localMail
+	known  map[string]uint32
+	last   uint32
+	uids   map[uint32]*localMail
+}
+
+func newLocalSource(vendor, path string, list func(path string) ([]*localMail, error)) *localSource {
+	return &localSource{vendor: vendor, path: path, list: list, known: make(map[string]uint32), uids: make(map[uint32]*localMail)}
+}
+
+func (s *localSource) Open(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	mails, err := s.list(s.path)
+	if err != nil {
+		return &ConnectionError{Op: "read " + s.vendor, Err: err}
+	}
+
+	// Copies of the same mail share a key, only the first one is read
+	s.mails = make(map[string]*localMail, len(mails))
+	s.order = make([]*localMail, 0, len(mails))
+	for _, local := range mails {
+		if _, ok := s.mails[local.Key]; ok {
+			continue
+		}
+		s.mails[local.Key] = local
+		s.order = append(s.order, local)
+	}
+
+	return nil
+}
+
+func (s *localSource) Track(mailList *mailList) {
+	s.known, s.last = mailList.remoteIDs()
+}
+
+// Search matches the dates like IMAP SINCE and BEFORE, mails without date are skipped
+func (s *localSource) Search(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uids := make([]uint32, 0)
+	for _, local := range s.order {
+		if local.Date.IsZero() || local.Date.Before(from) || !local.Date.Before(to) {
+			continue
+		}
+
+		uid, ok := s.known[local.Key]
+		if !ok {
+			s.last++
+			uid = s.last
+			s.known[local.Key] = uid
+		}
+
+		s.uids[uid] = local
+		uids = append(uids, uid)
+	}
+
+	return uids, nil
+}
+
+func (s *localSource) Fetch(ctx context.Context, uids []uint32, mailsChan chan *mail) error {
+	for _, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		mailsChan <- s.readMail(uid)
+	}
+
+	return nil
+}
+
+// Retry returns the uids of the failed mails which are still in the listing
+func (s *localSource) Retry(ctx context.Context, mailbox string, failures []failedMail) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uids := make([]uint32, 0, len(failures))
+	for _, failure := range failures {
+		if local, ok := s.mails[failure.RemoteID]; ok && local.Mailbox == mailbox {
+			s.uids[failure.Uid] = local
+			uids = append(uids, failure.Uid)
+		}
+	}
+
+	return uids, nil
+}
+
+func (s *localSource) Close() error {
+	return nil
+}
+
+func (s *localSource) Vendor() string {
+	return s.vendor
+}
+
+func (s *localSource) Server() string {
+	return s.path
+}
+
+// readMail reads and parses a mail. Failures are recorded as MessageError in mail.Error.
+func (s *localSource) readMail(uid uint32) *mail {
+	mail := &mail{Uid: uid}
+	local, ok := s.uids[uid]
+	if !ok {
+		mail.Error = &MessageError{Uid: uid, Op: "read body", Err: errors.New("unknown uid")}
+		return mail
+	}
+
+	mail.RemoteID = local.Key
+	mail.Mailbox = local.Mailbox
+	mail.Delimiter = local.Delimiter
+	mail.Flags = local.Flags
+	mail.InternalDate = local.Date
+
+	raw, err := local.read()
+	if err != nil {
+		mail.Error = &MessageError{Uid: uid, Op: "read body", Err: err}
+		return mail
+	}
+
+	mail.load(raw)
+	return mail
+}
+
+// load parses the raw source of a mail which wasn't fetched from IMAP.
+// Failures are recorded as MessageError in mail.Error.
+func (mail *mail) load(raw []byte) {
+	mail.Raw = raw
+
+	if err := mail.parseHeader(raw); err != nil {
+		mail.Error = &MessageError{Uid: mail.Uid, Op: "parse header", Err: err}
+		return
+	}
+
+	if err := mail.parse(raw); err != nil {
+		mail.Error = &MessageError{Uid: mail.Uid, Op: "parse", Err: err}
+	}
+}
+
+// parseHeader sets the fields IMAP takes from the envelope and body structure
+func (mail *mail) parseHeader(raw []byte) error {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return err
+	}
+
+	h := gomail.Header{Header: message.Header{Header: header}}
+
+	// Undecodable subjects are kept as they are
+	mail.Subject, _ = h.Subject()
+	if mail.Subject == "" {
+		mail.Subject = h.Get("Subject")
+	}
+
+	mail.MessageID = strings.TrimSpace(h.Get("Message-Id"))
+	mail.Date, _ = h.Date()
+	mail.From = envelopeAddresses(h, "From")
+	mail.To = envelopeAddresses(h, "To")
+	mail.Cc = envelopeAddresses(h, "Cc")
+
+	mail.MimeType = "text/plain"
+	if mediaType, _, err := h.ContentType(); err == nil && mediaType != "" {
+		mail.MimeType = mediaType
+	}
+
+	return nil
+}
+
+func envelopeAddresses(h gomail.Header, key string) []*i.Address {
+	list, _ := h.AddressList(key)
+	if len(list) == 0 {
+		return nil
+	}
+
+	addresses := make([]*i.Address, len(list))
+	for n, address := range list {
+		mailbox, host, _ := strings.Cut(address.Address, "@")
+		addresses[n] = &i.Address{PersonalName: address.Name, MailboxName: mailbox, HostName: host}
+	}
+
+	return addresses
+}
+
+// listMaildir reads a Maildir and its folders, either nested directories or
+// Maildir++ folders like ".Archive.2024"
+func listMaildir(root string) ([]*localMail, error) {
+	mails := make([]*localMail, 0)
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			return nil
+		}
+
+		switch entry.Name() {
+		case "cur", "new", "tmp":
+			return filepath.SkipDir
+		}
+
+		if info, err := os.Stat(filepath.Join(path, "cur")); err != nil || !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		mailbox, delimiter := filepath.ToSlash(rel), "/"
+		if rel == "." {
+			mailbox = "INBOX"
+		} else if strings.HasPrefix(rel, ".") && !strings.ContainsRune(rel, filepath.Separator) {
+			mailbox, delimiter = rel[1:], "."
+		}
+
+		folder, err := readMaildirFolder(path, mailbox, delimiter)
+		if err != nil {
+			return err
+		}
+
+		mails = append(mails, folder...)
+		return nil
+	})
+
+	return mails, err
+}
+
+func readMaildirFolder(dir, mailbox, delimiter string) ([]*localMail, error) {
+	files := make([]string, 0)
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, entry.Name()))
+			}
+		}
+	}
+
+	// Unique names start with the delivery time
+	sort.Slice(files, func(a, b int) bool {
+		return filepath.Base(files[a]) < filepath.Base(files[b])
+	})
+
+	mails := make([]*localMail, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		flags := make([]string, 0)
+		if _, infoFlags, ok := strings.Cut(filepath.Base(file), ":2,"); ok {
+			for _, flag := range maildirFlags {
+				if strings.IndexByte(infoFlags, flag.info) >= 0 {
+					flags = append(flags, flag.imap)
+				}
+			}
+		}
+
+		// The unique name stays when the flags after ":" change or the
+		// mail moves from new to cur
+		unique, _, _ := strings.Cut(filepath.Base(file), ":")
+
+		path := file
+		mails = append(mails, &localMail{
+			Key:       mailbox + "/" + unique,
+			Mailbox:   mailbox,
+			Delimiter: delimiter,
+			Date:      info.ModTime(),
+			Flags:     flags,
+			read:      func() ([]byte, error) { return os.ReadFile(path) },
+		})
+	}
+
+	return mails, nil
+}
+
+// listMbox reads a single mbox file or all .mbox files below a directory
+func listMbox(root string) ([]*localMail, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return scanMbox(root, strings.TrimSuffix(filepath.Base(root), filepath.Ext(root)), "")
+	}
+
+	mails := make([]*localMail, 0)
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".mbox" {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, ".mbox"))
+		if err != nil {
+			return err
+		}
+
+		folder, err := scanMbox(path, filepath.ToSlash(rel), "/")
+		if err != nil {
+			return err
+		}
+
+		mails = append(mails, folder...)
+		return nil
+	})
+
+	return mails, err
+}
+
+// mboxDateLayouts are the dates found in "From " lines
+var mboxDateLayouts = []string{time.ANSIC, "Mon Jan _2 15:04:05 -0700 2006", time.UnixDate}
+
+// mboxStatusHeaders are rewritten by mail clients and left out of the key
+var mboxStatusHeaders = map[string]bool{"status": true, "x-status": true, "x-mozilla-status": true, "x-mozilla-status2": true}
+
+// scanMbox indexes the mails of an mbox file by their offsets, flags are
+// taken from the Status and X-Status headers. The key of a mail is a hash of
+// its lines without status headers and trailing blank lines, so it stays the
+// same when flags change or mails are appended.
+func scanMbox(path, mailbox, delimiter string) ([]*localMail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mails := make([]*localMail, 0)
+	var current *localMail
+	var start, offset int64
+	hash, blanks := sha256.New(), 0
+	finish := func(end int64) {
+		if current == nil {
+			return
+		}
+		from, to := start, end
+		current.Key = mailbox + "/" + hex.EncodeToString(hash.Sum(nil))
+		current.read = func() ([]byte, error) { return readMbox(path, from, to) }
+		mails = append(mails, current)
+	}
+
+	reader := bufio.NewReader(file)
+	blank, header := true, false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		hashed := true
+		switch {
+		case blank && strings.HasPrefix(text, "From "):
+			finish(offset)
+			current = &localMail{Mailbox: mailbox, Delimiter: delimiter, Date: mboxDate(text), Flags: make([]string, 0)}
+			start = offset + int64(len(line))
+			header = true
+			hash.Reset()
+			blanks, hashed = 0, false
+		case current != nil && header:
+			name, value, _ := strings.Cut(text, ":")
+			hashed = !mboxStatusHeaders[strings.ToLower(name)]
+			switch strings.ToLower(name) {
+			case "":
+				header = false
+			case "date":
+				if current.Date.IsZero() {
+					current.Date, _ = netmail.ParseDate(strings.TrimSpace(value))
+				}
+			case "status":
+				if strings.Contains(value, "R") {
+					current.Flags = append(current.Flags, i.SeenFlag)
+				}
+			case "x-status":
+				for _, flag := range []struct{ status, imap string }{
+					{"A", i.AnsweredFlag}, {"F", i.FlaggedFlag}, {"D", i.DeletedFlag}, {"T", i.DraftFlag},
+				} {
+					if strings.Contains(value, flag.status) {
+						current.Flags = append(current.Flags, flag.imap)
+					}
+				}
+			}
+		}
+
+		// Blank lines are hashed once another line follows
+		if hashed && text == "" {
+			blanks++
+		} else if hashed {
+			for ; blanks > 0; blanks-- {
+				hash.Write([]byte("\n"))
+			}
+			hash.Write([]byte(text + "\n"))
+		}
+
+		blank = text == ""
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+
+	finish(offset)
+	return mails, nil
+}
+
+func mboxDate(line string) time.Time {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+
+	for _, layout := range mboxDateLayouts {
+		if date, err := time.Parse(layout, strings.TrimSpace(fields[2])); err == nil {
+			return date
+		}
+	}
+
+	return time.Time{}
+}
+
+// mboxrdEscaped matches "From " lines escaped by mboxrd
+var mboxrdEscaped = regexp.MustCompile(`(?m)^>(>*From )`)
+
+// readMbox reads the mail between start and end without the separating blank line
+func readMbox(path string, start, end int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw := make([]byte, end-start)
+	if _, err := file.ReadAt(raw, start); err != nil {
+		return nil, fmt.Errorf("failed to read mbox: %w", err)
+	}
+
+	if bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+		raw = raw[:len(raw)-2]
+	} else if bytes.HasSuffix(raw, []byte("\n\n")) {
+		raw = raw[:len(raw)-1]
+	}
+
+	return mboxrdEscaped.ReplaceAll(raw, []byte("$1")), nil
+}
+
+// listEml reads all .eml files below root, folders become mailboxes
+func listEml(root string) ([]*localMail, error) {
+	mails := make([]*localMail, 0)
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.EqualFold(filepath.Ext(path), ".eml") {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		mailbox := filepath.ToSlash(rel)
+		if rel == "." {
+			mailbox = "INBOX"
+		}
+
+		key, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		date, err := emlDate(path)
+		if err != nil {
+			return err
+		}
+
+		mails = append(mails, &localMail{
+			Key:       filepath.ToSlash(key),
+			Mailbox:   mailbox,
+			Delimiter: "/",
+			Date:      date,
+			Flags:     make([]string, 0),
+			read:      func() ([]byte, error) { return os.ReadFile(path) },
+		})
+		return nil
+	})
+
+	return mails, err
+}
+
+// emlDate returns the Date header of the file, or its modification time
+func emlDate(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	if date := headerDate(file); !date.IsZero() {
+		return date, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// headerDate returns the Date header of a mail, or the zero time
+func headerDate(r io.Reader) time.Time {
+	header, err := textproto.ReadHeader(bufio.NewReader(r))
+	if err != nil {
+		return time.Time{}
+	}
+
+	h := gomail.Header{Header: message.Header{Header: header}}
+	date, _ := h.Date()
+	return date
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func fetchLocal(t *testing.T, source *localSource, mailList *mailList, from, to time.Time) []*mail {
+	assert.NoError(t, source.Open(context.Background()))
+	defer source.Close()
+
+	if mailList != nil {
+		source.Track(mailList)
+	}
+
+	uids, err := source.Search(context.Background(), from, to)
+	assert.NoError(t, err)
+
+	mailsChan := make(chan *mail, len(uids))
+	assert.NoError(t, source.Fetch(context.Background(), uids, mailsChan))
+	close(mailsChan)
+
+	mails := make([]*mail, 0)
+	for mail := range mailsChan {
+		assert.NoError(t, mail.Error)
+		mails = append(mails, mail)
+		if mailList != nil {
+			assert.NoError(t, mailList.addMail(context.Background(), mail))
+		}
+	}
+	return mails
+}
+
+func TestLocalSources(t *testing.T) {
+	config := new(Config)
+	config.Export.Maildir = filepath.Join(t.TempDir(), "maildir")
+	config.Export.Mbox = filepath.Join(t.TempDir(), "mbox")
+	config.Export.All = true
+
+	// Sources read what the export handlers write
+	exported := exportMail()
+	for _, h := range []MailHandler{NewMaildirHandler(), NewMboxHandler()} {
+		assert.NoError(t, h.Handle(context.Background(), config, exported))
+		assert.NoError(t, h.Handle(context.Background(), config, &mail{
+			Uid: 1, Mailbox: "INBOX", InternalDate: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Raw: []byte("Subject: old\n\nold\n"),
+		}))
+	}
+
+	from, to := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, source := range []*localSource{
+		newLocalSource("maildir", config.Export.Maildir, listMaildir),
+		newLocalSource("mbox", config.Export.Mbox, listMbox),
+	} {
+		mails := fetchLocal(t, source, nil, from, to)
+		assert.Len(t, mails, 1, source.Vendor())
+
+		mail := mails[0]
+		assert.Equal(t, "Archive/2024", mail.Mailbox)
+		assert.Equal(t, "Invoice 42", mail.Subject)
+		assert.Equal(t, "example.com", mail.From[0].HostName)
+		assert.ElementsMatch(t, []string{i.SeenFlag, i.FlaggedFlag}, mail.Flags)
+		assert.True(t, exported.InternalDate.Equal(mail.InternalDate))
+		assert.Contains(t, string(mail.Raw), ">From quoted")
+		assert.NotContains(t, string(mail.Raw), ">>From quoted")
+	}
+}
+
+func TestEmlSource(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Invoices"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Invoices", "a.eml"), []byte("From: Shop <shop@example.com>\r\n"+
+		"Subject: =?utf-8?q?Rechnung_f=C3=BCr_M=C3=A4rz?=\r\nDate: Fri, 01 Mar 2024 10:00:00 +0000\r\n"+
+		"Message-Id: <1@example.com>\r\nContent-Type: text/html\r\n\r\n<p>Hi</p>\r\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("no mail"), 0o644))
+
+	mails := fetchLocal(t, newLocalSource("eml", dir, listEml), nil, time.Time{}, time.Now())
+	assert.Len(t, mails, 1)
+	assert.Equal(t, uint32(1), mails[0].Uid)
+	assert.Equal(t, "Invoices/a.eml", mails[0].RemoteID)
+	assert.Equal(t, "Invoices", mails[0].Mailbox)
+	assert.Equal(t, "Rechnung für März", mails[0].Subject)
+	assert.Equal(t, "<1@example.com>", mails[0].MessageID)
+	assert.Equal(t, "Shop", mails[0].From[0].PersonalName)
+	assert.Equal(t, "text/html", mails[0].MimeType)
+	assert.Len(t, mails[0].Body, 1)
+
+	// Mails without a From header, or an unparsable one, are stored below an unknown host
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "no-from.eml"), []byte("Subject: Note\r\n\r\nnote\r\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "bad-from.eml"), []byte("From: undisclosed\r\nSubject: Note\r\n\r\nnote\r\n"), 0o644))
+	mails = fetchLocal(t, newLocalSource("eml", dir, listEml), nil, time.Time{}, time.Now().Add(time.Hour))
+	assert.Len(t, mails, 3)
+
+	storage := newLocalStorage(t.TempDir())
+	for _, mail := range mails[1:] {
+		assert.Equal(t, "INBOX", mail.Mailbox)
+		assert.Empty(t, mail.From)
+		assert.Equal(t, "mail/user/"+mail.Date.Format("200601")+"/unknown", mail.getDirectoryName("mail", "user"))
+		assert.NoError(t, NewEMLHandler("user", storage).Handle(context.Background(), new(Config), mail))
+	}
+
+	config := new(Config)
+	config.Imap.Username = "user@example.com"
+	config.Source.Type = "eml"
+	config.Source.Path = dir + "/"
+	assert.Equal(t, "eml/"+filepath.Base(dir), config.account())
+
+	config.Source.Type = "unknown"
+	_, err := newSource(config)
+	assert.Error(t, err)
+}
+
+func TestNewHandlers(t *testing.T) {
+	config := new(Config)
+	storage := newLocalStorage(t.TempDir())
+
+	handlers, err := newHandlers(config, storage, nil)
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 3)
+	for _, handler := range handlers {
+		_, eml := handler.(*EMLHandler)
+		assert.False(t, eml)
+	}
+
+	// The original source is only saved if enabled
+	config.Mails.SaveEml = true
+	handlers, err = newHandlers(config, storage, nil)
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 4)
+	assert.IsType(t, new(EMLHandler), handlers[3])
+}
+
+func TestLocalSourceKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), os.ModePerm))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	from, to := time.Time{}, time.Now().Add(time.Hour)
+	uidsOf := func(mails []*mail) map[string]uint32 {
+		uids := make(map[string]uint32)
+		for _, mail := range mails {
+			uids[mail.Subject] = mail.Uid
+		}
+		return uids
+	}
+
+	// Maildir mails keep their uid when they are flagged and moved to cur
+	write("maildir/new/2.host", "Subject: b\n\nb\n")
+	write("maildir/cur/3.host:2,", "Subject: c\n\nc\n")
+
+	mailList, err := newMailList(newLocalStorage(t.TempDir()), "maildir/maildir", "maildir", dir, "mail/maildir/maildir")
+	assert.NoError(t, err)
+
+	mails := fetchLocal(t, newLocalSource("maildir", filepath.Join(dir, "maildir"), listMaildir), mailList, from, to)
+	assert.Equal(t, map[string]uint32{"b": 1, "c": 2}, uidsOf(mails))
+	assert.Equal(t, "INBOX/2.host", mails[0].RemoteID)
+
+	assert.NoError(t, os.Rename(filepath.Join(dir, "maildir/new/2.host"), filepath.Join(dir, "maildir/cur/2.host:2,S")))
+	write("maildir/cur/1.host:2,", "Subject: a\n\na\n")
+
+	mails = fetchLocal(t, newLocalSource("maildir", filepath.Join(dir, "maildir"), listMaildir), mailList, from, to)
+	assert.Equal(t, map[string]uint32{"a": 3, "b": 1, "c": 2}, uidsOf(mails))
+
+	// mbox mails keep their uid when their status changes or mails are added
+	// in front of them
+	mbox := "From a@example.com Fri Mar  1 10:00:00 2024\nSubject: b\n\nb\n"
+	write("inbox.mbox", mbox+"\nFrom a@example.com Fri Mar  1 10:00:00 2024\nSubject: c\n\nc\n")
+
+	mailList, err = newMailList(newLocalStorage(t.TempDir()), "mbox/inbox.mbox", "mbox", dir, "mail/mbox/inbox.mbox")
+	assert.NoError(t, err)
+
+	mails = fetchLocal(t, newLocalSource("mbox", filepath.Join(dir, "inbox.mbox"), listMbox), mailList, from, to)
+	assert.Equal(t, map[string]uint32{"b": 1, "c": 2}, uidsOf(mails))
+
+	write("inbox.mbox", "From a@example.com Fri Mar  1 10:00:00 2024\nSubject: a\n\na\n\n"+
+		"From a@example.com Fri Mar  1 10:00:00 2024\nSubject: b\nStatus: RO\n\nb\n\n"+
+		"From a@example.com Fri Mar  1 10:00:00 2024\nSubject: c\n\nc\n\n"+
+		"From a@example.com Fri Mar  1 10:00:00 2024\nSubject: c\n\nc\n")
+
+	mails = fetchLocal(t, newLocalSource("mbox", filepath.Join(dir, "inbox.mbox"), listMbox), mailList, from, to)
+	assert.Len(t, mails, 3)
+	assert.Equal(t, map[string]uint32{"a": 3, "b": 1, "c": 2}, uidsOf(mails))
+	assert.Equal(t, []string{i.SeenFlag}, mails[1].Flags)
+
+	// Failed mails are retried by their key
+	source := newLocalSource("mbox", filepath.Join(dir, "inbox.mbox"), listMbox)
+	assert.NoError(t, source.Open(context.Background()))
+	uids, err := source.Retry(context.Background(), "inbox", []failedMail{
+		{Uid: 2, Mailbox: "inbox", RemoteID: mails[2].RemoteID},
+		{Uid: 7, Mailbox: "inbox", RemoteID: "inbox/gone"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{2}, uids)
+	assert.Equal(t, "c", source.readMail(2).Subject)
+}
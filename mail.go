@@ -2,27 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"path"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/SebastiaanKlippert/go-wkhtmltopdf"
 	i "github.com/emersion/go-imap"
-	m "github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message"
 	"github.com/gabriel-vasile/mimetype"
-	"github.com/loeffel-io/mail-downloader/counter"
 )
 
 type mail struct {
 	Uid                uint32
+	Mailbox            string
+	Delimiter          string
 	MessageID          string
 	Subject            string
 	From               []*i.Address
+	To                 []*i.Address
+	Cc                 []*i.Address
 	Date               time.Time
 	Body               [][]byte
 	Attachments        []*attachment
@@ -30,17 +33,46 @@ type mail struct {
 	MultipartMimeType  []string
 	AttachmentMimeType []string
 	Error              error
+	PartErrors         []*PartError
+	Parts              []*mimePart
+	Raw                []byte
+	PdfParts           []pdfPart
+	Flags              []string
+	InternalDate       time.Time
+	// RemoteID identifies mails of sources without numeric uids, e.g. the POP3 UIDL
+	RemoteID string
+	Labels   []string
+	// Directory is an optional level below the account, e.g. the Gmail label
+	Directory string
+	// Saved lists the attachments and PDFs written by the handlers
+	Saved     []*savedFile
+	Paperless []paperlessTask
+
+	archives *expandedArchives
+}
+
+// savedFile is an attachment or PDF written to the storage
+type savedFile struct {
+	Path  string
+	Title string
+	Body  []byte
+	// Origin is set for files extracted from archives
+	Origin string
 }
 
 type attachment struct {
 	Filename string
 	Body     []byte
 	Mimetype string
+	Path     string
+	// Origin is set for files extracted from archives, e.g. "archive.zip!/invoice.pdf"
+	Origin string
 }
 
 // jsonMail is used for JSON serialization
 type jsonMail struct {
 	Uid                uint32    `json:"uid"`
+	Mailbox            string    `json:"mailbox,omitempty"`
 	MessageID          string    `json:"message_id"`
 	Subject            string    `json:"subject"`
 	From               []string  `json:"from"`
@@ -49,37 +81,63 @@ type jsonMail struct {
 	MimeType           string    `json:"mime_type"`
 	MultipartMimeType  []string  `json:"multipart_mime_type"`
 	AttachmentMimeType []string  `json:"attachment_mime_type"`
+	PdfParts           []pdfPart `json:"pdf_parts,omitempty"`
+	RemoteID           string    `json:"remote_id,omitempty"`
+	Labels             []string  `json:"labels,omitempty"`
+	// Deleted is set once the mail was expunged on the server
+	Deleted   bool            `json:"deleted,omitempty"`
+	Paperless []paperlessTask `json:"paperless,omitempty"`
+	// Warnings lists the parts which were skipped because they couldn't be read
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// failedMail is a message which couldn't be processed and waits for a retry
+type failedMail struct {
+	Uid         uint32    `json:"uid"`
+	Mailbox     string    `json:"mailbox"`
+	Subject     string    `json:"subject"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	RawPath     string    `json:"raw_path,omitempty"`
+	// RemoteID is needed to fetch mails of sources without numeric uids again
+	RemoteID string `json:"remote_id,omitempty"`
 }
 
+// mailListSaveInterval limits how often addMail writes the metadata to disk
+const mailListSaveInterval = 5 * time.Second
+
 // mailList represents the metadata for a user's email collection
 type mailList struct {
-	Email  string     `json:"email"`
-	List   []jsonMail `json:"list"`
-	Vendor string     `json:"vendor"`
-	Server string     `json:"server"`
-	mu     sync.Mutex `json:"-"`
-	path   string     `json:"-"`
+	Email    string       `json:"email"`
+	List     []jsonMail   `json:"list"`
+	Failures []failedMail `json:"failures"`
+	Vendor   string       `json:"vendor"`
+	Server   string       `json:"server"`
+	State    string       `json:"state,omitempty"`
+	mu       sync.Mutex   `json:"-"`
+	storage  Storage      `json:"-"`
+	path     string       `json:"-"`
+	dirty    bool         `json:"-"`
+	lastSave time.Time    `json:"-"`
 }
 
-// newMailList creates a new mailList or loads existing one
-func newMailList(email, vendor, server, mailDir string) (*mailList, error) {
+// newMailList creates a new mailList or loads existing one from storage
+func newMailList(storage Storage, email, vendor, server, mailDir string) (*mailList, error) {
 	ml := &mailList{
-		Email:  email,
-		List:   make([]jsonMail, 0),
-		Vendor: vendor,
-		Server: server,
-		path:   filepath.Join(mailDir, "data.json"),
-	}
-
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(ml.path), 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %w", err)
+		Email:    email,
+		List:     make([]jsonMail, 0),
+		Failures: make([]failedMail, 0),
+		Vendor:   vendor,
+		Server:   server,
+		storage:  storage,
+		path:     path.Join(mailDir, "data.json"),
 	}
 
 	// Try to load existing data
-	data, err := os.ReadFile(ml.path)
+	data, err := storage.Read(context.Background(), ml.path)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			// File doesn't exist yet, that's fine
 			return ml, nil
 		}
@@ -93,8 +151,9 @@ func newMailList(email, vendor, server, mailDir string) (*mailList, error) {
 	return ml, nil
 }
 
-// addMail adds a new mail to the list and saves the metadata
-func (ml *mailList) addMail(mail *mail) error {
+// addMail adds a new mail to the list. The metadata is saved at most every
+// mailListSaveInterval, or right away once ctx is cancelled.
+func (ml *mailList) addMail(ctx context.Context, mail *mail) error {
 	ml.mu.Lock()
 	defer ml.mu.Unlock()
 
@@ -110,38 +169,235 @@ func (ml *mailList) addMail(mail *mail) error {
 	}
 
 	// Check if mail already exists
+	found := false
 	for i, existing := range ml.List {
-		if existing.Uid == jm.Uid {
+		if existing.is(jm.Mailbox, jm.Uid) {
+			// Tasks are only set while processing, keep them when the mail is fetched again
+			if jm.Paperless == nil {
+				jm.Paperless = existing.Paperless
+			}
+
 			// Update existing entry
 			ml.List[i] = jm
-			return ml.save()
+			found = true
+			break
 		}
 	}
 
 	// Add new entry
-	ml.List = append(ml.List, jm)
+	if !found {
+		ml.List = append(ml.List, jm)
+	}
+
+	return ml.changed(ctx)
+}
+
+// is reports whether the entry is the mail with uid in mailbox. Entries
+// written before the mailbox was recorded match any mailbox.
+func (jm jsonMail) is(mailbox string, uid uint32) bool {
+	return jm.Uid == uid && (jm.Mailbox == mailbox || jm.Mailbox == "")
+}
+
+// remoteIDs returns the uids of the mails and failures in the list by their
+// remote id and the highest uid in use
+func (ml *mailList) remoteIDs() (map[string]uint32, uint32) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ids := make(map[string]uint32)
+	last := uint32(0)
+	for _, existing := range ml.List {
+		if existing.RemoteID != "" {
+			ids[existing.RemoteID] = existing.Uid
+		}
+		last = max(last, existing.Uid)
+	}
+
+	for _, failure := range ml.Failures {
+		if _, ok := ids[failure.RemoteID]; failure.RemoteID != "" && !ok {
+			ids[failure.RemoteID] = failure.Uid
+		}
+		last = max(last, failure.Uid)
+	}
+
+	return ids, last
+}
+
+// handled returns the remote ids of the processed mails of mailbox by uid.
+// Sources whose uids are unique across mailboxes pass an empty mailbox.
+func (ml *mailList) handled(mailbox string) map[uint32]string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ids := make(map[uint32]string, len(ml.List))
+	for _, existing := range ml.List {
+		if mailbox == "" || existing.Mailbox == mailbox {
+			ids[existing.Uid] = existing.RemoteID
+		}
+	}
+
+	return ids
+}
+
+// paperlessTasks returns the paperless-ngx tasks of the files of a mail
+func (ml *mailList) paperlessTasks(mailbox string, uid uint32) []paperlessTask {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for _, existing := range ml.List {
+		if existing.is(mailbox, uid) {
+			return append([]paperlessTask(nil), existing.Paperless...)
+		}
+	}
+
+	return nil
+}
+
+// uids returns the uids of the mails of mailbox which weren't deleted on the server
+func (ml *mailList) uids(mailbox string) []uint32 {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	uids := make([]uint32, 0, len(ml.List))
+	for _, existing := range ml.List {
+		if !existing.Deleted && existing.Mailbox == mailbox {
+			uids = append(uids, existing.Uid)
+		}
+	}
+
+	return uids
+}
+
+// markDeleted flags the mails of mailbox which were expunged on the server
+func (ml *mailList) markDeleted(ctx context.Context, mailbox string, deleted func(uid uint32) bool) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	marked := false
+	for i, existing := range ml.List {
+		if !existing.Deleted && existing.Mailbox == mailbox && deleted(existing.Uid) {
+			ml.List[i].Deleted = true
+			marked = true
+		}
+	}
+
+	if !marked {
+		return nil
+	}
+
+	return ml.changed(ctx)
+}
+
+// syncState returns the state of incremental sources
+func (ml *mailList) syncState() string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	return ml.State
+}
+
+// setSyncState stores the state of incremental sources
+func (ml *mailList) setSyncState(ctx context.Context, state string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	ml.State = state
+	return ml.changed(ctx)
+}
+
+// addFailure records a failed attempt to process mail
+func (ml *mailList) addFailure(ctx context.Context, mail *mail, err error, rawPath string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	failure := failedMail{
+		Uid:         mail.Uid,
+		Mailbox:     mail.Mailbox,
+		Subject:     mail.Subject,
+		Error:       err.Error(),
+		Attempts:    1,
+		LastAttempt: time.Now(),
+		RawPath:     rawPath,
+		RemoteID:    mail.RemoteID,
+	}
+
+	for i, existing := range ml.Failures {
+		if existing.Uid == mail.Uid && existing.Mailbox == mail.Mailbox {
+			failure.Attempts = existing.Attempts + 1
+			if failure.RawPath == "" {
+				failure.RawPath = existing.RawPath
+			}
+			ml.Failures[i] = failure
+			return ml.changed(ctx)
+		}
+	}
+
+	ml.Failures = append(ml.Failures, failure)
+	return ml.changed(ctx)
+}
+
+// removeFailure removes mail from the failures after it was processed successfully
+// and returns the removed entry
+func (ml *mailList) removeFailure(ctx context.Context, mail *mail) (*failedMail, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for i, existing := range ml.Failures {
+		if existing.Uid == mail.Uid && existing.Mailbox == mail.Mailbox {
+			ml.Failures = append(ml.Failures[:i], ml.Failures[i+1:]...)
+			return &existing, ml.changed(ctx)
+		}
+	}
+
+	return nil, nil
+}
+
+// failures returns a copy of all failed mails
+func (ml *mailList) failures() []failedMail {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	return append([]failedMail(nil), ml.Failures...)
+}
+
+// changed marks the metadata as modified and saves it at most every
+// mailListSaveInterval, or right away once ctx is cancelled
+func (ml *mailList) changed(ctx context.Context) error {
+	ml.dirty = true
+	if ctx.Err() == nil && time.Since(ml.lastSave) < mailListSaveInterval {
+		return nil
+	}
+
 	return ml.save()
 }
 
-// save writes the metadata to disk atomically
+// flush saves pending changes of the metadata
+func (ml *mailList) flush() error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if !ml.dirty {
+		return nil
+	}
+
+	return ml.save()
+}
+
+// save writes the metadata to the storage atomically. It isn't cancelled,
+// so the metadata is still saved when a run is interrupted.
 func (ml *mailList) save() error {
 	data, err := json.MarshalIndent(ml, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	// Write to temporary file first
-	tmpPath := ml.path + ".tmp"
-	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write temporary file: %w", err)
-	}
-
-	// Rename temporary file to actual file (atomic operation)
-	if err := os.Rename(tmpPath, ml.path); err != nil {
-		os.Remove(tmpPath) // Clean up temp file if rename fails
+	if err := ml.storage.Write(context.Background(), ml.path, data); err != nil {
 		return fmt.Errorf("failed to save metadata: %w", err)
 	}
 
+	ml.dirty = false
+	ml.lastSave = time.Now()
+
 	return nil
 }
 
@@ -150,148 +406,208 @@ func (mail *mail) fetchMeta(message *i.Message) {
 	mail.MessageID = message.Envelope.MessageId
 	mail.Subject = message.Envelope.Subject
 	mail.From = message.Envelope.From
+	mail.To = message.Envelope.To
+	mail.Cc = message.Envelope.Cc
 	mail.Date = message.Envelope.Date
+	mail.Flags = message.Flags
+	mail.InternalDate = message.InternalDate
 }
 
-func (mail *mail) fetchBody(reader *m.Reader) error {
-	var (
-		bodies      [][]byte
-		attachments []*attachment
-		count       = counter.CreateCounter()
-	)
+// parse reads the raw message source and fetches its body
+func (mail *mail) parse(raw []byte) error {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return err
+	}
+
+	// Initialize MultipartMimeType and AttachmentMimeType slices before fetching body
+	mail.MultipartMimeType = make([]string, 0)
+	mail.AttachmentMimeType = make([]string, 0)
 
+	mail.fetchBody(entity)
+
+	// Detect MIME types for each body part
+	for _, body := range mail.Body {
+		if len(body) > 0 {
+			mtype := mimetype.Detect(body)
+			if mtype != nil {
+				mail.MultipartMimeType = append(mail.MultipartMimeType, mtype.String())
+			}
+		}
+	}
+
+	// Detect MIME types for each attachment
+	for _, attachment := range mail.Attachments {
+		if len(attachment.Body) > 0 {
+			mtype := mimetype.Detect(attachment.Body)
+			if mtype != nil {
+				mail.AttachmentMimeType = append(mail.AttachmentMimeType, mtype.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchBody walks the whole MIME tree of the message including nested
+// multiparts and embedded messages. Parts which can't be read are skipped
+// and recorded in mail.PartErrors.
+func (mail *mail) fetchBody(entity *message.Entity) {
 	// Get the mail's content type
-	contentType, _, err := reader.Header.ContentType()
+	contentType, _, err := entity.Header.ContentType()
 	if err == nil {
 		mail.MimeType = contentType
 	}
 
-	for {
-		part, err := reader.NextPart()
-		if err != nil {
-			if err == io.EOF || err.Error() == "multipart: NextPart: EOF" {
-				break
-			}
+	mail.walkEntity(entity, "", nil, true, 0)
+	mail.collectParts()
+}
 
-			return err
-		}
+func (mail *mail) addPartError(part string, err error) {
+	mail.PartErrors = append(mail.PartErrors, &PartError{Uid: mail.Uid, Part: part, Err: err})
+}
 
-		switch header := part.Header.(type) {
-		case *m.InlineHeader:
-			body, err := io.ReadAll(part.Body)
-			if err != nil {
-				if err == io.ErrUnexpectedEOF {
-					continue
-				}
+// generatePdf renders all html bodies with renderer. cid: references are
+// embedded as data uris, remote content is only loaded from the configured
+// hosts and the first page starts with the header block if it is enabled.
+func (mail *mail) generatePdf(ctx context.Context, config *Config, renderer Renderer) ([]byte, error) {
+	options, err := newPageOptions(config)
+	if err != nil {
+		return nil, err
+	}
 
-				return err
-			}
+	rewriter := mail.newHtmlRewriter(config.Mails.RemoteHosts)
+	pages := make([][]byte, 0)
 
-			bodies = append(bodies, body)
-		case *m.AttachmentHeader:
-			// This is an attachment
-			filename, err := header.Filename()
-			if err != nil {
-				return err
-			}
+	for _, body := range mail.htmlPages() {
+		html, err := rewriter.rewrite(body)
+		if err != nil {
+			return nil, err
+		}
 
-			body, err := io.ReadAll(part.Body)
+		if len(pages) == 0 && config.Mails.Header.Enabled {
+			header, err := mail.renderHeader(config)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			mime := mimetype.Detect(body)
-
-			if filename == "" {
-				filename = fmt.Sprintf("%d-%d%s", mail.Uid, count.Next(), mime.Extension())
+			if html, err = prependHtml(html, header); err != nil {
+				return nil, err
 			}
-
-			filename = new(imap).fixUtf(filename)
-
-			// Replace all slashes with dashes to prevent directory traversal
-			filename = strings.ReplaceAll(filename, "/", "-")
-
-			attachments = append(attachments, &attachment{
-				Filename: filename,
-				Body:     body,
-				Mimetype: mime.String(),
-			})
 		}
+
+		pages = append(pages, html)
 	}
 
-	mail.Body = bodies
-	mail.Attachments = attachments
+	if len(pages) == 0 {
+		return nil, nil
+	}
 
-	return nil
+	return renderer.Render(ctx, pages, options)
 }
 
-func (mail *mail) generatePdf() ([]byte, error) {
-	count := counter.CreateCounter()
+// htmlPages returns the html bodies of the mail. Mails without html body
+// get their text/plain bodies converted to html instead.
+func (mail *mail) htmlPages() [][]byte {
+	pages := make([][]byte, 0)
 
-	pdfg, err := wkhtmltopdf.NewPDFGenerator()
-	if err != nil {
-		return nil, err
+	for _, body := range mail.Body {
+		if mime := mimetype.Detect(body); mime.Is("text/html") {
+			pages = append(pages, body)
+		}
 	}
 
-	pdfg.LowQuality.Set(true)
-	pdfg.Orientation.Set(wkhtmltopdf.OrientationPortrait)
-	pdfg.PageSize.Set(wkhtmltopdf.PageSizeA4)
+	if len(pages) > 0 {
+		return pages
+	}
 
-	for _, body := range mail.Body {
-		if mime := mimetype.Detect(body); !mime.Is("text/html") {
+	for _, part := range mail.Parts {
+		if part.Body == nil || part.ContentType != "text/plain" || !part.inline() || part.embedded() {
 			continue
 		}
 
-		page := wkhtmltopdf.NewPageReader(bytes.NewReader(body))
-		page.DisableJavascript.Set(true)
-		page.Encoding.Set("UTF-8")
+		_, params, _ := part.Header.ContentType()
+		flowed := strings.EqualFold(params["format"], "flowed")
+		delsp := strings.EqualFold(params["delsp"], "yes")
 
-		pdfg.AddPage(page)
-		count.Next()
+		pages = append(pages, textToHtml(part.Body, flowed, delsp))
 	}
 
-	if count.Current() == 0 {
-		return nil, nil
+	if len(pages) > 0 {
+		return pages
 	}
 
-	if err := pdfg.Create(); err != nil {
-		return nil, err
+	// bodies without MIME part, e.g. from winmail.dat
+	for _, body := range mail.Body {
+		if mime := mimetype.Detect(body); mime.Is("text/plain") {
+			pages = append(pages, textToHtml(body, false, false))
+		}
 	}
 
-	return pdfg.Bytes(), nil
+	return pages
 }
 
 func (mail *mail) getDirectoryName(root, username string) string {
+	if mail.Directory != "" {
+		username += "/" + mail.Directory
+	}
+
+	// Local mails may have no or an unparsable From header
+	host := "unknown"
+	if len(mail.From) > 0 && mail.From[0].HostName != "" {
+		host = mail.From[0].HostName
+	}
+
 	return fmt.Sprintf(
 		"%s/%s/%s/%s",
-		root, username, mail.Date.Format("200601"), mail.From[0].HostName,
+		root, username, mail.Date.Format("200601"), host,
 	)
 }
 
-func (mail *mail) getErrorText() string {
-	return fmt.Sprintf("Error: %s\nSubject: %s\nFrom: %s\n", mail.Error.Error(), mail.Subject, mail.Date)
+// getFileName returns the file name shared by all outputs of the mail, without extension
+func (mail *mail) getFileName() string {
+	return fmt.Sprintf("%s-%s-%d", sanitizeSubject(mail.Subject), mail.Date.Format("2006-01-02"), mail.Uid)
 }
 
-func (mail *mail) toJson() ([]byte, error) {
-	// Convert mail.From to string slice
-	fromAddrs := make([]string, len(mail.From))
-	for i, addr := range mail.From {
+func formatAddresses(addresses []*i.Address) []string {
+	formatted := make([]string, len(addresses))
+	for i, addr := range addresses {
 		if addr.PersonalName != "" {
-			fromAddrs[i] = fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
+			formatted[i] = fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
 		} else {
-			fromAddrs[i] = fmt.Sprintf("%s@%s", addr.MailboxName, addr.HostName)
+			formatted[i] = fmt.Sprintf("%s@%s", addr.MailboxName, addr.HostName)
 		}
 	}
 
+	return formatted
+}
+
+func (mail *mail) toJson() ([]byte, error) {
+	// Convert mail.From to string slice
+	fromAddrs := formatAddresses(mail.From)
+
 	// Convert attachments to filename slice
 	attachmentNames := make([]string, len(mail.Attachments))
 	for i, att := range mail.Attachments {
 		attachmentNames[i] = att.Filename
 	}
 
+	// Files extracted from archives are listed if they were saved
+	for _, saved := range mail.Saved {
+		if saved.Origin != "" {
+			attachmentNames = append(attachmentNames, saved.Origin)
+		}
+	}
+
+	warnings := make([]string, 0, len(mail.PartErrors))
+	for _, partErr := range mail.PartErrors {
+		warnings = append(warnings, partErr.Error())
+	}
+
 	// Create JSON structure
 	jsonData := jsonMail{
 		Uid:                mail.Uid,
+		Mailbox:            mail.Mailbox,
 		MessageID:          mail.MessageID,
 		Subject:            mail.Subject,
 		From:               fromAddrs,
@@ -300,6 +616,11 @@ func (mail *mail) toJson() ([]byte, error) {
 		MimeType:           mail.MimeType,
 		MultipartMimeType:  mail.MultipartMimeType,
 		AttachmentMimeType: mail.AttachmentMimeType,
+		PdfParts:           mail.PdfParts,
+		RemoteID:           mail.RemoteID,
+		Labels:             mail.Labels,
+		Paperless:          mail.Paperless,
+		Warnings:           warnings,
 	}
 
 	// Use json.Marshal with SetEscapeHTML(false) to preserve unicode and compact output
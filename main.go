@@ -1,62 +1,208 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// exitMessagesFailed is the exit status of a run which skipped failed messages
+	exitMessagesFailed = 2
+	// exitInterrupted is the exit status of a run stopped by SIGINT or SIGTERM
+	exitInterrupted = 130
+)
+
 func main() {
-	var config *Config
+	// commands
+	command := "sync"
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		command, args = args[0], args[1:]
+	}
 
-	// flags
-	configPath := flag.String("config", "", "config path")
-	from := flag.String("from", "", "from date")
-	to := flag.String("to", "", "to date")
-	flag.Parse()
+	switch command {
+	case "sync":
+		runSync(args)
+	case "watch":
+		runWatch(args)
+	case "daemon":
+		runDaemon(args)
+	case "retry":
+		runRetry(args)
+	default:
+		log.Fatalf("unknown command: %s", command)
+	}
+}
+
+// signalContext returns a context which is cancelled by the first SIGINT or
+// SIGTERM. A second signal exits right away without any cleanup.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %s, finishing current message (repeat to exit immediately)", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		<-sigs
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	var config *Config
 
 	// yaml
-	yamlBytes, err := os.ReadFile(*configPath)
+	yamlBytes, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	// yaml to config
-	err = yaml.Unmarshal(yamlBytes, &config)
-	if err != nil {
-		log.Fatal(err)
+	if err := yaml.Unmarshal(yamlBytes, &config); err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, errors.New("empty config")
 	}
 
-	// imap
-	imap := &imap{
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return config, nil
+}
+
+func newImap(config *Config) *imap {
+	return &imap{
 		Username: config.Imap.Username,
 		Password: config.Imap.Password,
 		Server:   config.Imap.Server,
 		Port:     config.Imap.Port,
+		UseGmail: config.Gmail.Enabled,
+		// Only used on Gmail
+		LabelDirectories: config.Gmail.LabelDirectories,
 	}
+}
 
-	if err := imap.connect(); err != nil {
-		log.Fatal(err)
+func newHandlers(config *Config, storage Storage, mailList *mailList) ([]MailHandler, error) {
+	renderer, err := newRenderer(config)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := imap.login(); err != nil {
-		log.Fatal(err)
+	handlers := []MailHandler{
+		NewAttachmentHandler(config.account(), storage),
+		NewPDFHandler(config.account(), renderer, storage),
+		NewTextHandler(config.account(), storage),
+	}
+
+	if config.Mails.SaveEml {
+		handlers = append(handlers, NewEMLHandler(config.account(), storage))
+	}
+
+	if config.Export.Maildir != "" {
+		handlers = append(handlers, NewMaildirHandler())
+	}
+
+	if config.Export.Mbox != "" {
+		handlers = append(handlers, NewMboxHandler())
+	}
+
+	// Posts the files saved by the handlers above
+	if config.Paperless.URL != "" {
+		paperless, err := NewPaperlessHandler(config, mailList)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, paperless)
+	}
+
+	return handlers, nil
+}
+
+// processMail runs all handlers for the mail and returns the errors of the mail
+// and the handlers. Parts which couldn't be read are only logged, they are
+// recorded as warnings in the metadata. A cancelled ctx doesn't stop the
+// handlers, so a mail is always processed completely. With dedup enabled, index
+// is set and duplicates of an already processed message are only recorded in it.
+// The message is claimed while the handlers run, so concurrent copies wait.
+func processMail(ctx context.Context, config *Config, handlers []MailHandler, index *messageIndex, mail *mail) error {
+	if mail.Error != nil {
+		return mail.Error
 	}
 
-	imap.enableCharsetReader()
+	if index != nil && index.claim(config.account(), mail) != nil {
+		index.add(config.account(), mail)
+		return nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	errs := make([]error, 0)
+
+	for _, partErr := range mail.PartErrors {
+		log.Printf("Skipped part: %v", partErr)
+	}
+
+	// Process mail with all handlers
+	for _, handler := range handlers {
+		if err := handler.Handle(ctx, config, mail); err != nil {
+			errs = append(errs, &MessageError{Uid: mail.Uid, Op: "handle", Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		if index != nil {
+			index.release(config.account(), mail)
+		}
+		return errors.Join(errs...)
+	}
+
+	// Failed mails are processed again, so they aren't duplicates yet
+	if index != nil {
+		index.add(config.account(), mail)
+	}
+
+	return nil
+}
+
+func runSync(args []string) {
+	// flags
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := flags.String("config", "", "config path")
+	from := flags.String("from", "", "from date")
+	to := flags.String("to", "", "to date")
+	_ = flags.Parse(args)
 
-	// Mailbox
-	_, err = imap.selectMailbox("INBOX")
+	config, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// search uids
+	// search dates
 	fromDate, err := time.Parse("2006-01-02", *from)
 	if err != nil {
 		log.Fatal(err)
@@ -67,84 +213,160 @@ func main() {
 		log.Fatal(err)
 	}
 
-	uids, err := imap.search(fromDate, toDate)
+	new(imap).enableCharsetReader()
+
+	ctx, stop := signalContext()
+	report := newErrorReport()
+	err = syncMails(ctx, config, fromDate, toDate, true, report)
+	stop()
+
+	report.write(os.Stderr)
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Interrupted")
+		os.Exit(exitInterrupted)
+	}
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// seqset
-	seqset := imap.createSeqSet(uids)
+	if report.len() > 0 {
+		os.Exit(exitMessagesFailed)
+	}
+
+	// done
+	fmt.Println("Done")
+}
+
+// syncMails downloads and processes all messages of the configured source
+// between from and to. Messages which fail are skipped and added to report.
+// When ctx is cancelled the current message is finished, the metadata is
+// flushed, the source is closed and ctx.Err() is returned.
+func syncMails(ctx context.Context, config *Config, from, to time.Time, progress bool, report *errorReport) error {
+	source, err := newSource(config)
+	if err != nil {
+		return err
+	}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(storage)
+
+	defer func() {
+		if err := source.Close(); err != nil {
+			log.Printf("Failed to close source: %v", err)
+		}
+	}()
+
+	if err := source.Open(ctx); err != nil {
+		return err
+	}
+
+	// Create mail list for metadata tracking
+	username := config.account()
+	mailRoot := fmt.Sprintf("mail/%s", username)
+	mailList, err := newMailList(storage, username, source.Vendor(), source.Server(), mailRoot)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := mailList.flush(); err != nil {
+			log.Printf("Failed to save metadata: %v", err)
+		}
+	}()
+
+	index, err := loadMessageIndex(config, storage)
+	if err != nil {
+		return err
+	}
+
+	defer saveMessageIndex(index)
+
+	if incremental, ok := source.(incrementalSource); ok {
+		incremental.Track(mailList)
+	}
+
+	// search uids
+	uids, err := source.Search(ctx, from, to)
+	if err != nil {
+		return err
+	}
 
 	// channel
 	mailsChan := make(chan *mail)
+	fetchErr := make(chan error, 1)
 
 	// fetch messages
 	go func() {
-		if err = imap.fetchMessages(seqset, mailsChan); err != nil {
-			log.Fatal(err)
-		}
+		fetchErr <- source.Fetch(ctx, uids, mailsChan)
 		close(mailsChan)
 	}()
 
 	// start bar
-	fmt.Println("Fetching messages...")
-	bar := pb.StartNew(len(uids))
+	bar := pb.New(len(uids))
+	if progress {
+		fmt.Println("Fetching messages...")
+		bar.Start()
+	}
 
 	// mails
 	mails := make([]*mail, 0)
 
-	// Create mail list for metadata tracking
-	mailRoot := fmt.Sprintf("mail/%s", imap.Username)
-	mailList, err := newMailList(imap.Username, "imap", imap.Server, mailRoot)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// fetch messages
 	for mail := range mailsChan {
 		mails = append(mails, mail)
-		if mail.Error == nil {
-			if err := mailList.addMail(mail); err != nil {
-				log.Printf("Failed to update metadata for mail %d: %v", mail.Uid, err)
-			}
-		}
 		bar.Increment()
 	}
 
-	// logout
-	if err := imap.Client.Logout(); err != nil {
-		log.Fatal(err)
+	if err := <-fetchErr; err != nil {
+		return err
+	}
+
+	// close
+	if err := source.Close(); err != nil {
+		return err
 	}
 
 	// Initialize handlers
-	handlers := []MailHandler{
-		NewAttachmentHandler(imap.Username),
-		NewPDFHandler(imap.Username),
-		NewTextHandler(imap.Username),
+	handlers, err := newHandlers(config, storage, mailList)
+	if err != nil {
+		return err
 	}
 
 	// start bar
-	fmt.Println("Processing messages...")
+	if progress {
+		fmt.Println("Processing messages...")
+	}
 	bar.SetCurrent(0)
 
 	// process messages
 	for _, mail := range mails {
-		if mail.Error != nil {
-			log.Println(mail.getErrorText())
-			bar.Increment()
-			continue
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		// Process mail with all handlers
-		for _, handler := range handlers {
-			if err := handler.Handle(config, mail); err != nil {
-				log.Printf("Handler error for mail %d: %v", mail.Uid, err)
-			}
+		err := processMail(ctx, config, handlers, index, mail)
+		if err != nil {
+			report.add(mail, err)
 		}
 
+		if err := recordResult(ctx, username, mailList, mail, err); err != nil {
+			log.Printf("Failed to update metadata for mail %d: %v", mail.Uid, err)
+		}
 		bar.Increment()
 	}
 
-	// done
-	fmt.Println("Done")
+	if progress {
+		bar.Finish()
+	}
+
+	if committing, ok := source.(committingSource); ok {
+		return committing.Commit(ctx, mailList)
+	}
+
+	return nil
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-message"
+	m "github.com/emersion/go-message/mail"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/loeffel-io/mail-downloader/archive"
+	"github.com/loeffel-io/mail-downloader/counter"
+	"github.com/loeffel-io/mail-downloader/tnef"
+)
+
+// maxMimeDepth limits how deep nested multiparts and embedded messages are walked
+const maxMimeDepth = 16
+
+// mimePart is a node of the MIME tree of a message. Multipart containers and
+// embedded messages are parts too, only leaves and embedded messages have a Body.
+type mimePart struct {
+	Path        string
+	Header      message.Header
+	ContentType string
+	Disposition string
+	Parent      *mimePart
+	Body        []byte
+}
+
+// embedded reports whether the part is inside a message/rfc822 part
+func (part *mimePart) embedded() bool {
+	for parent := part.Parent; parent != nil; parent = parent.Parent {
+		if isMessageType(parent.ContentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inline reports whether the part is shown as part of the message body,
+// following the same rules as go-message's mail.Reader
+func (part *mimePart) inline() bool {
+	return part.Disposition == "inline" ||
+		(part.Disposition != "attachment" && strings.HasPrefix(part.ContentType, "text/"))
+}
+
+func isMessageType(contentType string) bool {
+	return contentType == "message/rfc822" || contentType == "message/global"
+}
+
+func childPath(path string, index int) string {
+	if path == "" {
+		return fmt.Sprint(index)
+	}
+
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// walkEntity adds entity and all its descendants to mail.Parts using IMAP part
+// numbering. Embedded messages are walked as children of their message/rfc822
+// part; root is set for the top level entity of a message whose children are
+// numbered relative to path.
+func (mail *mail) walkEntity(entity *message.Entity, path string, parent *mimePart, root bool, depth int) {
+	if depth > maxMimeDepth {
+		mail.addPartError(path, fmt.Errorf("MIME tree deeper than %d levels", maxMimeDepth))
+		return
+	}
+
+	if mr := entity.MultipartReader(); mr != nil {
+		container := parent
+		if !root {
+			container = mail.addPart(entity, path, parent)
+		}
+
+		for index := 1; ; index++ {
+			child, err := mr.NextPart()
+			if err != nil && !message.IsUnknownCharset(err) {
+				if !errors.Is(err, io.EOF) {
+					// The remaining parts can't be located anymore
+					mail.addPartError(childPath(path, index), err)
+				}
+				break
+			}
+
+			mail.walkEntity(child, childPath(path, index), container, false, depth+1)
+		}
+
+		return
+	}
+
+	if root {
+		path = childPath(path, 1)
+	}
+
+	part := mail.addPart(entity, path, parent)
+
+	body, err := io.ReadAll(entity.Body)
+	if err != nil {
+		if err != io.ErrUnexpectedEOF || !part.inline() {
+			mail.addPartError(path, err)
+		}
+		return
+	}
+	part.Body = body
+
+	if !isMessageType(part.ContentType) {
+		return
+	}
+
+	inner, err := message.Read(bytes.NewReader(body))
+	if err != nil && !message.IsUnknownCharset(err) {
+		mail.addPartError(path, err)
+		return
+	}
+
+	mail.walkEntity(inner, path, part, true, depth+1)
+}
+
+func (mail *mail) addPart(entity *message.Entity, path string, parent *mimePart) *mimePart {
+	contentType, _, _ := entity.Header.ContentType()
+	disposition, _, _ := entity.Header.ContentDisposition()
+
+	part := &mimePart{
+		Path:        path,
+		Header:      entity.Header,
+		ContentType: contentType,
+		Disposition: disposition,
+		Parent:      parent,
+	}
+
+	mail.Parts = append(mail.Parts, part)
+	return part
+}
+
+// collectParts fills mail.Body and mail.Attachments from the leaves of the MIME
+// tree. Inline parts of embedded messages are skipped, their attachments are not.
+func (mail *mail) collectParts() {
+	count := counter.CreateCounter()
+
+	for _, part := range mail.Parts {
+		if part.Body == nil {
+			continue
+		}
+
+		if part.inline() {
+			if !part.embedded() {
+				mail.Body = append(mail.Body, part.Body)
+			}
+			continue
+		}
+
+		filename, err := (&m.AttachmentHeader{Header: part.Header}).Filename()
+		if err != nil {
+			mail.addPartError(part.Path, err)
+			continue
+		}
+
+		if isTNEF(part.ContentType, filename) && mail.expandTNEF(part, count) {
+			continue
+		}
+
+		mail.addAttachment(filename, part.Body, part.Path, "", count)
+	}
+}
+
+func isTNEF(contentType, filename string) bool {
+	return contentType == "application/ms-tnef" ||
+		contentType == "application/vnd.ms-tnef" ||
+		strings.EqualFold(filename, "winmail.dat")
+}
+
+// expandTNEF adds the files and the body contained in a winmail.dat part to the
+// mail. It returns false if the part couldn't be decoded.
+func (mail *mail) expandTNEF(part *mimePart, count *counter.Counter) bool {
+	decoded, err := tnef.Decode(part.Body)
+	if err != nil {
+		mail.addPartError(part.Path, err)
+		return false
+	}
+
+	if !part.embedded() {
+		switch {
+		case len(decoded.BodyHTML) > 0:
+			mail.Body = append(mail.Body, decoded.BodyHTML)
+		case len(decoded.Body) > 0:
+			mail.Body = append(mail.Body, decoded.Body)
+		case len(decoded.BodyRTF) > 0:
+			mail.addAttachment("", decoded.BodyRTF, part.Path, "application/rtf", count)
+		}
+	}
+
+	for _, attachment := range decoded.Attachments {
+		mail.addAttachment(attachment.Filename, attachment.Data, part.Path, attachment.MimeType, count)
+	}
+
+	return true
+}
+
+// addAttachment adds an attachment with a safe filename. The detected mimetype
+// is preferred over fallbackMimetype unless it is unspecific.
+func (mail *mail) addAttachment(filename string, body []byte, path, fallbackMimetype string, count *counter.Counter) {
+	mime := mimetype.Detect(body)
+	mimeString := mime.String()
+	if fallbackMimetype != "" && mime.Is("application/octet-stream") {
+		mimeString = fallbackMimetype
+	}
+
+	if filename == "" {
+		filename = fmt.Sprintf("%d-%d%s", mail.Uid, count.Next(), mime.Extension())
+	}
+
+	filename = new(imap).fixUtf(filename)
+
+	// Replace all slashes with dashes to prevent directory traversal
+	filename = strings.ReplaceAll(filename, "/", "-")
+
+	mail.Attachments = append(mail.Attachments, &attachment{
+		Filename: filename,
+		Body:     body,
+		Mimetype: mimeString,
+		Path:     path,
+	})
+}
+
+// expandedArchives is the result of expandArchives
+type expandedArchives struct {
+	attachments []*attachment
+	failed      []*attachment
+}
+
+// attachments returns the attachments of the mail followed by the files
+// extracted from archives if they are enabled
+func (mail *mail) attachments(config *Config) (attachments []*attachment, failed []*attachment) {
+	if !config.Attachments.Archives.Enabled {
+		return mail.Attachments, nil
+	}
+
+	return mail.expandArchives(archiveLimits(config))
+}
+
+// expandArchives returns the attachments followed by the files of archive
+// attachments with their origin. Archives which can't be extracted, e.g.
+// because they exceed the limits, are recorded as part errors and returned as
+// failed, so they are saved as they are. The result is kept for later
+// handlers, mail.Attachments isn't changed.
+func (mail *mail) expandArchives(limits archive.Limits) (attachments []*attachment, failed []*attachment) {
+	if mail.archives != nil {
+		return mail.archives.attachments, mail.archives.failed
+	}
+
+	attachments = slices.Clone(mail.Attachments)
+
+	for _, att := range mail.Attachments {
+		if att.Origin != "" || !archive.IsArchive(mimeType(att.Mimetype)) {
+			continue
+		}
+
+		files, err := archive.Extract(att.Body, mimeType(att.Mimetype), limits)
+		if err != nil {
+			err = fmt.Errorf("failed to extract %s: %w", att.Filename, err)
+			log.Printf("Keeping archive: %v", err)
+			mail.addPartError(att.Path, err)
+			failed = append(failed, att)
+			continue
+		}
+
+		for _, f := range files {
+			attachments = append(attachments, &attachment{
+				// Replace all slashes with dashes to prevent directory traversal
+				Filename: strings.ReplaceAll(new(imap).fixUtf(f.Name), "/", "-"),
+				Body:     f.Body,
+				Mimetype: mimetype.Detect(f.Body).String(),
+				Path:     att.Path,
+				Origin:   att.Filename + "!/" + f.Name,
+			})
+		}
+	}
+
+	mail.archives = &expandedArchives{attachments: attachments, failed: failed}
+	return attachments, failed
+}
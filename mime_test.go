@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/loeffel-io/mail-downloader/archive"
+	"github.com/stretchr/testify/assert"
+)
+
+const forwardedMail = "From: accounting@example.com\r\n" +
+	"Subject: Fwd: invoice\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"see attached\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>see attached</p>\r\n" +
+	"--alt--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"Content-Disposition: attachment; filename=invoice.eml\r\n" +
+	"\r\n" +
+	"From: billing@vendor.com\r\n" +
+	"Subject: Your invoice\r\n" +
+	"Content-Type: multipart/mixed; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"thank you\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+	"\r\n" +
+	"%PDF-1.4\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+func TestParseNested(t *testing.T) {
+	mail := &mail{Uid: 1}
+	assert.NoError(t, mail.parse([]byte(forwardedMail)))
+	assert.Empty(t, mail.PartErrors)
+
+	paths := make([]string, 0)
+	for _, part := range mail.Parts {
+		paths = append(paths, part.Path+" "+part.ContentType)
+	}
+
+	assert.Equal(t, []string{
+		"1 multipart/alternative",
+		"1.1 text/plain",
+		"1.2 text/html",
+		"2 message/rfc822",
+		"2.1 text/plain",
+		"2.2 application/pdf",
+	}, paths)
+
+	assert.Equal(t, "2", mail.Parts[5].Parent.Path)
+	assert.Nil(t, mail.Parts[0].Parent)
+
+	assert.Len(t, mail.Body, 2)
+	assert.Equal(t, "see attached", strings.TrimSpace(string(mail.Body[0])))
+
+	filenames := make([]string, 0)
+	for _, attachment := range mail.Attachments {
+		filenames = append(filenames, attachment.Path+" "+attachment.Filename)
+	}
+
+	assert.Equal(t, []string{"2 invoice.eml", "2.2 invoice.pdf"}, filenames)
+}
+
+func TestParseSinglePart(t *testing.T) {
+	mail := &mail{Uid: 1}
+	assert.NoError(t, mail.parse([]byte("Subject: hi\r\nContent-Type: text/plain\r\n\r\nhello\r\n")))
+
+	assert.Len(t, mail.Parts, 1)
+	assert.Equal(t, "1", mail.Parts[0].Path)
+	assert.Len(t, mail.Body, 1)
+	assert.Empty(t, mail.Attachments)
+}
+
+func TestParseTruncated(t *testing.T) {
+	raw := "Subject: truncated\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+		"\r\n" +
+		"%PDF-1.4\r\n"
+
+	mail := &mail{Uid: 1}
+	assert.NoError(t, mail.parse([]byte(raw)))
+	assert.NotEmpty(t, mail.PartErrors)
+	assert.Len(t, mail.Body, 1)
+
+	// Part errors are warnings, they don't fail the mail
+	assert.NoError(t, processMail(context.Background(), new(Config), nil, nil, mail))
+
+	data, err := mail.toJson()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"warnings":["message 1 part`)
+}
+
+func TestExpandArchives(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	w, err := writer.Create("docs/a.pdf")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("%PDF-1.4"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	mail := &mail{Attachments: []*attachment{
+		{Filename: "docs.zip", Mimetype: "application/zip", Body: buf.Bytes()},
+	}}
+
+	attachments, failed := mail.expandArchives(archive.Limits{})
+	assert.Empty(t, failed)
+	assert.Len(t, attachments, 2)
+	assert.Equal(t, "docs-a.pdf", attachments[1].Filename)
+	assert.Equal(t, "docs.zip!/docs/a.pdf", attachments[1].Origin)
+	assert.Equal(t, "application/pdf", attachments[1].Mimetype)
+
+	// Handlers which run later see the attachments of the mail only
+	assert.Len(t, mail.Attachments, 1)
+
+	// Archives exceeding the limits are a warning and saved as they are
+	mail.archives = nil
+	attachments, failed = mail.expandArchives(archive.Limits{MaxSize: 1})
+	assert.Equal(t, mail.Attachments, attachments)
+	assert.Equal(t, mail.Attachments, failed)
+	assert.Len(t, mail.PartErrors, 1)
+	assert.ErrorIs(t, mail.PartErrors[0], archive.ErrTooLarge)
+
+	config := new(Config)
+	config.Attachments.Mimetypes = []string{"application/pdf"}
+	config.Attachments.Archives.Enabled = true
+	config.Attachments.Archives.MaxSize = 1
+
+	storage := newLocalStorage(t.TempDir())
+	mail.archives, mail.PartErrors = nil, nil
+	assert.NoError(t, NewAttachmentHandler("user", storage).Handle(context.Background(), config, mail))
+	assert.Len(t, mail.Saved, 1)
+	assert.True(t, strings.HasSuffix(mail.Saved[0].Path, "/docs.zip"))
+	assert.Len(t, mail.PartErrors, 1)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/net/html"
+)
+
+// nativeBlocks start on a new line
+var nativeBlocks = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "dd": true, "div": true,
+	"dl": true, "dt": true, "figure": true, "footer": true, "form": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "header": true, "li": true, "main": true,
+	"nav": true, "ol": true, "p": true, "pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// nativeHeadings are font sizes in points
+var nativeHeadings = map[string]float64{"h1": 18, "h2": 15, "h3": 13, "h4": 11, "h5": 10, "h6": 10}
+
+const nativeFontSize = 10
+
+// nativeRenderer lays out text, links, lists and embedded images in pure Go.
+// CSS is ignored and text is limited to the Windows-1252 character set, so
+// it's only meant for simple mails or systems without a browser.
+type nativeRenderer struct{}
+
+func (r *nativeRenderer) Render(ctx context.Context, pages [][]byte, options *PageOptions) ([]byte, error) {
+	orientation := "P"
+	if options.Landscape {
+		orientation = "L"
+	}
+
+	pdf := fpdf.New(orientation, "mm", options.Size, "")
+	pdf.SetMargins(options.Margins.Left, options.Margins.Top, options.Margins.Right)
+	pdf.SetAutoPageBreak(true, options.Margins.Bottom)
+	pdf.SetCreator("mail-downloader", true)
+
+	writer := &nativeWriter{
+		pdf:       pdf,
+		translate: pdf.UnicodeTranslatorFromDescriptor("cp1252"),
+		size:      nativeFontSize,
+	}
+
+	for _, page := range pages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		doc, err := html.Parse(bytes.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+
+		pdf.AddPage()
+		writer.space = true
+		writer.setFont()
+		writer.walk(doc)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := pdf.Output(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// nativeWriter keeps the text style while walking the html tree
+type nativeWriter struct {
+	pdf       *fpdf.Fpdf
+	translate func(string) string
+	images    int
+
+	bold   int
+	italic int
+	mono   int
+	pre    int
+	size   float64
+	href   string
+
+	// space is set at the start of a line or after whitespace, so collapsed
+	// whitespace isn't written twice
+	space bool
+}
+
+func (w *nativeWriter) setFont() {
+	family := "Helvetica"
+	if w.mono > 0 {
+		family = "Courier"
+	}
+
+	style := ""
+	if w.bold > 0 {
+		style += "B"
+	}
+	if w.italic > 0 {
+		style += "I"
+	}
+
+	w.pdf.SetFont(family, style, w.size)
+}
+
+// lineHeight in millimeters for the current font size
+func (w *nativeWriter) lineHeight() float64 {
+	return w.size * 0.5
+}
+
+// block moves to the start of a new line unless the current line is empty
+func (w *nativeWriter) block() {
+	left, _, _, _ := w.pdf.GetMargins()
+	if w.pdf.GetX() > left+0.01 {
+		w.pdf.Ln(w.lineHeight())
+	}
+	w.space = true
+}
+
+func (w *nativeWriter) write(text string) {
+	if text == "" {
+		return
+	}
+
+	text = w.translate(text)
+	if w.href != "" {
+		w.pdf.SetTextColor(0, 0, 238)
+		w.pdf.WriteLinkString(w.lineHeight(), text, w.href)
+		w.pdf.SetTextColor(0, 0, 0)
+		return
+	}
+
+	w.pdf.Write(w.lineHeight(), text)
+}
+
+func (w *nativeWriter) text(data string) {
+	if w.pre > 0 {
+		w.write(data)
+		w.space = strings.HasSuffix(data, "\n")
+		return
+	}
+
+	words := strings.Fields(data)
+	if len(words) == 0 {
+		if data != "" && !w.space {
+			w.write(" ")
+			w.space = true
+		}
+		return
+	}
+
+	text := strings.Join(words, " ")
+	if !w.space && strings.IndexFunc(data[:1], isSpace) == 0 {
+		text = " " + text
+	}
+	if strings.LastIndexFunc(data, isSpace) == len(data)-1 {
+		text += " "
+	}
+
+	w.write(text)
+	w.space = strings.HasSuffix(text, " ")
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+}
+
+func (w *nativeWriter) walk(node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		w.text(node.Data)
+		return
+	case html.ElementNode:
+	default:
+		w.children(node)
+		return
+	}
+
+	switch node.Data {
+	case "head", "script", "style", "title", "noscript", "template":
+		return
+	case "br":
+		w.pdf.Ln(w.lineHeight())
+		w.space = true
+		return
+	case "hr":
+		w.block()
+		left, _, right, _ := w.pdf.GetMargins()
+		width, _ := w.pdf.GetPageSize()
+		y := w.pdf.GetY() + w.lineHeight()/2
+		w.pdf.Line(left, y, width-right, y)
+		w.pdf.Ln(w.lineHeight())
+		return
+	case "img":
+		w.image(attribute(node, "src"))
+		return
+	case "td", "th":
+		if node.PrevSibling != nil {
+			w.write("    ")
+			w.space = true
+		}
+	}
+
+	size, bold, italic, mono, pre, href := w.size, w.bold, w.italic, w.mono, w.pre, w.href
+
+	switch node.Data {
+	case "b", "strong", "th", "dt":
+		w.bold++
+	case "i", "em", "cite", "var":
+		w.italic++
+	case "code", "kbd", "samp", "tt":
+		w.mono++
+	case "pre":
+		w.mono++
+		w.pre++
+	case "a":
+		if href := attribute(node, "href"); href != "" && !strings.HasPrefix(href, "#") {
+			w.href = href
+		}
+	}
+
+	if heading, ok := nativeHeadings[node.Data]; ok {
+		w.size = heading
+		w.bold++
+	}
+
+	w.setFont()
+
+	if nativeBlocks[node.Data] {
+		w.block()
+	}
+
+	if node.Data == "li" {
+		w.write("• ")
+		w.space = true
+	}
+
+	w.children(node)
+
+	if nativeBlocks[node.Data] {
+		w.block()
+	}
+
+	w.size, w.bold, w.italic, w.mono, w.pre, w.href = size, bold, italic, mono, pre, href
+	w.setFont()
+}
+
+func (w *nativeWriter) children(node *html.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		w.walk(child)
+	}
+}
+
+// image draws data uri images, which includes all cid: images of the mail
+func (w *nativeWriter) image(src string) {
+	data, ok := strings.CutPrefix(src, "data:")
+	if !ok {
+		return
+	}
+
+	mediatype, encoded, ok := strings.Cut(data, ";base64,")
+	if !ok {
+		return
+	}
+
+	tp := w.pdf.ImageTypeFromMime(mediatype)
+	if w.pdf.Err() {
+		w.pdf.ClearError()
+		return
+	}
+
+	body, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+
+	w.images++
+	name := fmt.Sprintf("image%d", w.images)
+	options := fpdf.ImageOptions{ImageType: tp}
+
+	info := w.pdf.RegisterImageOptionsReader(name, options, bytes.NewReader(body))
+	if w.pdf.Err() || info == nil {
+		// Broken images are skipped instead of failing the document
+		w.pdf.ClearError()
+		return
+	}
+
+	left, _, right, _ := w.pdf.GetMargins()
+	pageWidth, _ := w.pdf.GetPageSize()
+	width := min(info.Width(), pageWidth-left-right)
+
+	w.block()
+	w.pdf.ImageOptions(name, left, -1, width, 0, true, options, 0, "")
+	w.space = true
+}
+
+func attribute(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/loeffel-io/mail-downloader/search"
+)
+
+// paperlessTask is the consumption task of a file posted to paperless-ngx
+type paperlessTask struct {
+	File   string `json:"file"`
+	TaskID string `json:"task_id"`
+}
+
+// PaperlessHandler posts the saved attachments and PDFs to paperless-ngx. It
+// must run after the handlers which save them. Files with a task in the
+// metadata aren't posted again.
+type PaperlessHandler struct {
+	url      *url.URL
+	token    string
+	client   *http.Client
+	mailList *mailList
+	mutex    sync.Mutex
+	// ids caches the ids of correspondents and tags by endpoint and name
+	ids map[string]int
+}
+
+func NewPaperlessHandler(config *Config, mailList *mailList) (*PaperlessHandler, error) {
+	u, err := url.Parse(config.Paperless.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid paperless url: %s", config.Paperless.URL)
+	}
+
+	return &PaperlessHandler{
+		url:      u,
+		token:    config.Paperless.Token,
+		client:   http.DefaultClient,
+		mailList: mailList,
+		ids:      make(map[string]int),
+	}, nil
+}
+
+func (h *PaperlessHandler) Handle(ctx context.Context, config *Config, mail *mail) error {
+	if len(mail.Saved) == 0 {
+		return nil
+	}
+
+	posted := make(map[string]bool)
+	mail.Paperless = h.mailList.paperlessTasks(mail.Mailbox, mail.Uid)
+	for _, task := range mail.Paperless {
+		posted[task.File] = true
+	}
+
+	pending := make([]*savedFile, 0, len(mail.Saved))
+	for _, file := range mail.Saved {
+		if !posted[file.Path] {
+			pending = append(pending, file)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	fields := url.Values{"created": {mail.Date.Format(time.RFC3339)}}
+
+	if len(mail.From) > 0 && mail.From[0].HostName != "" {
+		id, err := h.id(ctx, "correspondents", mail.From[0].HostName)
+		if err != nil {
+			return fmt.Errorf("failed to find correspondent: %w", err)
+		}
+		fields.Set("correspondent", strconv.Itoa(id))
+	}
+
+	for _, tag := range paperlessTags(config, mail) {
+		id, err := h.id(ctx, "tags", tag)
+		if err != nil {
+			return fmt.Errorf("failed to find tag: %w", err)
+		}
+		fields.Add("tags", strconv.Itoa(id))
+	}
+
+	errs := make([]error, 0)
+	for _, file := range pending {
+		fields.Set("title", file.Title)
+
+		taskID, err := h.postDocument(ctx, file, fields)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to post %s: %w", file.Path, err))
+			continue
+		}
+
+		mail.Paperless = append(mail.Paperless, paperlessTask{File: file.Path, TaskID: taskID})
+	}
+
+	return errors.Join(errs...)
+}
+
+// paperlessTags returns the terms of the subject rule which matches mail and the configured tags
+func paperlessTags(config *Config, mail *mail) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+
+	s := &search.Search{Search: config.Mails.Subjects, Data: mail.Subject}
+	terms, _ := s.Match()
+	for _, tag := range append(terms, config.Paperless.Tags...) {
+		if tag != "" && !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// postDocument uploads a file for consumption and returns the id of the task
+func (h *PaperlessHandler) postDocument(ctx context.Context, file *savedFile, fields url.Values) (string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for name, values := range fields {
+		for _, value := range values {
+			if err := writer.WriteField(name, value); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	part, err := writer.CreateFormFile("document", path.Base(file.Path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(file.Body); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	var taskID string
+	if err := h.do(ctx, http.MethodPost, "documents/post_document/", nil, writer.FormDataContentType(), body, &taskID); err != nil {
+		return "", err
+	}
+
+	return taskID, nil
+}
+
+// id returns the id of the correspondent or tag called name, it is created if it doesn't exist
+func (h *PaperlessHandler) id(ctx context.Context, endpoint, name string) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := endpoint + "/" + strings.ToLower(name)
+	if id, ok := h.ids[key]; ok {
+		return id, nil
+	}
+
+	var found struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	query := url.Values{"name__iexact": {name}}
+	if err := h.do(ctx, http.MethodGet, endpoint+"/", query, "", nil, &found); err != nil {
+		return 0, err
+	}
+
+	if len(found.Results) > 0 {
+		h.ids[key] = found.Results[0].ID
+		return found.Results[0].ID, nil
+	}
+
+	// Mails are assigned explicitly, so paperless shouldn't match other documents
+	body, err := json.Marshal(map[string]any{"name": name, "matching_algorithm": 0})
+	if err != nil {
+		return 0, err
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	if err := h.do(ctx, http.MethodPost, endpoint+"/", nil, "application/json", bytes.NewReader(body), &created); err != nil {
+		return 0, err
+	}
+
+	h.ids[key] = created.ID
+	return created.ID, nil
+}
+
+// do sends a request to an endpoint below /api/ and decodes the JSON response into v
+func (h *PaperlessHandler) do(ctx context.Context, method, endpoint string, query url.Values, contentType string, body io.Reader, v any) error {
+	target := h.url.JoinPath("api", endpoint)
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Token "+h.token)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("paperless: %s %s: %s: %s", method, target.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+// paperlessServer is a paperless-ngx API stub which records posted documents
+type paperlessServer struct {
+	mutex     sync.Mutex
+	names     map[string]map[string]int
+	documents []map[string][]string
+}
+
+func (s *paperlessServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, `{"detail":"Invalid token."}`, http.StatusUnauthorized)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch endpoint := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/paperless/api/"), "/"); {
+	case endpoint == "documents/post_document" && r.Method == http.MethodPost:
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		file, header, err := r.FormFile("document")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(file)
+
+		document := r.MultipartForm.Value
+		document["filename"] = []string{header.Filename}
+		document["body"] = []string{string(body)}
+		s.documents = append(s.documents, document)
+		json.NewEncoder(w).Encode(fmt.Sprintf("task-%d", len(s.documents)))
+	case s.names[endpoint] != nil && r.Method == http.MethodGet:
+		results := make([]map[string]any, 0)
+		for name, id := range s.names[endpoint] {
+			if strings.EqualFold(name, r.URL.Query().Get("name__iexact")) {
+				results = append(results, map[string]any{"id": id, "name": name})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"count": len(results), "results": results})
+	case s.names[endpoint] != nil && r.Method == http.MethodPost:
+		var created struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&created)
+		id := 100 + len(s.names[endpoint])
+		s.names[endpoint][created.Name] = id
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "name": created.Name})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPaperlessHandler(t *testing.T) {
+	stub := &paperlessServer{names: map[string]map[string]int{
+		"correspondents": {},
+		"tags":           {"Inbox": 7},
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	config := new(Config)
+	config.Attachments.Mimetypes = []string{"application/pdf"}
+	config.Mails.Subjects = []string{"invoice, amazon", "receipt"}
+	config.Paperless.URL = server.URL + "/paperless"
+	config.Paperless.Token = "secret"
+	config.Paperless.Tags = []string{"inbox"}
+
+	ctx := context.Background()
+	storage := newLocalStorage(t.TempDir())
+	mailList, err := newMailList(storage, "user", "imap", "localhost", "mail/user")
+	assert.NoError(t, err)
+
+	paperless, err := NewPaperlessHandler(config, mailList)
+	assert.NoError(t, err)
+
+	invoice := func() *mail {
+		return &mail{
+			Uid:     3,
+			Mailbox: "INBOX",
+			Subject: "Your Amazon invoice",
+			Date:    time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+			From:    []*i.Address{{MailboxName: "billing", HostName: "amazon.de"}},
+			Attachments: []*attachment{
+				{Filename: "INV-42.pdf", Body: []byte("%PDF-1.4 invoice"), Mimetype: "application/pdf"},
+				{Filename: "logo.png", Body: []byte("png"), Mimetype: "image/png"},
+			},
+		}
+	}
+
+	receipt := invoice()
+	assert.NoError(t, mailList.addMail(ctx, receipt))
+	assert.NoError(t, NewAttachmentHandler("user", storage).Handle(ctx, config, receipt))
+	receipt.Saved = append(receipt.Saved, &savedFile{Path: "mail/user/202403/amazon.de/mail.pdf", Title: receipt.Subject, Body: []byte("%PDF-1.4 mail")})
+
+	assert.NoError(t, paperless.Handle(ctx, config, receipt))
+	assert.NoError(t, mailList.addMail(ctx, receipt))
+
+	assert.Len(t, stub.documents, 2)
+	assert.Equal(t, []string{"INV-42"}, stub.documents[0]["title"])
+	assert.Equal(t, []string{"INV-42.pdf"}, stub.documents[0]["filename"])
+	assert.Equal(t, []string{"%PDF-1.4 invoice"}, stub.documents[0]["body"])
+	assert.Equal(t, []string{"2024-03-01T10:00:00Z"}, stub.documents[0]["created"])
+	assert.Equal(t, []string{"100"}, stub.documents[0]["correspondent"])
+	assert.Equal(t, []string{"101", "102", "7"}, stub.documents[0]["tags"])
+	assert.Equal(t, []string{"Your Amazon invoice"}, stub.documents[1]["title"])
+	assert.Equal(t, map[string]int{"invoice": 101, "amazon": 102, "Inbox": 7}, stub.names["tags"])
+	assert.Equal(t, map[string]int{"amazon.de": 100}, stub.names["correspondents"])
+
+	assert.Equal(t, []paperlessTask{
+		{File: "attachment/user/202403/amazon.de/INV-42.pdf", TaskID: "task-1"},
+		{File: "mail/user/202403/amazon.de/mail.pdf", TaskID: "task-2"},
+	}, mailList.paperlessTasks("INBOX", 3))
+
+	// Files with a task aren't posted again when the mail is fetched again
+	receipt = invoice()
+	assert.NoError(t, mailList.addMail(ctx, receipt))
+	assert.NoError(t, NewAttachmentHandler("user", storage).Handle(ctx, config, receipt))
+	assert.NoError(t, paperless.Handle(ctx, config, receipt))
+	assert.NoError(t, mailList.addMail(ctx, receipt))
+	assert.Len(t, stub.documents, 2)
+	assert.Len(t, mailList.paperlessTasks("INBOX", 3), 2)
+
+	// The same uid in another mailbox is a different mail
+	filed := invoice()
+	filed.Mailbox = "Invoices"
+	assert.Empty(t, mailList.paperlessTasks("Invoices", 3))
+	assert.NoError(t, mailList.addMail(ctx, filed))
+	assert.Len(t, mailList.List, 2)
+	assert.Len(t, mailList.paperlessTasks("INBOX", 3), 2)
+
+	config.Paperless.Token = "wrong"
+	paperless, err = NewPaperlessHandler(config, mailList)
+	assert.NoError(t, err)
+	receipt.Uid = 4
+	assert.ErrorContains(t, paperless.Handle(ctx, config, receipt), "401")
+}
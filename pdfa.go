@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// mailNamespace holds the XMP properties which have no standard schema
+const mailNamespace = "https://github.com/loeffel-io/mail-downloader/ns/mail/1.0/"
+
+// xmpTemplate describes the document for PDF/A. Custom properties must be
+// declared in a PDF/A extension schema.
+var xmpTemplate = template.Must(template.New("xmp").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(
+	`<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about=""
+  xmlns:dc="http://purl.org/dc/elements/1.1/"
+  xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+  xmlns:pdf="http://ns.adobe.com/pdf/1.3/"
+  xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/"
+  xmlns:pdfaExtension="http://www.aiim.org/pdfa/ns/extension/"
+  xmlns:pdfaSchema="http://www.aiim.org/pdfa/ns/schema#"
+  xmlns:pdfaProperty="http://www.aiim.org/pdfa/ns/property#"
+  xmlns:mail="` + mailNamespace + `">
+<pdfaid:part>{{.Part}}</pdfaid:part>
+<pdfaid:conformance>B</pdfaid:conformance>
+<dc:format>application/pdf</dc:format>
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">{{xml .Subject}}</rdf:li></rdf:Alt></dc:title>
+{{- if .From}}
+<dc:creator><rdf:Seq><rdf:li>{{xml .From}}</rdf:li></rdf:Seq></dc:creator>
+{{- end}}
+{{- if .Date}}
+<dc:date><rdf:Seq><rdf:li>{{.Date}}</rdf:li></rdf:Seq></dc:date>
+{{- end}}
+<xmp:CreateDate>{{.Written}}</xmp:CreateDate>
+<xmp:ModifyDate>{{.Written}}</xmp:ModifyDate>
+<xmp:CreatorTool>{{.Creator}}</xmp:CreatorTool>
+<pdf:Producer>{{.Producer}}</pdf:Producer>
+<mail:MessageID>{{xml .MessageID}}</mail:MessageID>
+<mail:Mailbox>{{xml .Mailbox}}</mail:Mailbox>
+<pdfaExtension:schemas><rdf:Bag><rdf:li rdf:parseType="Resource">
+<pdfaSchema:schema>Mail</pdfaSchema:schema>
+<pdfaSchema:namespaceURI>` + mailNamespace + `</pdfaSchema:namespaceURI>
+<pdfaSchema:prefix>mail</pdfaSchema:prefix>
+<pdfaSchema:property><rdf:Seq>
+<rdf:li rdf:parseType="Resource"><pdfaProperty:name>MessageID</pdfaProperty:name><pdfaProperty:valueType>Text</pdfaProperty:valueType><pdfaProperty:category>external</pdfaProperty:category><pdfaProperty:description>Message-ID of the mail</pdfaProperty:description></rdf:li>
+<rdf:li rdf:parseType="Resource"><pdfaProperty:name>Mailbox</pdfaProperty:name><pdfaProperty:valueType>Text</pdfaProperty:valueType><pdfaProperty:category>external</pdfaProperty:category><pdfaProperty:description>Mailbox the mail was downloaded from</pdfaProperty:description></rdf:li>
+</rdf:Seq></pdfaSchema:property>
+</rdf:li></rdf:Bag></pdfaExtension:schemas>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`))
+
+// xmpDateLayout always has the same length, unlike RFC 3339 which writes Z
+// for UTC
+const xmpDateLayout = "2006-01-02T15:04:05-07:00"
+
+// xmpWritten stands in for the time of writing, which pdfcpu stamps into the
+// document information while writing. It's replaced in the written file by a
+// date of the same length, so no offsets change.
+var xmpWritten = []byte("0000-00-00T00:00:00+00:00")
+
+// pdfaPart matches the PDF/A part in XMP metadata, which may be written as
+// element or attribute
+var pdfaPart = regexp.MustCompile(`pdfaid:part(?:>|\s*=\s*["'])\s*([1-4])`)
+
+// xmpData is passed to the XMP template
+type xmpData struct {
+	Part      int
+	Subject   string
+	From      string
+	Date      string
+	Written   string
+	Creator   string
+	Producer  string
+	MessageID string
+	Mailbox   string
+}
+
+func xmlEscape(s string) string {
+	buf := new(bytes.Buffer)
+	_ = xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// embedEml attaches the raw mail as source of the document
+func (mail *mail) embedEml(ctx *model.Context) error {
+	if mail.Raw == nil {
+		return nil
+	}
+
+	name := fmt.Sprintf("%d.eml", mail.Uid)
+	spec, err := ctx.NewFileSpecDictForAttachment(model.Attachment{
+		Reader:  bytes.NewReader(mail.Raw),
+		ID:      name,
+		Desc:    "Original mail",
+		ModTime: &mail.Date,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to embed mail: %w", err)
+	}
+
+	// PDF/A-3 requires the mimetype and the relationship to the document
+	spec.InsertName("AFRelationship", "Source")
+	if stream, _, err := ctx.DereferenceStreamDict(spec.DictEntry("EF")["F"]); err == nil && stream != nil {
+		stream.InsertName("Subtype", "message/rfc822")
+	}
+
+	ref, err := ctx.IndRefForNewObject(spec)
+	if err != nil {
+		return fmt.Errorf("failed to embed mail: %w", err)
+	}
+
+	if err := ctx.LocateNameTree("EmbeddedFiles", true); err != nil {
+		return fmt.Errorf("failed to embed mail: %w", err)
+	}
+	if err := ctx.Names["EmbeddedFiles"].Add(ctx.XRefTable, name, *ref, model.NameMap{name: []types.Dict{spec}}, []string{"F", "UF"}); err != nil {
+		return fmt.Errorf("failed to embed mail: %w", err)
+	}
+
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return err
+	}
+	catalog["AF"] = types.Array{*ref}
+
+	return nil
+}
+
+// archival adds the metadata and output intent required for the configured
+// PDF/A part with conformance level B. The dates of the document are the time
+// of writing, which setXmpDates copies from the document information, the
+// mail date is dc:date.
+func (mail *mail) archival(ctx *model.Context, config *Config, info map[string]string) error {
+	date := ""
+	if !mail.Date.IsZero() {
+		date = mail.Date.Format(time.RFC3339)
+	}
+
+	// Info and XMP only match if there is a single creator
+	from := strings.Join(formatAddresses(mail.From), ", ")
+	data := &xmpData{
+		Part:      config.pdfaPart(),
+		Subject:   mail.Subject,
+		From:      from,
+		Date:      date,
+		Written:   string(xmpWritten),
+		Creator:   pdfCreator,
+		Producer:  "pdfcpu " + model.VersionStr,
+		MessageID: mail.MessageID,
+		Mailbox:   mail.Mailbox,
+	}
+
+	xmp := new(bytes.Buffer)
+	if err := xmpTemplate.Execute(xmp, data); err != nil {
+		return fmt.Errorf("failed to render XMP metadata: %w", err)
+	}
+
+	// The document information must match the XMP metadata
+	info["Creator"] = pdfCreator
+	if from != "" {
+		info["Author"] = from
+	}
+
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return err
+	}
+
+	// Metadata stays uncompressed so it can be found without parsing the file
+	metadata := types.NewStreamDict(types.Dict{"Type": types.Name("Metadata"), "Subtype": types.Name("XML")}, 0, nil, nil, nil)
+	metadata.Content = xmp.Bytes()
+	if err := metadata.Encode(); err != nil {
+		return err
+	}
+
+	ref, err := ctx.IndRefForNewObject(metadata)
+	if err != nil {
+		return err
+	}
+	catalog["Metadata"] = *ref
+
+	profile, err := ctx.NewStreamDictForBuf(srgbProfile())
+	if err != nil {
+		return err
+	}
+	profile.InsertInt("N", 3)
+	if err := profile.Encode(); err != nil {
+		return err
+	}
+
+	profileRef, err := ctx.IndRefForNewObject(*profile)
+	if err != nil {
+		return err
+	}
+
+	intent, err := ctx.IndRefForNewObject(types.Dict{
+		"Type":                      types.Name("OutputIntent"),
+		"S":                         types.Name("GTS_PDFA1"),
+		"OutputConditionIdentifier": types.StringLiteral("sRGB IEC61966-2.1"),
+		"Info":                      types.StringLiteral("sRGB IEC61966-2.1"),
+		"DestOutputProfile":         *profileRef,
+	})
+	if err != nil {
+		return err
+	}
+	catalog["OutputIntents"] = types.Array{*intent}
+
+	return printAnnotations(ctx)
+}
+
+// setXmpDates replaces the placeholders of archival in the written document
+// by the date pdfcpu stamped into the document information
+func setXmpDates(ctx *model.Context, data []byte) error {
+	if ctx.Info == nil {
+		return errors.New("missing document information")
+	}
+
+	info, err := ctx.DereferenceDict(*ctx.Info)
+	if err != nil {
+		return err
+	}
+
+	created, ok := info["CreationDate"].(types.StringLiteral)
+	if !ok {
+		return errors.New("missing creation date")
+	}
+
+	written, ok := types.DateTime(created.Value(), false)
+	if !ok {
+		return fmt.Errorf("invalid creation date: %s", created.Value())
+	}
+
+	// CreateDate and ModifyDate
+	if n := bytes.Count(data, xmpWritten); n != 2 {
+		return fmt.Errorf("found %d XMP date placeholders instead of 2", n)
+	}
+
+	date := []byte(written.Format(xmpDateLayout))
+	for i := bytes.Index(data, xmpWritten); i >= 0; i = bytes.Index(data, xmpWritten) {
+		copy(data[i:], date)
+	}
+
+	return nil
+}
+
+// checkPdfA refuses documents which can't be appended to a PDF/A file. They
+// must declare PDF/A conformance and may not embed files, which would lack
+// the relationship PDF/A-3 requires.
+func checkPdfA(ctx *model.Context) error {
+	catalog, err := ctx.Catalog()
+	if err != nil {
+		return err
+	}
+
+	if names := catalog.DictEntry("Names"); names != nil && names["EmbeddedFiles"] != nil {
+		return errors.New("PDF/A attachments with embedded files are not supported")
+	}
+
+	metadata, _, err := ctx.DereferenceStreamDict(catalog["Metadata"])
+	if err != nil {
+		return err
+	}
+	if metadata != nil {
+		if err := metadata.Decode(); err != nil {
+			return err
+		}
+		if pdfaPart.Match(metadata.Content) {
+			return nil
+		}
+	}
+
+	return errors.New("not a PDF/A file")
+}
+
+// printAnnotations makes all annotations visible and printable, which PDF/A
+// requires
+func printAnnotations(ctx *model.Context) error {
+	for i := 1; i <= ctx.PageCount; i++ {
+		page, _, _, err := ctx.PageDict(i, false)
+		if err != nil {
+			return err
+		}
+
+		annots, err := ctx.DereferenceArray(page["Annots"])
+		if err != nil {
+			return err
+		}
+
+		for _, annot := range annots {
+			dict, err := ctx.DereferenceDict(annot)
+			if err != nil || dict == nil {
+				continue
+			}
+
+			flags := 0
+			if f := dict.IntEntry("F"); f != nil {
+				flags = *f
+			}
+			dict["F"] = types.Integer(flags&^(1|2|32) | 4)
+		}
+	}
+
+	return nil
+}
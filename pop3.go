@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pop3 is a minimal POP3 client (RFC 1939) with STLS (RFC 2595)
+type pop3 struct {
+	Username string
+	Password string
+	Server   string
+	Port     string
+	// Security is tls (default), starttls or none
+	Security string
+	conn     *textproto.Conn
+	// tlsConfig overrides the default TLS settings
+	tlsConfig *tls.Config
+}
+
+func (p *pop3) config() *tls.Config {
+	if p.tlsConfig != nil {
+		return p.tlsConfig
+	}
+
+	return &tls.Config{ServerName: p.Server}
+}
+
+func (p *pop3) connect(ctx context.Context) error {
+	address := net.JoinHostPort(p.Server, p.Port)
+	dialer := new(net.Dialer)
+
+	var conn net.Conn
+	var err error
+	switch p.Security {
+	case "", "tls":
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: p.config()}).DialContext(ctx, "tcp", address)
+	case "starttls", "none":
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	default:
+		return &ConnectionError{Op: "connect", Err: fmt.Errorf("unknown security: %s", p.Security)}
+	}
+	if err != nil {
+		return &ConnectionError{Op: "connect", Err: err}
+	}
+
+	p.conn = textproto.NewConn(conn)
+	if _, err := p.response(); err != nil {
+		p.conn.Close()
+		return &ConnectionError{Op: "greeting", Err: err}
+	}
+
+	if p.Security != "starttls" {
+		return nil
+	}
+
+	if _, err := p.cmd("STLS"); err != nil {
+		p.conn.Close()
+		return &ConnectionError{Op: "starttls", Err: err}
+	}
+
+	secure := tls.Client(conn, p.config())
+	if err := secure.HandshakeContext(ctx); err != nil {
+		p.conn.Close()
+		return &ConnectionError{Op: "starttls", Err: err}
+	}
+
+	p.conn = textproto.NewConn(secure)
+	return nil
+}
+
+func (p *pop3) login(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := p.cmd("USER %s", p.Username); err != nil {
+		return &ConnectionError{Op: "login", Err: err}
+	}
+
+	if _, err := p.cmd("PASS %s", p.Password); err != nil {
+		return &ConnectionError{Op: "login", Err: err}
+	}
+
+	return nil
+}
+
+// response reads a status line and returns the text after +OK
+func (p *pop3) response() (string, error) {
+	line, err := p.conn.ReadLine()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	default:
+		return "", fmt.Errorf("unexpected response: %s", line)
+	}
+}
+
+func (p *pop3) cmd(format string, args ...any) (string, error) {
+	if err := p.conn.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+
+	return p.response()
+}
+
+// uidl returns the unique ids of all messages by message number
+func (p *pop3) uidl() (map[int]string, error) {
+	if _, err := p.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+
+	lines, err := p.conn.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	uidls := make(map[int]string, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid UIDL line: %s", line)
+		}
+
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UIDL line: %s", line)
+		}
+		uidls[number] = fields[1]
+	}
+
+	return uidls, nil
+}
+
+// top returns the header of a message
+func (p *pop3) top(number int) ([]byte, error) {
+	if _, err := p.cmd("TOP %d 0", number); err != nil {
+		return nil, err
+	}
+
+	return p.conn.ReadDotBytes()
+}
+
+func (p *pop3) retr(number int) ([]byte, error) {
+	if _, err := p.cmd("RETR %d", number); err != nil {
+		return nil, err
+	}
+
+	return p.conn.ReadDotBytes()
+}
+
+func (p *pop3) dele(number int) error {
+	_, err := p.cmd("DELE %d", number)
+	return err
+}
+
+// quit ends the session, the server removes deleted messages
+func (p *pop3) quit() error {
+	if p.conn == nil {
+		return nil
+	}
+
+	_, err := p.cmd("QUIT")
+	p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// pop3Message is a message of the current session
+type pop3Message struct {
+	number int
+	uidl   string
+}
+
+// pop3Source reads new messages from a POP3 maildrop. Uids are assigned from
+// the metadata and stay the same for a UIDL, so known messages are skipped.
+type pop3Source struct {
+	*pop3
+	leaveOnServer bool
+	known         map[string]uint32
+	last          uint32
+	messages      map[uint32]pop3Message
+}
+
+func newPop3Source(config *Config) *pop3Source {
+	return &pop3Source{
+		pop3: &pop3{
+			Username: config.Pop3.Username,
+			Password: config.Pop3.Password,
+			Server:   config.Pop3.Server,
+			Port:     config.Pop3.Port,
+			Security: config.Pop3.Security,
+		},
+		leaveOnServer: config.Pop3.LeaveOnServer,
+		known:         make(map[string]uint32),
+		messages:      make(map[uint32]pop3Message),
+	}
+}
+
+func (s *pop3Source) Open(ctx context.Context) error {
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+
+	return s.login(ctx)
+}
+
+func (s *pop3Source) Track(mailList *mailList) {
+	s.known, s.last = mailList.remoteIDs()
+}
+
+// Search returns the unknown messages. POP3 has no dates, so they are taken
+// from the Date header, messages without one are always included.
+func (s *pop3Source) Search(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uidls, err := s.uidl()
+	if err != nil {
+		return nil, &ConnectionError{Op: "uidl", Err: err}
+	}
+
+	numbers := make([]int, 0, len(uidls))
+	for number := range uidls {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	uids := make([]uint32, 0)
+	for _, number := range numbers {
+		if _, ok := s.known[uidls[number]]; ok {
+			continue
+		}
+
+		header, err := s.top(number)
+		if err != nil {
+			return nil, &ConnectionError{Op: "top", Err: err}
+		}
+
+		if date := headerDate(bytes.NewReader(header)); !date.IsZero() && (date.Before(from) || !date.Before(to)) {
+			continue
+		}
+
+		s.last++
+		s.messages[s.last] = pop3Message{number: number, uidl: uidls[number]}
+		uids = append(uids, s.last)
+	}
+
+	return uids, nil
+}
+
+// Fetch downloads the messages, they are deleted by Commit
+func (s *pop3Source) Fetch(ctx context.Context, uids []uint32, mailsChan chan *mail) error {
+	for _, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		message, ok := s.messages[uid]
+		if !ok {
+			mailsChan <- &mail{Uid: uid, Error: &MessageError{Uid: uid, Op: "read body", Err: errors.New("unknown uid")}}
+			continue
+		}
+
+		raw, err := s.retr(message.number)
+		if err != nil {
+			return &ConnectionError{Op: "retr", Err: err}
+		}
+
+		mail := &mail{Uid: uid, Mailbox: "INBOX", RemoteID: message.uidl}
+		mail.load(raw)
+		mailsChan <- mail
+	}
+
+	return nil
+}
+
+// Retry looks up the failed mails by their UIDL
+func (s *pop3Source) Retry(ctx context.Context, mailbox string, failures []failedMail) ([]uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	uidls, err := s.uidl()
+	if err != nil {
+		return nil, &ConnectionError{Op: "uidl", Err: err}
+	}
+
+	numbers := make(map[string]int, len(uidls))
+	for number, uidl := range uidls {
+		numbers[uidl] = number
+	}
+
+	uids := make([]uint32, 0, len(failures))
+	for _, failure := range failures {
+		number, ok := numbers[failure.RemoteID]
+		if !ok {
+			continue
+		}
+
+		s.messages[failure.Uid] = pop3Message{number: number, uidl: failure.RemoteID}
+		uids = append(uids, failure.Uid)
+	}
+
+	return uids, nil
+}
+
+// Commit deletes the processed messages unless they are left on the server.
+// Messages processed by an interrupted run are deleted as well, failed ones
+// stay until they were retried.
+func (s *pop3Source) Commit(ctx context.Context, mailList *mailList) error {
+	if s.leaveOnServer {
+		return nil
+	}
+
+	handled := make(map[string]bool)
+	for _, uidl := range mailList.handled("") {
+		handled[uidl] = true
+	}
+
+	// Fetching closed the session, the server only deletes messages on QUIT
+	if s.conn == nil {
+		if err := s.Open(ctx); err != nil {
+			return err
+		}
+	}
+
+	uidls, err := s.uidl()
+	if err != nil {
+		return &ConnectionError{Op: "uidl", Err: err}
+	}
+
+	for number, uidl := range uidls {
+		if !handled[uidl] {
+			continue
+		}
+
+		if err := s.dele(number); err != nil {
+			return &ConnectionError{Op: "dele", Err: err}
+		}
+	}
+
+	if err := s.quit(); err != nil {
+		return &ConnectionError{Op: "quit", Err: err}
+	}
+
+	return nil
+}
+
+func (s *pop3Source) Close() error {
+	return s.quit()
+}
+
+func (s *pop3Source) Vendor() string {
+	return "pop3"
+}
+
+func (s *pop3Source) Server() string {
+	return s.pop3.Server
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pop3Server is an in-process POP3 server with STLS support
+type pop3Server struct {
+	listener net.Listener
+	tls      *tls.Config
+	mutex    sync.Mutex
+	uidls    []string
+	messages map[string]string
+}
+
+func newPop3Server(t *testing.T) (*pop3Server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	server := &pop3Server{
+		listener: listener,
+		tls:      &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		messages: make(map[string]string),
+	}
+	go server.serve()
+
+	return server, pool
+}
+
+func (s *pop3Server) add(uidl, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.uidls = append(s.uidls, uidl)
+	s.messages[uidl] = message
+}
+
+func (s *pop3Server) port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *pop3Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *pop3Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	s.mutex.Lock()
+	maildrop := append([]string(nil), s.uidls...)
+	s.mutex.Unlock()
+
+	deleted := make(map[int]bool)
+	text := textproto.NewConn(conn)
+	text.PrintfLine("+OK ready")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		number := 0
+		if len(fields) > 1 {
+			number, _ = strconv.Atoi(fields[1])
+		}
+		if number > len(maildrop) {
+			text.PrintfLine("-ERR no such message")
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "STLS":
+			text.PrintfLine("+OK begin TLS")
+			secure := tls.Server(conn, s.tls)
+			if err := secure.Handshake(); err != nil {
+				return
+			}
+			text = textproto.NewConn(secure)
+		case "USER", "NOOP":
+			text.PrintfLine("+OK")
+		case "PASS":
+			if fields[1] != "secret" {
+				text.PrintfLine("-ERR invalid password")
+				continue
+			}
+			text.PrintfLine("+OK logged in")
+		case "UIDL":
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			for n, uidl := range maildrop {
+				if !deleted[n+1] {
+					w.Write([]byte(strconv.Itoa(n+1) + " " + uidl + "\n"))
+				}
+			}
+			w.Close()
+		case "TOP", "RETR":
+			s.mutex.Lock()
+			message := s.messages[maildrop[number-1]]
+			s.mutex.Unlock()
+			if fields[0] == "TOP" {
+				message, _, _ = strings.Cut(message, "\r\n\r\n")
+				message += "\r\n\r\n"
+			}
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			w.Write([]byte(message))
+			w.Close()
+		case "DELE":
+			deleted[number] = true
+			text.PrintfLine("+OK deleted")
+		case "RSET":
+			deleted = make(map[int]bool)
+			text.PrintfLine("+OK")
+		case "QUIT":
+			s.mutex.Lock()
+			kept := make([]string, 0)
+			for n, uidl := range maildrop {
+				if !deleted[n+1] {
+					kept = append(kept, uidl)
+				}
+			}
+			s.uidls = kept
+			s.mutex.Unlock()
+			text.PrintfLine("+OK bye")
+			return
+		default:
+			text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func fetchPop3(t *testing.T, server *pop3Server, source *pop3Source, mailList *mailList) []*mail {
+	ctx := context.Background()
+	server.mutex.Lock()
+	count := len(server.uidls)
+	server.mutex.Unlock()
+
+	assert.NoError(t, source.Open(ctx))
+	source.Track(mailList)
+
+	uids, err := source.Search(ctx, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+
+	mailsChan := make(chan *mail, len(uids))
+	assert.NoError(t, source.Fetch(ctx, uids, mailsChan))
+	close(mailsChan)
+	assert.NoError(t, source.Close())
+
+	// Nothing is deleted before the mails were processed
+	server.mutex.Lock()
+	assert.Equal(t, count, len(server.uidls))
+	server.mutex.Unlock()
+
+	mails := make([]*mail, 0)
+	for mail := range mailsChan {
+		assert.NoError(t, mail.Error)
+		// Mails whose handlers fail stay on the server
+		if mail.Subject == "Broken" {
+			assert.NoError(t, mailList.addFailure(ctx, mail, errors.New("failed"), ""))
+		} else {
+			assert.NoError(t, mailList.addMail(ctx, mail))
+		}
+		mails = append(mails, mail)
+	}
+
+	assert.NoError(t, source.Commit(ctx, mailList))
+	return mails
+}
+
+func TestPop3Source(t *testing.T) {
+	server, pool := newPop3Server(t)
+	server.add("a", "From: shop@example.com\r\nSubject: Invoice\r\nDate: Fri, 01 Mar 2024 10:00:00 +0000\r\n\r\nTotal\r\n.\r\n")
+	server.add("b", "From: shop@example.com\r\nSubject: Old\r\nDate: Fri, 01 Mar 2019 10:00:00 +0000\r\n\r\nold\r\n")
+	server.add("c", "From: shop@example.com\r\nSubject: Undated\r\n\r\nundated\r\n")
+	server.add("e", "From: shop@example.com\r\nSubject: Broken\r\n\r\nbroken\r\n")
+
+	config := new(Config)
+	config.Pop3.Server = "127.0.0.1"
+	config.Pop3.Port = server.port()
+	config.Pop3.Username = "user"
+	config.Pop3.Password = "secret"
+	config.Pop3.Security = "starttls"
+
+	mailList, err := newMailList(newLocalStorage(t.TempDir()), "user", "pop3", "127.0.0.1", "mail/user")
+	assert.NoError(t, err)
+
+	source := newPop3Source(config)
+	source.tlsConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	mails := fetchPop3(t, server, source, mailList)
+
+	assert.Len(t, mails, 3)
+	assert.Equal(t, uint32(1), mails[0].Uid)
+	assert.Equal(t, "a", mails[0].RemoteID)
+	assert.Equal(t, "Invoice", mails[0].Subject)
+	assert.Equal(t, "Total\n.\n", string(mails[0].Body[0]))
+	assert.Equal(t, "c", mails[1].RemoteID)
+
+	// Processed mails were deleted, the old and the failed one are still there
+	assert.Equal(t, []string{"b", "e"}, server.uidls)
+
+	// Known mails are skipped and new ones continue the uids
+	server.add("d", "From: shop@example.com\r\nSubject: New\r\n\r\nnew\r\n")
+	server.add("a", server.messages["a"])
+	config.Pop3.LeaveOnServer = true
+	source = newPop3Source(config)
+	source.tlsConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	mails = fetchPop3(t, server, source, mailList)
+
+	assert.Len(t, mails, 1)
+	assert.Equal(t, uint32(4), mails[0].Uid)
+	assert.Equal(t, "d", mails[0].RemoteID)
+	assert.Equal(t, []string{"b", "e", "d", "a"}, server.uidls)
+
+	source = newPop3Source(config)
+	source.Password = "wrong"
+	source.Security = "none"
+	assert.ErrorContains(t, source.Open(context.Background()), "invalid password")
+}
+
+func TestPop3Retry(t *testing.T) {
+	server, _ := newPop3Server(t)
+	server.add("a", "From: shop@example.com\r\nSubject: Invoice\r\nDate: Fri, 01 Mar 2024 10:00:00 +0000\r\n\r\nTotal\r\n")
+
+	config := new(Config)
+	config.Source.Type = "pop3"
+	config.Storage.Path = t.TempDir()
+	config.Pop3.Server = "127.0.0.1"
+	config.Pop3.Port = server.port()
+	config.Pop3.Username = "user"
+	config.Pop3.Password = "secret"
+	config.Pop3.Security = "none"
+
+	ctx := context.Background()
+	storage := newLocalStorage(config.Storage.Path)
+	mailList, err := newMailList(storage, "user", "pop3", "127.0.0.1", "mail/user")
+	assert.NoError(t, err)
+	assert.NoError(t, mailList.addFailure(ctx, &mail{Uid: 5, Mailbox: "INBOX", RemoteID: "a"}, errors.New("failed"), ""))
+	assert.NoError(t, mailList.addFailure(ctx, &mail{Uid: 6, Mailbox: "INBOX", RemoteID: "gone"}, errors.New("failed"), ""))
+	assert.NoError(t, mailList.flush())
+
+	// Failed mails are fetched again from the POP3 server by their UIDL
+	report := newErrorReport()
+	assert.NoError(t, retryMails(ctx, config, report))
+	assert.Equal(t, 1, report.len())
+
+	mailList, err = newMailList(storage, "user", "pop3", "127.0.0.1", "mail/user")
+	assert.NoError(t, err)
+	assert.Len(t, mailList.List, 1)
+	assert.Equal(t, uint32(5), mailList.List[0].Uid)
+	assert.Equal(t, "a", mailList.List[0].RemoteID)
+
+	// The retried mail was deleted once it was processed
+	assert.Empty(t, server.uidls)
+
+	failures := mailList.failures()
+	assert.Len(t, failures, 1)
+	assert.Equal(t, uint32(6), failures[0].Uid)
+	assert.Equal(t, errMailGone.Error(), failures[0].Error)
+	assert.Equal(t, "gone", failures[0].RemoteID)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+)
+
+var errMailGone = errors.New("message no longer exists on the server")
+
+// quarantinePath returns where the raw source of a failed mail is saved in
+// the storage
+func quarantinePath(username string, mail *mail) string {
+	return path.Join("quarantine", username, sanitizeSubject(mail.Mailbox), fmt.Sprintf("%d.eml", mail.Uid))
+}
+
+// recordResult updates the metadata of mail after processing. It quarantines
+// mail when processing failed and releases it once it succeeded.
+func recordResult(ctx context.Context, username string, mailList *mailList, mail *mail, result error) error {
+	// Only processed mails are listed, handlers record saved files, e.g.
+	// files extracted from archives
+	if result == nil {
+		if err := mailList.addMail(ctx, mail); err != nil {
+			return err
+		}
+
+		failure, err := mailList.removeFailure(ctx, mail)
+		if err != nil {
+			return err
+		}
+
+		if failure != nil && failure.RawPath != "" {
+			if err := mailList.storage.Remove(ctx, failure.RawPath); err != nil {
+				return fmt.Errorf("failed to remove quarantined mail: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	rawPath := ""
+	if len(mail.Raw) > 0 {
+		rawPath = quarantinePath(username, mail)
+
+		if err := mailList.storage.Write(ctx, rawPath, mail.Raw); err != nil {
+			return fmt.Errorf("failed to write quarantined mail: %w", err)
+		}
+	}
+
+	return mailList.addFailure(ctx, mail, result, rawPath)
+}
+
+func runRetry(args []string) {
+	// flags
+	flags := flag.NewFlagSet("retry", flag.ExitOnError)
+	configPath := flags.String("config", "", "config path")
+	_ = flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	new(imap).enableCharsetReader()
+
+	ctx, stop := signalContext()
+	report := newErrorReport()
+	err = retryMails(ctx, config, report)
+	stop()
+
+	report.write(os.Stderr)
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Interrupted")
+		os.Exit(exitInterrupted)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if report.len() > 0 {
+		os.Exit(exitMessagesFailed)
+	}
+
+	// done
+	fmt.Println("Done")
+}
+
+// retryMails fetches the failed mails recorded in the metadata again from the
+// configured source and processes them
+func retryMails(ctx context.Context, config *Config, report *errorReport) error {
+	source, err := newSource(config)
+	if err != nil {
+		return err
+	}
+
+	storage, err := newStorage(config)
+	if err != nil {
+		return err
+	}
+	defer closeStorage(storage)
+
+	// Create mail list for metadata tracking
+	username := config.account()
+	mailRoot := fmt.Sprintf("mail/%s", username)
+	mailList, err := newMailList(storage, username, source.Vendor(), source.Server(), mailRoot)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := mailList.flush(); err != nil {
+			log.Printf("Failed to save metadata: %v", err)
+		}
+	}()
+
+	index, err := loadMessageIndex(config, storage)
+	if err != nil {
+		return err
+	}
+
+	defer saveMessageIndex(index)
+
+	// group failures by mailbox
+	failures := make(map[string][]failedMail)
+	mailboxes := make([]string, 0)
+	for _, failure := range mailList.failures() {
+		if _, ok := failures[failure.Mailbox]; !ok {
+			mailboxes = append(mailboxes, failure.Mailbox)
+		}
+		failures[failure.Mailbox] = append(failures[failure.Mailbox], failure)
+	}
+
+	if len(mailboxes) == 0 {
+		fmt.Println("No failed messages")
+		return nil
+	}
+
+	defer func() {
+		if err := source.Close(); err != nil {
+			log.Printf("Failed to close source: %v", err)
+		}
+	}()
+
+	if err := source.Open(ctx); err != nil {
+		return err
+	}
+
+	handlers, err := newHandlers(config, storage, mailList)
+	if err != nil {
+		return err
+	}
+
+	for _, mailbox := range mailboxes {
+		if err := retryMailbox(ctx, config, source, mailbox, failures[mailbox], handlers, index, mailList, report); err != nil {
+			return err
+		}
+	}
+
+	if committing, ok := source.(committingSource); ok {
+		return committing.Commit(ctx, mailList)
+	}
+
+	return nil
+}
+
+func retryMailbox(
+	ctx context.Context,
+	config *Config,
+	source Source,
+	mailbox string,
+	failures []failedMail,
+	handlers []MailHandler,
+	index *messageIndex,
+	mailList *mailList,
+	report *errorReport,
+) error {
+	log.Printf("Retrying %d messages in %s", len(failures), mailbox)
+
+	uids, err := source.Retry(ctx, mailbox, failures)
+	if err != nil {
+		return err
+	}
+
+	// channel
+	mailsChan := make(chan *mail)
+	fetchErr := make(chan error, 1)
+
+	go func() {
+		fetchErr <- source.Fetch(ctx, uids, mailsChan)
+		close(mailsChan)
+	}()
+
+	seen := make(map[uint32]bool)
+	for mail := range mailsChan {
+		seen[mail.Uid] = true
+
+		err := processMail(ctx, config, handlers, index, mail)
+		if err != nil {
+			report.add(mail, err)
+		}
+
+		if err := recordResult(ctx, config.account(), mailList, mail, err); err != nil {
+			log.Printf("Failed to update metadata for mail %d: %v", mail.Uid, err)
+		}
+	}
+
+	if err := <-fetchErr; err != nil {
+		return err
+	}
+
+	// Messages deleted upstream stay in the failures until they are cleaned up manually
+	for _, failure := range failures {
+		if seen[failure.Uid] {
+			continue
+		}
+
+		mail := &mail{Uid: failure.Uid, Mailbox: failure.Mailbox, Subject: failure.Subject, RemoteID: failure.RemoteID}
+		report.add(mail, errMailGone)
+
+		if err := mailList.addFailure(ctx, mail, errMailGone, ""); err != nil {
+			log.Printf("Failed to update metadata for mail %d: %v", mail.Uid, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordResult(t *testing.T) {
+	storage := newLocalStorage(t.TempDir())
+	ctx := context.Background()
+
+	mailList, err := newMailList(storage, "user", "imap", "localhost", "mail/user")
+	assert.NoError(t, err)
+
+	// The raw source of failed mails is saved in the storage
+	failed := &mail{Uid: 3, Mailbox: "INBOX", Raw: []byte("Subject: Invoice\r\n\r\nbody")}
+	assert.NoError(t, recordResult(ctx, "user", mailList, failed, errors.New("failed")))
+	assert.Len(t, mailList.Failures, 1)
+	assert.Equal(t, "quarantine/user/INBOX/3.eml", mailList.Failures[0].RawPath)
+
+	data, err := storage.Read(ctx, "quarantine/user/INBOX/3.eml")
+	assert.NoError(t, err)
+	assert.Equal(t, failed.Raw, data)
+
+	// and removed once it succeeded
+	assert.NoError(t, recordResult(ctx, "user", mailList, failed, nil))
+	assert.Empty(t, mailList.Failures)
+
+	_, err = storage.Read(ctx, "quarantine/user/INBOX/3.eml")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Renderer converts html pages into a single PDF document. Every page starts
+// on a new sheet. Pages have already been sanitized, so renderers must not
+// load local files or run scripts.
+type Renderer interface {
+	Render(ctx context.Context, pages [][]byte, options *PageOptions) ([]byte, error)
+}
+
+// PageOptions describe the sheets of a generated PDF
+type PageOptions struct {
+	Size      string // A3, A4, A5, Letter or Legal
+	Landscape bool
+	Margins   Margins
+	Width     float64 // millimeters, derived from Size and Landscape
+	Height    float64
+}
+
+// paperSizes in millimeters, portrait
+var paperSizes = map[string][2]float64{
+	"A3":     {297, 420},
+	"A4":     {210, 297},
+	"A5":     {148, 210},
+	"Letter": {215.9, 279.4},
+	"Legal":  {215.9, 355.6},
+}
+
+// defaultMargin is used for all sides when no margins are configured
+const defaultMargin = 10
+
+func newPageOptions(config *Config) (*PageOptions, error) {
+	options := &PageOptions{Size: "A4"}
+
+	if size := config.Pdf.PageSize; size != "" {
+		options.Size = ""
+		for name := range paperSizes {
+			if strings.EqualFold(name, size) {
+				options.Size = name
+			}
+		}
+		if options.Size == "" {
+			return nil, fmt.Errorf("unknown page size: %s", size)
+		}
+	}
+
+	switch strings.ToLower(config.Pdf.Orientation) {
+	case "", "portrait":
+	case "landscape":
+		options.Landscape = true
+	default:
+		return nil, fmt.Errorf("unknown orientation: %s", config.Pdf.Orientation)
+	}
+
+	options.Margins = Margins{Top: defaultMargin, Right: defaultMargin, Bottom: defaultMargin, Left: defaultMargin}
+	if config.Pdf.Margins != nil {
+		options.Margins = *config.Pdf.Margins
+	}
+
+	size := paperSizes[options.Size]
+	options.Width, options.Height = size[0], size[1]
+	if options.Landscape {
+		options.Width, options.Height = options.Height, options.Width
+	}
+
+	return options, nil
+}
+
+// newRenderer returns the renderer selected in the config, wkhtmltopdf by default
+func newRenderer(config *Config) (Renderer, error) {
+	switch strings.ToLower(config.Pdf.Renderer) {
+	case "", "wkhtmltopdf":
+		return &wkhtmltopdfRenderer{allowedHosts: config.Mails.RemoteHosts}, nil
+	case "chromium":
+		return &chromiumRenderer{
+			path: config.Pdf.Chromium.Path,
+			url:  config.Pdf.Chromium.URL,
+
+			allowedHosts: config.Mails.RemoteHosts,
+		}, nil
+	case "native":
+		// The standard PDF fonts aren't embedded, which PDF/A requires
+		if config.Pdf.PdfA {
+			return nil, errors.New("the native pdf renderer can't write PDF/A")
+		}
+		return new(nativeRenderer), nil
+	default:
+		return nil, fmt.Errorf("unknown pdf renderer: %s", config.Pdf.Renderer)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestNewPageOptions(t *testing.T) {
+	config := new(Config)
+
+	options, err := newPageOptions(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "A4", options.Size)
+	assert.Equal(t, 210.0, options.Width)
+	assert.Equal(t, Margins{Top: 10, Right: 10, Bottom: 10, Left: 10}, options.Margins)
+
+	config.Pdf.PageSize = "letter"
+	config.Pdf.Orientation = "landscape"
+	config.Pdf.Margins = &Margins{Top: 5}
+
+	options, err = newPageOptions(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "Letter", options.Size)
+	assert.Equal(t, 279.4, options.Width)
+	assert.Equal(t, 215.9, options.Height)
+	assert.Equal(t, Margins{Top: 5}, options.Margins)
+
+	config.Pdf.PageSize = "B5"
+	_, err = newPageOptions(config)
+	assert.Error(t, err)
+}
+
+func TestNewRenderer(t *testing.T) {
+	config := new(Config)
+
+	renderer, err := newRenderer(config)
+	assert.NoError(t, err)
+	assert.IsType(t, new(wkhtmltopdfRenderer), renderer)
+
+	config.Pdf.Renderer = "native"
+	renderer, err = newRenderer(config)
+	assert.NoError(t, err)
+	assert.IsType(t, new(nativeRenderer), renderer)
+
+	config.Pdf.PdfA = true
+	_, err = newRenderer(config)
+	assert.ErrorContains(t, err, "PDF/A")
+
+	config.Pdf.Renderer = "prince"
+	_, err = newRenderer(config)
+	assert.Error(t, err)
+}
+
+func TestNativeRenderer(t *testing.T) {
+	options, err := newPageOptions(new(Config))
+	assert.NoError(t, err)
+
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+	pages := [][]byte{
+		[]byte(`<html><head><style>p { color: red }</style></head><body><h1>Invoice</h1><p>Total: <b>12,00 €</b></p>` +
+			`<ul><li>One</li><li>Two</li></ul><img src="data:image/png;base64,` + png + `"><img src="data:image/png;base64,broken"></body></html>`),
+		textToHtml([]byte("plain\ntext"), false, false),
+	}
+
+	pdf, err := new(nativeRenderer).Render(context.Background(), pages, options)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(pdf, []byte("%PDF-")))
+	assert.Equal(t, 2, bytes.Count(pdf, []byte("/Type /Page\n")))
+}
+
+func TestCombinePages(t *testing.T) {
+	html, err := combinePages([][]byte{
+		[]byte(`<html><head><style>a{}</style></head><body><p>one</p></body></html>`),
+		[]byte(`<html><head><title>x</title><style>b{}</style></head><body><p>two</p></body></html>`),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `<html><head><style>a{}</style><style>b{}</style></head><body><p>one</p>`+
+		`<div style="break-before: page"><p>two</p></div></body></html>`, string(html))
+}
+
+func TestChromiumRenderer(t *testing.T) {
+	printed := []byte("%PDF-1.4 fake")
+	var document string
+	fetched := map[string]string{}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/json/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"webSocketDebuggerUrl": "ws://` + r.Host + `/devtools/browser/1"}`))
+	})
+
+	mux.Handle("/devtools/browser/1", websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var request struct {
+				ID        int64          `json:"id"`
+				Method    string         `json:"method"`
+				SessionID string         `json:"sessionId"`
+				Params    map[string]any `json:"params"`
+			}
+			if err := websocket.JSON.Receive(conn, &request); err != nil {
+				return
+			}
+
+			result := map[string]any{}
+			switch request.Method {
+			case "Target.createTarget":
+				result["targetId"] = "target"
+			case "Target.attachToTarget":
+				result["sessionId"] = "session"
+			case "Page.getFrameTree":
+				result["frameTree"] = map[string]any{"frame": map[string]any{"id": "frame"}}
+			case "Fetch.enable":
+				assert.Equal(t, "session", request.SessionID)
+			case "Page.setDocumentContent":
+				document = request.Params["html"].(string)
+			case "Fetch.continueRequest", "Fetch.failRequest":
+				fetched[request.Params["requestId"].(string)] = request.Method
+			case "Page.printToPDF":
+				assert.Equal(t, "session", request.SessionID)
+				assert.InDelta(t, 8.27, request.Params["paperWidth"], 0.01)
+				result["data"] = base64.StdEncoding.EncodeToString(printed)
+			}
+
+			websocket.JSON.Send(conn, map[string]any{"id": request.ID, "result": result})
+
+			// The page loads once the renderer decided about its requests
+			switch {
+			case request.Method == "Page.setDocumentContent":
+				for id, url := range map[string]string{"1": "https://tracker.com/a.png", "2": "https://cdn.vendor.com/b.png", "3": "file:///etc/passwd"} {
+					websocket.JSON.Send(conn, map[string]any{
+						"method":    "Fetch.requestPaused",
+						"sessionId": "session",
+						"params":    map[string]any{"requestId": id, "request": map[string]any{"url": url}},
+					})
+				}
+			case strings.HasPrefix(request.Method, "Fetch.") && len(fetched) == 3:
+				websocket.JSON.Send(conn, map[string]any{"method": "Page.loadEventFired", "sessionId": "session"})
+			}
+		}
+	}))
+
+	options, err := newPageOptions(new(Config))
+	assert.NoError(t, err)
+
+	renderer := &chromiumRenderer{url: server.URL, allowedHosts: []string{"*.vendor.com"}}
+	pdf, err := renderer.Render(context.Background(), [][]byte{[]byte("<p>body</p>")}, options)
+	assert.NoError(t, err)
+	assert.Equal(t, printed, pdf)
+	assert.True(t, strings.Contains(document, "<p>body</p>"))
+	assert.Equal(t, map[string]string{"1": "Fetch.failRequest", "2": "Fetch.continueRequest", "3": "Fetch.failRequest"}, fetched)
+}
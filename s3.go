@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+const (
+	// defaultS3PartSize is the size of multipart upload parts, larger files
+	// are uploaded in parts
+	defaultS3PartSize = 16 << 20
+	// minS3PartSize is the smallest part size S3 accepts
+	minS3PartSize = 5 << 20
+	// s3Timeout limits a single upload or download including its retries
+	s3Timeout = 10 * time.Minute
+)
+
+// s3Storage writes to a bucket of an S3 compatible server, e.g. MinIO
+type s3Storage struct {
+	client     *minio.Client
+	bucket     string
+	prefix     string
+	partSize   uint64
+	encryption encrypt.ServerSide
+}
+
+func newS3Storage(config *Config) (*s3Storage, error) {
+	s3 := config.Storage.S3
+
+	endpoint, err := url.Parse(s3.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", s3.Endpoint)
+	}
+
+	if s3.Bucket == "" {
+		return nil, fmt.Errorf("missing s3 bucket")
+	}
+
+	partSize := s3.PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+	if partSize < minS3PartSize {
+		return nil, fmt.Errorf("s3 part size must be at least %d bytes", minS3PartSize)
+	}
+
+	region := s3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	lookup := minio.BucketLookupDNS
+	if s3.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	var encryption encrypt.ServerSide
+	switch s3.Encryption {
+	case "":
+	case "AES256":
+		encryption = encrypt.NewSSE()
+	case "aws:kms":
+		encryption, err = encrypt.NewSSEKMS(s3.KmsKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 kms key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown s3 encryption: %s", s3.Encryption)
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(s3.AccessKey, s3.SecretKey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+		Transport:    s3Transport(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	return &s3Storage{
+		client:     client,
+		bucket:     s3.Bucket,
+		prefix:     s3.Prefix,
+		partSize:   uint64(partSize),
+		encryption: encryption,
+	}, nil
+}
+
+// s3Transport fails requests to servers which stop responding
+func s3Transport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = time.Minute
+	// Objects are stored as they are, e.g. gzip files
+	transport.DisableCompression = true
+
+	return transport
+}
+
+func (s *s3Storage) Write(ctx context.Context, name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+
+	key := s.prefix + name
+	options := minio.PutObjectOptions{
+		ContentType:          mime.TypeByExtension(path.Ext(name)),
+		PartSize:             s.partSize,
+		SendContentMd5:       true,
+		ServerSideEncryption: s.encryption,
+	}
+
+	if _, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), options); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, s3Error(err))
+	}
+
+	return nil
+}
+
+func (s *s3Storage) Read(ctx context.Context, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+
+	object, err := s.client.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return data, nil
+}
+
+func (s *s3Storage) Remove(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, s3Timeout)
+	defer cancel()
+
+	// Deleting a missing object succeeds
+	if err := s.client.RemoveObject(ctx, s.bucket, s.prefix+name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", s.prefix+name, s3Error(err))
+	}
+
+	return nil
+}
+
+// s3Error wraps missing objects with fs.ErrNotExist
+func s3Error(err error) error {
+	if response := minio.ToErrorResponse(err); response.Code == "NoSuchKey" || response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func contentMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// s3Server is a path-style S3 stub for a single bucket
+type s3Server struct {
+	mutex      sync.Mutex
+	objects    map[string][]byte
+	encryption map[string]string
+	uploads    map[string]map[int][]byte
+	parts      int
+}
+
+func newS3Server() *s3Server {
+	return &s3Server{
+		objects:    make(map[string][]byte),
+		encryption: make(map[string]string),
+		uploads:    make(map[string]map[int][]byte),
+	}
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = decodeAwsChunked(body)
+	}
+	if md5 := r.Header.Get("Content-MD5"); md5 != "" && md5 != contentMD5(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "<Error><Code>BadDigest</Code><Message>Content-MD5 mismatch</Message></Error>")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet:
+		object, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>Not Found</Message></Error>")
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 04 Mar 2024 10:00:00 GMT")
+		w.Header().Set("ETag", `"`+contentMD5(object)+`"`)
+		w.Write(object)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][number] = body
+		s.parts++
+		w.Header().Set("ETag", `"`+contentMD5(body)+`"`)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		s.encryption[key] = r.Header.Get("X-Amz-Server-Side-Encryption")
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := "upload-" + key
+		s.uploads[id] = make(map[int][]byte)
+		s.encryption[key] = r.Header.Get("X-Amz-Server-Side-Encryption")
+		io.WriteString(w, "<InitiateMultipartUploadResult><UploadId>"+id+"</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []s3CompletedPart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		sort.Slice(complete.Parts, func(i, j int) bool { return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber })
+
+		object := make([]byte, 0)
+		for _, part := range complete.Parts {
+			object = append(object, s.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, query.Get("uploadId"))
+		io.WriteString(w, "<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>"+key+"</Key></CompleteMultipartUploadResult>")
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// decodeAwsChunked returns the payload of a body signed in chunks, which is
+// used for uploads without TLS
+func decodeAwsChunked(body []byte) []byte {
+	payload := make([]byte, 0, len(body))
+	for {
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return payload
+		}
+
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(size), 16, 64)
+		if err != nil || n == 0 || int64(len(rest)) < n {
+			return payload
+		}
+
+		payload = append(payload, rest[:n]...)
+		body = bytes.TrimPrefix(rest[n:], []byte("\r\n"))
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	stub := newS3Server()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	config := new(Config)
+	config.Storage.Type = "s3"
+	config.Storage.S3.Endpoint = server.URL
+	config.Storage.S3.Bucket = "bucket"
+	config.Storage.S3.Prefix = "archive/"
+	config.Storage.S3.AccessKey = "access"
+	config.Storage.S3.SecretKey = "secret"
+	config.Storage.S3.PathStyle = true
+	config.Storage.S3.PartSize = minS3PartSize
+	config.Storage.S3.Encryption = "AES256"
+
+	storage, err := newStorage(config)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, storage.Write(ctx, "mail/user/Invoice 1.pdf", []byte("pdf")))
+	assert.Equal(t, []byte("pdf"), stub.objects["archive/mail/user/Invoice 1.pdf"])
+	assert.Equal(t, "AES256", stub.encryption["archive/mail/user/Invoice 1.pdf"])
+	assert.Equal(t, 0, stub.parts)
+
+	// Files larger than the part size are uploaded in parts
+	big := bytes.Repeat([]byte("0123456789"), 2*minS3PartSize/10+1)
+	assert.NoError(t, storage.Write(ctx, "mail/user/archive.zip", big))
+	assert.Equal(t, big, stub.objects["archive/mail/user/archive.zip"])
+	assert.Equal(t, "AES256", stub.encryption["archive/mail/user/archive.zip"])
+	assert.Equal(t, 3, stub.parts)
+	assert.Empty(t, stub.uploads)
+
+	data, err := storage.Read(ctx, "mail/user/archive.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, big, data)
+
+	_, err = storage.Read(ctx, "mail/other/data.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, storage.Remove(ctx, "mail/user/archive.zip"))
+	assert.NotContains(t, stub.objects, "archive/mail/user/archive.zip")
+
+	// The metadata is stored in the bucket as well
+	mailList, err := newMailList(storage, "user", "imap", "localhost", "mail/user")
+	assert.NoError(t, err)
+	assert.NoError(t, mailList.addMail(ctx, &mail{Uid: 1, Subject: "Invoice"}))
+	assert.NoError(t, mailList.flush())
+	assert.Contains(t, string(stub.objects["archive/mail/user/data.json"]), `"subject": "Invoice"`)
+
+	config.Storage.S3.AccessKey = "wrong"
+	storage, err = newStorage(config)
+	assert.NoError(t, err)
+
+	err = storage.Write(ctx, "mail/user/Invoice 1.pdf", []byte("pdf"))
+	assert.Error(t, err)
+	assert.Equal(t, "AccessDenied", minio.ToErrorResponse(errors.Unwrap(err)).Code)
+
+	config.Storage.S3.PartSize = 1 << 20
+	_, err = newStorage(config)
+	assert.Error(t, err)
+}
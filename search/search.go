@@ -11,6 +11,12 @@ type Search struct {
 }
 
 func (search *Search) Find() bool {
+	_, ok := search.Match()
+	return ok
+}
+
+// Match returns the terms of the first row which matches
+func (search *Search) Match() ([]string, bool) {
 	for _, row := range search.Search {
 		count := counter.CreateCounter()
 		split := strings.Split(row, ",")
@@ -22,9 +28,13 @@ func (search *Search) Find() bool {
 		}
 
 		if count.Current() == len(split) {
-			return true
+			terms := make([]string, len(split))
+			for i, cell := range split {
+				terms[i] = strings.TrimSpace(cell)
+			}
+			return terms, true
 		}
 	}
 
-	return false
+	return nil, false
 }
@@ -46,3 +46,18 @@ func TestFind(t *testing.T) {
 		assert.Equal(t, test.expected, test.search.Find())
 	}
 }
+
+func TestMatch(t *testing.T) {
+	search := &Search{
+		Search: []string{"movie", "invoice, apple"},
+		Data:   "your invoice from apple",
+	}
+
+	terms, ok := search.Match()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"invoice", "apple"}, terms)
+
+	search.Data = "test"
+	_, ok = search.Match()
+	assert.False(t, ok)
+}
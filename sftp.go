@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpPosixRename replaces existing files, RENAME fails for them on OpenSSH
+const sftpPosixRename = "posix-rename@openssh.com"
+
+func dialSftp(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sftpStorage writes below a directory of an SFTP server. The connection is
+// opened on first use and opened again after connection errors.
+type sftpStorage struct {
+	root       string
+	dial       func(ctx context.Context) (*ssh.Client, error)
+	retryDelay time.Duration
+	mutex      sync.Mutex
+	conn       *ssh.Client
+	client     *sftp.Client
+	// dirs holds the directories which are known to exist
+	dirs map[string]bool
+}
+
+func newSftpStorage(config *Config) (*sftpStorage, error) {
+	sftp := config.Storage.Sftp
+
+	auth := make([]ssh.AuthMethod, 0)
+	if sftp.Key != "" {
+		key, err := os.ReadFile(sftp.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sftp key: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sftp.Password != "" {
+		auth = append(auth, ssh.Password(sftp.Password))
+	}
+
+	knownHosts := sftp.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts: %w", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+
+	port := sftp.Port
+	if port == "" {
+		port = "22"
+	}
+
+	addr := net.JoinHostPort(sftp.Server, port)
+	sshConfig := &ssh.ClientConfig{
+		User:            sftp.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	return &sftpStorage{
+		root: sftp.Path,
+		dial: func(ctx context.Context) (*ssh.Client, error) {
+			return dialSftp(ctx, addr, sshConfig)
+		},
+		retryDelay: storageRetryDelay,
+		dirs:       make(map[string]bool),
+	}, nil
+}
+
+// Write uploads data to a temporary name and renames it to name once it is complete
+func (s *sftpStorage) Write(ctx context.Context, name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	target := path.Join(s.root, name)
+	tmpName := path.Join(path.Dir(target), "."+path.Base(target)+".tmp")
+
+	return withRetry(ctx, s.retryDelay, func() error {
+		return s.run(ctx, func(client *sftp.Client) error {
+			if dir := path.Dir(target); !s.dirs[dir] {
+				if err := client.MkdirAll(dir); err != nil {
+					return fmt.Errorf("failed to create directory: %w", err)
+				}
+				s.dirs[dir] = true
+			}
+
+			if err := writeSftpFile(client, tmpName, data); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", name, err)
+			}
+
+			if err := renameSftpFile(client, tmpName, target); err != nil {
+				return fmt.Errorf("failed to rename %s: %w", name, err)
+			}
+
+			return nil
+		})
+	})
+}
+
+func (s *sftpStorage) Read(ctx context.Context, name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var data []byte
+	err := withRetry(ctx, s.retryDelay, func() error {
+		return s.run(ctx, func(client *sftp.Client) error {
+			file, err := client.Open(path.Join(s.root, name))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			data, err = io.ReadAll(file)
+			return err
+		})
+	})
+
+	return data, err
+}
+
+func (s *sftpStorage) Remove(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return withRetry(ctx, s.retryDelay, func() error {
+		return s.run(ctx, func(client *sftp.Client) error {
+			if err := client.Remove(path.Join(s.root, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			return nil
+		})
+	})
+}
+
+// Close closes the connection, it is opened again on the next use
+func (s *sftpStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	return s.disconnect()
+}
+
+// disconnect closes the ssh connection first, so the sftp client doesn't wait
+// for an unresponsive server
+func (s *sftpStorage) disconnect() error {
+	err := s.conn.Close()
+	s.client.Close()
+	s.client, s.conn = nil, nil
+	return err
+}
+
+// run calls fn with a connected client. Errors other than failed requests
+// close the connection and are transient.
+func (s *sftpStorage) run(ctx context.Context, fn func(client *sftp.Client) error) error {
+	if s.client == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return &transientError{err: fmt.Errorf("failed to connect: %w", err)}
+		}
+
+		client, err := sftp.NewClient(conn)
+		if err != nil {
+			conn.Close()
+			return &transientError{err: fmt.Errorf("failed to start sftp: %w", err)}
+		}
+		s.conn, s.client = conn, client
+	}
+
+	err := fn(s.client)
+	var status *sftp.StatusError
+	if err == nil || errors.As(err, &status) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	_ = s.disconnect()
+	return &transientError{err: err}
+}
+
+// writeSftpFile creates or truncates name and writes data to it
+func writeSftpFile(client *sftp.Client, name string, data []byte) error {
+	file, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// renameSftpFile replaces newName, with a POSIX rename if the server supports it
+func renameSftpFile(client *sftp.Client, oldName, newName string) error {
+	if _, ok := client.HasExtension(sftpPosixRename); ok {
+		return client.PosixRename(oldName, newName)
+	}
+
+	if err := client.Remove(newName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return client.Rename(oldName, newName)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// droppingChannel closes the connection after the next request while drop is set
+type droppingChannel struct {
+	ssh.Channel
+	drop *atomic.Bool
+}
+
+func (c *droppingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if err == nil && c.drop.Swap(false) {
+		c.Channel.Close()
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// startSftpServer starts an SSH server with the sftp subsystem for user nas
+func startSftpServer(t *testing.T, root string, drop *atomic.Bool) (string, ssh.PublicKey) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "nas" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+
+					go func() {
+						for req := range requests {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if !ok {
+								continue
+							}
+
+							server, err := sftp.NewServer(&droppingChannel{Channel: channel, drop: drop}, sftp.WithServerWorkingDirectory(root))
+							if err != nil {
+								channel.Close()
+								continue
+							}
+							go func() {
+								server.Serve()
+								channel.Close()
+							}()
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+func TestSftpStorage(t *testing.T) {
+	root := t.TempDir()
+	drop := new(atomic.Bool)
+	addr, hostKey := startSftpServer(t, root, drop)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0o600))
+
+	host, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+
+	config := new(Config)
+	config.Storage.Type = "sftp"
+	config.Storage.Sftp.Server = host
+	config.Storage.Sftp.Port = port
+	config.Storage.Sftp.Username = "nas"
+	config.Storage.Sftp.Password = "secret"
+	config.Storage.Sftp.KnownHosts = knownHosts
+	config.Storage.Sftp.Path = "archive"
+
+	storage, err := newStorage(config)
+	assert.NoError(t, err)
+	defer closeStorage(storage)
+	storage.(*sftpStorage).retryDelay = 0
+
+	ctx := context.Background()
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "archive"), os.ModePerm))
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/invoice.pdf", []byte("pdf")))
+
+	// A lost connection is opened again
+	drop.Store(true)
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/invoice.pdf", []byte("new")))
+	assert.False(t, drop.Load())
+
+	data, err := os.ReadFile(filepath.Join(root, "archive", "mail", "user", "202403", "invoice.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), data)
+
+	entries, err := os.ReadDir(filepath.Join(root, "archive", "mail", "user", "202403"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	big := make([]byte, 100<<10)
+	rand.Read(big)
+	assert.NoError(t, storage.Write(ctx, "mail/user/data.json", big))
+
+	data, err = storage.Read(ctx, "mail/user/data.json")
+	assert.NoError(t, err)
+	assert.Equal(t, big, data)
+
+	_, err = storage.Read(ctx, "mail/other/data.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, storage.Remove(ctx, "mail/user/data.json"))
+	assert.NoError(t, storage.Remove(ctx, "mail/user/data.json"))
+	assert.NoFileExists(t, filepath.Join(root, "archive", "mail", "user", "data.json"))
+
+	config.Storage.Sftp.Password = "wrong"
+	storage, err = newStorage(config)
+	assert.NoError(t, err)
+	storage.(*sftpStorage).retryDelay = 0
+	assert.Error(t, storage.Write(ctx, "mail/user/data.json", []byte("{}")))
+}
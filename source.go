@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	i "github.com/emersion/go-imap"
+)
+
+// Source reads mails from a mail store. Uids are only valid for the
+// lifetime of an opened source.
+type Source interface {
+	// Open connects to or indexes the store
+	Open(ctx context.Context) error
+	// Search returns the uids of all mails between from and to
+	Search(ctx context.Context, from, to time.Time) ([]uint32, error)
+	// Fetch sends the mails to mailsChan. Once ctx is cancelled the current
+	// mail is finished and ctx.Err() is returned.
+	Fetch(ctx context.Context, uids []uint32, mailsChan chan *mail) error
+	// Retry prepares Fetch for mails of a single mailbox which failed in an
+	// earlier run and returns the uids of those which still exist
+	Retry(ctx context.Context, mailbox string, failures []failedMail) ([]uint32, error)
+	// Close releases the store, it may be called more than once
+	Close() error
+	// Vendor and Server describe the source in the metadata
+	Vendor() string
+	Server() string
+}
+
+// incrementalSource uses the metadata to skip known mails and to keep its sync state
+type incrementalSource interface {
+	Source
+	Track(mailList *mailList)
+}
+
+// committingSource finishes a run once the fetched mails were processed, so
+// nothing is given up on the server before the handlers succeeded
+type committingSource interface {
+	Source
+	Commit(ctx context.Context, mailList *mailList) error
+}
+
+func newSource(config *Config) (Source, error) {
+	switch config.Source.Type {
+	case "", "imap":
+		return &imapSource{imap: newImap(config), mailbox: "INBOX", query: config.Gmail.Query}, nil
+	case "pop3":
+		return newPop3Source(config), nil
+	case "jmap":
+		return newJmapSource(config), nil
+	case "maildir":
+		return newLocalSource("maildir", config.Source.Path, listMaildir), nil
+	case "mbox":
+		return newLocalSource("mbox", config.Source.Path, listMbox), nil
+	case "eml":
+		return newLocalSource("eml", config.Source.Path, listEml), nil
+	default:
+		return nil, fmt.Errorf("unknown source: %s", config.Source.Type)
+	}
+}
+
+// imapSource reads a single mailbox of an IMAP account. On Gmail the mailbox
+// with all mails is searched with query and mails are deduplicated by their
+// Gmail message id. Servers with CONDSTORE only return mails changed since the
+// last run and report expunged mails.
+type imapSource struct {
+	*imap
+	mailbox   string
+	query     string
+	known     map[string]uint32
+	mailList  *mailList
+	condstore bool
+	qresync   bool
+	// state is taken before searching, so changes during the run come up again
+	state     modSeqState
+	hasModSeq bool
+	// searched holds the uids of the last search, the state is stored once they were processed
+	searched []uint32
+}
+
+func (s *imapSource) Open(ctx context.Context) error {
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+
+	if err := s.login(ctx); err != nil {
+		return err
+	}
+
+	return s.open(ctx)
+}
+
+// open selects the mailbox of an authenticated session
+func (s *imapSource) open(ctx context.Context) error {
+	var err error
+	if s.qresync, err = s.Client.Support(qresyncCapability); err != nil {
+		return &ConnectionError{Op: "capability", Err: err}
+	}
+
+	if s.qresync {
+		if err := s.enableQresync(); err != nil {
+			return err
+		}
+	}
+
+	if s.condstore, err = s.Client.Support(condstoreCapability); err != nil {
+		return &ConnectionError{Op: "capability", Err: err}
+	}
+	s.condstore = s.condstore || s.qresync
+
+	if s.Gmail {
+		if s.mailbox, err = s.allMailbox(); err != nil {
+			return err
+		}
+	}
+
+	if s.condstore {
+		if s.state, s.hasModSeq, err = s.modSeqState(s.mailbox); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.selectMailbox(ctx, s.mailbox)
+	return err
+}
+
+func (s *imapSource) Track(mailList *mailList) {
+	s.mailList = mailList
+	s.known, _ = mailList.remoteIDs()
+}
+
+func (s *imapSource) Search(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	uids, err := s.searchChanged(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not nil even without results, so Commit knows Search ran
+	s.searched = append(make([]uint32, 0, len(uids)), uids...)
+	return uids, nil
+}
+
+// searchChanged returns the uids between from and to which changed since the
+// stored state or weren't processed yet, e.g. when the range was widened
+func (s *imapSource) searchChanged(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	uids, err := s.searchRange(ctx, from, to)
+	if err != nil || !s.hasModSeq || s.mailList == nil {
+		return uids, err
+	}
+
+	previous, ok := parseModSeqState(s.mailList.syncState())
+	if !ok || previous.UidValidity != s.state.UidValidity {
+		return uids, nil
+	}
+
+	changed, vanished, err := s.changedSince(ctx, previous.ModSeq, s.qresync)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.markExpunged(ctx, vanished); err != nil {
+		return nil, err
+	}
+
+	isChanged := make(map[uint32]bool, len(changed))
+	for _, uid := range changed {
+		isChanged[uid] = true
+	}
+
+	handled := s.mailList.handled(s.mailbox)
+	filtered := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if _, ok := handled[uid]; isChanged[uid] || !ok {
+			filtered = append(filtered, uid)
+		}
+	}
+
+	return filtered, nil
+}
+
+// searchRange returns the uids between from and to, or those matching the Gmail query
+func (s *imapSource) searchRange(ctx context.Context, from, to time.Time) ([]uint32, error) {
+	if !s.Gmail {
+		return s.search(ctx, from, to)
+	}
+
+	query := s.query
+	if query == "" {
+		query = defaultGmailQuery
+	}
+
+	uids, err := s.gmailSearch(ctx, query, from, to)
+	if err != nil || len(uids) == 0 || len(s.known) == 0 {
+		return uids, err
+	}
+
+	ids, err := s.gmailMessageIDs(ctx, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := make([]uint32, 0, len(uids))
+	for _, uid := range uids {
+		if _, ok := s.known[ids[uid]]; !ok {
+			unknown = append(unknown, uid)
+		}
+	}
+
+	return unknown, nil
+}
+
+// markExpunged marks the mails of the mailbox in the metadata which are gone on
+// the server. Without QRESYNC the known uids of the mailbox are searched.
+func (s *imapSource) markExpunged(ctx context.Context, vanished *i.SeqSet) error {
+	if s.qresync {
+		return s.mailList.markDeleted(ctx, s.mailbox, vanished.Contains)
+	}
+
+	exists, err := s.existing(ctx, s.mailList.uids(s.mailbox))
+	if err != nil {
+		return err
+	}
+
+	return s.mailList.markDeleted(ctx, s.mailbox, func(uid uint32) bool { return !exists[uid] })
+}
+
+func (s *imapSource) Fetch(ctx context.Context, uids []uint32, mailsChan chan *mail) error {
+	return s.fetchMessages(ctx, uids, mailsChan)
+}
+
+// Commit stores the modseq once every mail found by Search was processed.
+// Otherwise the previous state is kept and the next run searches the same
+// changes again.
+func (s *imapSource) Commit(ctx context.Context, mailList *mailList) error {
+	if !s.hasModSeq || s.searched == nil {
+		return nil
+	}
+
+	handled := mailList.handled(s.mailbox)
+	for _, uid := range s.searched {
+		if _, ok := handled[uid]; !ok {
+			return nil
+		}
+	}
+
+	return mailList.setSyncState(ctx, s.state.String())
+}
+
+// Retry selects the mailbox of the failed mails, uids which no longer exist
+// are left out by the server when fetching
+func (s *imapSource) Retry(ctx context.Context, mailbox string, failures []failedMail) ([]uint32, error) {
+	if _, err := s.selectMailbox(ctx, mailbox); err != nil {
+		return nil, err
+	}
+
+	uids := make([]uint32, 0, len(failures))
+	for _, failure := range failures {
+		uids = append(uids, failure.Uid)
+	}
+
+	return uids, nil
+}
+
+func (s *imapSource) Close() error {
+	if s.Client == nil || s.Client.State() == i.LogoutState {
+		return nil
+	}
+
+	return s.logout()
+}
+
+func (s *imapSource) Vendor() string {
+	return "imap"
+}
+
+func (s *imapSource) Server() string {
+	return s.imap.Server
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Remote storages retry transient errors, the delay doubles after every attempt
+const (
+	storageAttempts   = 3
+	storageRetryDelay = time.Second
+)
+
+// Storage stores the outputs of the handlers and the metadata. Paths are
+// slash separated and relative to the root of the storage, e.g.
+// "mail/<username>/data.json".
+type Storage interface {
+	// Write replaces the file at path atomically and creates missing directories
+	Write(ctx context.Context, path string, data []byte) error
+	// Read returns the file at path, the error matches fs.ErrNotExist if there is none
+	Read(ctx context.Context, path string) ([]byte, error)
+	// Remove deletes the file at path, a missing file isn't an error
+	Remove(ctx context.Context, path string) error
+}
+
+func newStorage(config *Config) (Storage, error) {
+	switch config.Storage.Type {
+	case "", "local":
+		return newLocalStorage(config.Storage.Path), nil
+	case "s3":
+		return newS3Storage(config)
+	case "webdav":
+		return newWebdavStorage(config)
+	case "sftp":
+		return newSftpStorage(config)
+	default:
+		return nil, fmt.Errorf("unknown storage: %s", config.Storage.Type)
+	}
+}
+
+// closeStorage closes connections of the storage, if it keeps any
+func closeStorage(storage Storage) {
+	closer, ok := storage.(io.Closer)
+	if !ok {
+		return
+	}
+
+	if err := closer.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
+}
+
+// transientError is a failure of a remote storage which may succeed on a retry,
+// e.g. a lost connection or a 503 response
+type transientError struct {
+	err error
+}
+
+func (err *transientError) Error() string {
+	return err.err.Error()
+}
+
+func (err *transientError) Unwrap() error {
+	return err.err
+}
+
+// withRetry calls fn until it succeeds, fails with an error which isn't
+// transient or storageAttempts were made
+func withRetry(ctx context.Context, delay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < storageAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay << (attempt - 1)):
+			}
+		}
+
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		var transient *transientError
+		if !errors.As(err, &transient) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// localStorage writes below a directory of the local filesystem
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	if root == "" {
+		root = "."
+	}
+
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) Write(ctx context.Context, path string, data []byte) error {
+	name := filepath.Join(s.root, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write to a unique temporary file first, so concurrent writes of the
+	// same path don't share it
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	// CreateTemp creates files readable by the owner only
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *localStorage) Read(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.root, filepath.FromSlash(path)))
+}
+
+func (s *localStorage) Remove(ctx context.Context, path string) error {
+	if err := os.Remove(filepath.Join(s.root, filepath.FromSlash(path))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
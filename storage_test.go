@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	storage := newLocalStorage(root)
+	ctx := context.Background()
+
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/example.com/invoice.pdf", []byte("pdf")))
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/example.com/invoice.pdf", []byte("new")))
+
+	data, err := os.ReadFile(filepath.Join(root, "mail", "user", "202403", "example.com", "invoice.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), data)
+
+	entries, err := os.ReadDir(filepath.Join(root, "mail", "user", "202403", "example.com"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	info, err := entries[0].Info()
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+
+	// Concurrent writes of the same path don't share a temporary file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, storage.Write(ctx, "mail/user/state.json", []byte("{}")))
+		}()
+	}
+	wg.Wait()
+
+	entries, err = os.ReadDir(filepath.Join(root, "mail", "user"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	data, err = storage.Read(ctx, "mail/user/202403/example.com/invoice.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), data)
+
+	_, err = storage.Read(ctx, "mail/user/data.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, storage.Remove(ctx, "mail/user/202403/example.com/invoice.pdf"))
+	assert.NoError(t, storage.Remove(ctx, "mail/user/202403/example.com/invoice.pdf"))
+	_, err = storage.Read(ctx, "mail/user/202403/example.com/invoice.pdf")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestExportStorage(t *testing.T) {
+	config := new(Config)
+	config.Export.Maildir = "export/maildir"
+	assert.NoError(t, config.validate())
+
+	// Exports only write to the local filesystem
+	config.Storage.Type = "s3"
+	assert.Error(t, config.validate())
+}
+
+func TestUnknownStorage(t *testing.T) {
+	config := new(Config)
+	config.Storage.Type = "ftp"
+
+	_, err := newStorage(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var textURL = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+const textTemplateHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<style>
+body { margin: 0; }
+pre { font-family: "DejaVu Sans Mono", Menlo, Consolas, monospace; font-size: 10pt; white-space: pre-wrap; overflow-wrap: break-word; }
+a { color: #1a0dab; }
+</style>
+</head>
+<body><pre>`
+
+const textTemplateFoot = `</pre></body>
+</html>
+`
+
+// textToHtml converts a text/plain body into escaped, monospaced html with clickable urls.
+// Bodies with format=flowed are unwrapped first.
+func textToHtml(text []byte, flowed, delsp bool) []byte {
+	content := strings.ReplaceAll(string(text), "\r\n", "\n")
+	if flowed {
+		content = unflow(content, delsp)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(textTemplateHead)
+	buf.WriteString(linkify(content))
+	buf.WriteString(textTemplateFoot)
+
+	return buf.Bytes()
+}
+
+// linkify escapes text and turns urls into links
+func linkify(text string) string {
+	buf := new(strings.Builder)
+	last := 0
+
+	for _, match := range textURL.FindAllStringIndex(text, -1) {
+		start, end := match[0], match[1]
+
+		// Trailing punctuation most likely belongs to the sentence
+		end = start + len(strings.TrimRight(text[start:end], ".,;:!?)]}'"))
+
+		href := text[start:end]
+		if strings.HasPrefix(strings.ToLower(href), "www.") {
+			href = "http://" + href
+		}
+
+		buf.WriteString(html.EscapeString(text[last:start]))
+		buf.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(text[start:end]) + `</a>`)
+		last = end
+	}
+
+	buf.WriteString(html.EscapeString(text[last:]))
+	return buf.String()
+}
+
+// unflow joins the soft line breaks of a format=flowed body (RFC 3676)
+func unflow(text string, delsp bool) string {
+	lines := strings.Split(text, "\n")
+	result := make([]string, 0, len(lines))
+
+	current := ""
+	currentDepth := -1
+
+	flush := func() {
+		if currentDepth >= 0 {
+			result = append(result, strings.Repeat(">", currentDepth)+prefixSpace(currentDepth, current))
+		}
+		current = ""
+		currentDepth = -1
+	}
+
+	for _, line := range lines {
+		depth := 0
+		for depth < len(line) && line[depth] == '>' {
+			depth++
+		}
+		content := line[depth:]
+
+		// space stuffing
+		content = strings.TrimPrefix(content, " ")
+
+		// a quote depth change always ends the paragraph
+		if currentDepth >= 0 && depth != currentDepth {
+			flush()
+		}
+
+		currentDepth = depth
+		signature := content == "-- "
+		soft := strings.HasSuffix(content, " ") && !signature
+
+		if soft && delsp {
+			content = strings.TrimSuffix(content, " ")
+		}
+
+		current += content
+
+		if !soft {
+			flush()
+		}
+	}
+
+	flush()
+	return strings.Join(result, "\n")
+}
+
+func prefixSpace(depth int, content string) string {
+	if depth > 0 && content != "" {
+		return " " + content
+	}
+
+	return content
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnflow(t *testing.T) {
+	tests := []struct {
+		input    string
+		delsp    bool
+		expected string
+	}{
+		{
+			input:    "This is a long \nparagraph.\nNext line",
+			expected: "This is a long paragraph.\nNext line",
+		},
+		{
+			input:    "This is a long \nparagraph.",
+			delsp:    true,
+			expected: "This is a longparagraph.",
+		},
+		{
+			input:    ">> quoted \n>> text\n> less\nreply",
+			expected: ">> quoted text\n> less\nreply",
+		},
+		{
+			input:    " >not a quote\n-- \nsignature",
+			expected: ">not a quote\n-- \nsignature",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, unflow(test.input, test.delsp), test.input)
+	}
+}
+
+func TestTextToHtml(t *testing.T) {
+	output := string(textToHtml([]byte("Total: <5 EUR> & more\r\nSee https://vendor.com/invoice?id=1&x=2.\r\n"), false, false))
+
+	body := output[strings.Index(output, "<pre>")+len("<pre>") : strings.Index(output, "</pre>")]
+	assert.Equal(t,
+		"Total: &lt;5 EUR&gt; &amp; more\nSee <a href=\"https://vendor.com/invoice?id=1&amp;x=2\">https://vendor.com/invoice?id=1&amp;x=2</a>.\n",
+		body,
+	)
+
+	assert.Contains(t, linkify("visit www.vendor.com"), `<a href="http://www.vendor.com">www.vendor.com</a>`)
+}
@@ -0,0 +1,106 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	rtfCompressed   = 0x75465a4c // "LZFu"
+	rtfUncompressed = 0x414c454d // "MELA"
+)
+
+// rtfDictionary is the initial dictionary of the compressed RTF format (MS-OXRTFCP)
+const rtfDictionary = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}" +
+	"{\\f0\\fnil \\froman \\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+	"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+// rtfMaxRatio is the highest possible ratio of decompressed to compressed size
+const rtfMaxRatio = 9
+
+var ErrInvalidRTF = errors.New("tnef: invalid compressed RTF")
+
+// DecompressRTF decompresses a PR_RTF_COMPRESSED property value
+func DecompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, ErrInvalidRTF
+	}
+
+	compSize := binary.LittleEndian.Uint32(data[0:])
+	rawSize := binary.LittleEndian.Uint32(data[4:])
+	compType := binary.LittleEndian.Uint32(data[8:])
+
+	// compSize counts everything after its own field
+	end := int(compSize) + 4
+	if end > len(data) || end < 16 {
+		return nil, ErrInvalidRTF
+	}
+	input := data[16:end]
+
+	switch compType {
+	case rtfUncompressed:
+		if int(rawSize) > len(input) {
+			return nil, ErrInvalidRTF
+		}
+		return input[:rawSize], nil
+	case rtfCompressed:
+	default:
+		return nil, ErrInvalidRTF
+	}
+
+	// A 2 byte reference expands to at most 17 bytes
+	if uint64(rawSize) > uint64(len(input))*rtfMaxRatio {
+		return nil, ErrInvalidRTF
+	}
+
+	var dictionary [4096]byte
+	copy(dictionary[:], rtfDictionary)
+	write := len(rtfDictionary)
+
+	output := make([]byte, 0, rawSize)
+	pos := 0
+
+	for pos < len(input) {
+		control := input[pos]
+		pos++
+
+		for bit := 0; bit < 8; bit++ {
+			if pos >= len(input) {
+				return output, nil
+			}
+
+			// literal byte
+			if control&(1<<bit) == 0 {
+				output = append(output, input[pos])
+				dictionary[write] = input[pos]
+				write = (write + 1) % len(dictionary)
+				pos++
+				continue
+			}
+
+			// dictionary reference: 12 bit offset, 4 bit length
+			if pos+1 >= len(input) {
+				return nil, ErrInvalidRTF
+			}
+
+			token := int(binary.BigEndian.Uint16(input[pos:]))
+			pos += 2
+
+			offset := token >> 4
+			length := token&0xf + 2
+
+			if offset == write {
+				return output, nil
+			}
+
+			for n := 0; n < length; n++ {
+				b := dictionary[(offset+n)%len(dictionary)]
+				output = append(output, b)
+				dictionary[write] = b
+				write = (write + 1) % len(dictionary)
+			}
+		}
+	}
+
+	return output, nil
+}
@@ -0,0 +1,413 @@
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const signature = 0x223e9f78
+
+// attribute levels
+const (
+	levelMessage    = 0x01
+	levelAttachment = 0x02
+)
+
+// attribute ids without their type
+const (
+	attBody           = 0x800c
+	attAttachData     = 0x800f
+	attAttachTitle    = 0x8010
+	attAttachRenddata = 0x9002
+	attMsgProps       = 0x9003
+	attAttachment     = 0x9005
+)
+
+// MAPI property ids
+const (
+	propBody           = 0x1000
+	propRtfCompressed  = 0x1009
+	propHtml           = 0x1013
+	propAttachDataBin  = 0x3701
+	propAttachFilename = 0x3704
+	propAttachLongName = 0x3707
+	propAttachMimeTag  = 0x370e
+)
+
+// MAPI property types
+const (
+	typeNull     = 0x0001
+	typeI2       = 0x0002
+	typeLong     = 0x0003
+	typeR4       = 0x0004
+	typeDouble   = 0x0005
+	typeCurrency = 0x0006
+	typeAppTime  = 0x0007
+	typeError    = 0x000a
+	typeBoolean  = 0x000b
+	typeObject   = 0x000d
+	typeI8       = 0x0014
+	typeString8  = 0x001e
+	typeUnicode  = 0x001f
+	typeSysTime  = 0x0040
+	typeClsid    = 0x0048
+	typeBinary   = 0x0102
+	typeMulti    = 0x1000
+)
+
+var (
+	ErrNoSignature = errors.New("tnef: invalid signature")
+	ErrTruncated   = errors.New("tnef: unexpected end of data")
+)
+
+// Attachment is a file contained in a TNEF stream
+type Attachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+// Data is the decoded content of a TNEF stream (winmail.dat)
+type Data struct {
+	Body        []byte
+	BodyHTML    []byte
+	BodyRTF     []byte
+	Attachments []*Attachment
+}
+
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, ErrTruncated
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b, nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	b, err := r.next(2)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// padded reads n bytes and skips the padding to the next multiple of 4
+func (r *reader) padded(n int) ([]byte, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.next((4 - n%4) % 4); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Decode decodes a TNEF stream
+func Decode(data []byte) (*Data, error) {
+	r := &reader{data: data}
+
+	sig, err := r.uint32()
+	if err != nil || sig != signature {
+		return nil, ErrNoSignature
+	}
+
+	// legacy key
+	if _, err := r.uint16(); err != nil {
+		return nil, err
+	}
+
+	result := new(Data)
+	var current *Attachment
+
+	for r.pos < len(r.data) {
+		level, err := r.next(1)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := r.next(int(length))
+		if err != nil {
+			return nil, err
+		}
+
+		checksum, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		if sum(value) != checksum {
+			return nil, fmt.Errorf("tnef: invalid checksum for attribute %#x", id)
+		}
+
+		switch {
+		case level[0] == levelMessage && id&0xffff == attBody:
+			result.Body = trimNull(value)
+		case level[0] == levelMessage && id&0xffff == attMsgProps:
+			props, err := decodeProps(value)
+			if err != nil {
+				return nil, err
+			}
+			result.applyProps(props)
+		case level[0] == levelAttachment && id&0xffff == attAttachRenddata:
+			current = new(Attachment)
+			result.Attachments = append(result.Attachments, current)
+		case level[0] == levelAttachment && current != nil:
+			if err := current.apply(id&0xffff, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (result *Data) applyProps(props map[uint16]prop) {
+	if p, ok := props[propBody]; ok && len(result.Body) == 0 {
+		result.Body = []byte(p.string())
+	}
+
+	if p, ok := props[propHtml]; ok {
+		result.BodyHTML = p.value
+	}
+
+	if p, ok := props[propRtfCompressed]; ok {
+		if rtf, err := DecompressRTF(p.value); err == nil {
+			result.BodyRTF = rtf
+		}
+	}
+}
+
+func (attachment *Attachment) apply(id uint32, value []byte) error {
+	switch id {
+	case attAttachTitle:
+		if attachment.Filename == "" {
+			attachment.Filename = decodeString8(trimNull(value))
+		}
+	case attAttachData:
+		attachment.Data = value
+	case attAttachment:
+		props, err := decodeProps(value)
+		if err != nil {
+			return err
+		}
+
+		if p, ok := props[propAttachLongName]; ok {
+			attachment.Filename = p.string()
+		} else if p, ok := props[propAttachFilename]; ok && attachment.Filename == "" {
+			attachment.Filename = p.string()
+		}
+
+		if p, ok := props[propAttachMimeTag]; ok {
+			attachment.MimeType = p.string()
+		}
+
+		if p, ok := props[propAttachDataBin]; ok && len(attachment.Data) == 0 && p.typ == typeBinary {
+			attachment.Data = p.value
+		}
+	}
+
+	return nil
+}
+
+type prop struct {
+	typ   uint16
+	value []byte
+}
+
+func (p prop) string() string {
+	if p.typ == typeUnicode {
+		return decodeUnicode(p.value)
+	}
+
+	return decodeString8(trimNull(p.value))
+}
+
+// decodeProps decodes a MAPI property list, keeping the first value of each property
+func decodeProps(data []byte) (map[uint16]prop, error) {
+	r := &reader{data: data}
+	props := make(map[uint16]prop)
+
+	count, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	for n := uint32(0); n < count; n++ {
+		typ, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := r.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		// named properties carry a GUID and a numeric id or a name
+		if id >= 0x8000 {
+			if _, err := r.next(16); err != nil {
+				return nil, err
+			}
+
+			kind, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+
+			if kind == 0 {
+				if _, err := r.uint32(); err != nil {
+					return nil, err
+				}
+			} else {
+				length, err := r.uint32()
+				if err != nil {
+					return nil, err
+				}
+				if _, err := r.padded(int(length)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		values, err := decodeValues(r, typ)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) > 0 {
+			props[id] = prop{typ: typ &^ typeMulti, value: values[0]}
+		}
+	}
+
+	return props, nil
+}
+
+func decodeValues(r *reader, typ uint16) ([][]byte, error) {
+	count := uint32(1)
+	base := typ &^ typeMulti
+	variable := base == typeString8 || base == typeUnicode || base == typeBinary || base == typeObject
+
+	if typ&typeMulti != 0 || variable {
+		var err error
+		if count, err = r.uint32(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every value takes at least 4 bytes, so larger counts can't be valid
+	if uint64(count)*4 > uint64(len(r.data)-r.pos) {
+		return nil, ErrTruncated
+	}
+
+	values := make([][]byte, 0, count)
+	for n := uint32(0); n < count; n++ {
+		size := 0
+
+		switch base {
+		case typeNull, typeI2, typeLong, typeR4, typeError, typeBoolean:
+			size = 4
+		case typeDouble, typeCurrency, typeAppTime, typeI8, typeSysTime:
+			size = 8
+		case typeClsid:
+			size = 16
+		case typeString8, typeUnicode, typeBinary, typeObject:
+			length, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			size = int(length)
+		default:
+			return nil, fmt.Errorf("tnef: unknown property type %#x", typ)
+		}
+
+		value, err := r.padded(size)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func sum(data []byte) uint16 {
+	var s uint16
+	for _, b := range data {
+		s += uint16(b)
+	}
+
+	return s
+}
+
+func trimNull(data []byte) []byte {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i]
+	}
+
+	return data
+}
+
+// decodeString8 decodes 8 bit strings which aren't valid UTF-8 as Windows-1252
+func decodeString8(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+
+	return string(decoded)
+}
+
+func decodeUnicode(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,108 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeAttachments(t *testing.T) {
+	data, err := os.ReadFile("testdata/attachments.tnef")
+	assert.NoError(t, err)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Please find the invoice attached.", string(decoded.Body))
+	assert.Len(t, decoded.Attachments, 2)
+
+	assert.Equal(t, "Rechnung März.pdf", decoded.Attachments[0].Filename)
+	assert.Equal(t, "application/pdf", decoded.Attachments[0].MimeType)
+	assert.Equal(t, "%PDF-1.4", string(decoded.Attachments[0].Data[:8]))
+
+	assert.Equal(t, "notes.txt", decoded.Attachments[1].Filename)
+	assert.Equal(t, "", decoded.Attachments[1].MimeType)
+	assert.Equal(t, "remember to pay\n", string(decoded.Attachments[1].Data))
+}
+
+func TestDecodeBody(t *testing.T) {
+	data, err := os.ReadFile("testdata/body.tnef")
+	assert.NoError(t, err)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+
+	assert.Empty(t, decoded.Attachments)
+	assert.Equal(t, "<html><body><p>Invoice</p></body></html>", string(decoded.BodyHTML))
+	assert.Equal(t, "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n", string(decoded.BodyRTF))
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode([]byte("%PDF-1.4"))
+	assert.ErrorIs(t, err, ErrNoSignature)
+
+	data, err := os.ReadFile("testdata/attachments.tnef")
+	assert.NoError(t, err)
+
+	_, err = Decode(data[:len(data)-20])
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-5] ^= 0xff
+	_, err = Decode(corrupt)
+	assert.Error(t, err)
+}
+
+func TestDecompressRTF(t *testing.T) {
+	// Example from MS-OXRTFCP
+	compressed := []byte{
+		0x2d, 0x00, 0x00, 0x00, 0x2b, 0x00, 0x00, 0x00, 0x4c, 0x5a, 0x46, 0x75, 0xf1, 0xc5, 0xc7, 0xa7,
+		0x03, 0x00, 0x0a, 0x00, 0x72, 0x63, 0x70, 0x67, 0x31, 0x32, 0x35, 0x42, 0x32, 0x0a, 0xf3, 0x20,
+		0x68, 0x65, 0x6c, 0x09, 0x00, 0x20, 0x62, 0x77, 0x05, 0xb0, 0x6c, 0x64, 0x7d, 0x0a, 0x80, 0x0f,
+		0xa0,
+	}
+
+	rtf, err := DecompressRTF(compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n", string(rtf))
+
+	_, err = DecompressRTF([]byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidRTF)
+}
+
+// attribute encodes a TNEF attribute with its checksum
+func attribute(level byte, id uint32, value []byte) []byte {
+	data := []byte{level}
+	data = binary.LittleEndian.AppendUint32(data, id)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(value)))
+	data = append(data, value...)
+	return binary.LittleEndian.AppendUint16(data, sum(value))
+}
+
+func TestDecodeHostileSizes(t *testing.T) {
+	header := binary.LittleEndian.AppendUint32(nil, signature)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+
+	// One multi-valued property claiming 2^32-1 values
+	props := binary.LittleEndian.AppendUint32(nil, 1)
+	props = binary.LittleEndian.AppendUint16(props, typeMulti|typeLong)
+	props = binary.LittleEndian.AppendUint16(props, 0x0001)
+	props = binary.LittleEndian.AppendUint32(props, 0xffffffff)
+
+	data := append(header, attribute(levelMessage, attMsgProps, props)...)
+	assert.Len(t, data, 29)
+
+	_, err := Decode(data)
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	// Compressed RTF claiming 4 GiB of output
+	rtf := binary.LittleEndian.AppendUint32(nil, 13)
+	rtf = binary.LittleEndian.AppendUint32(rtf, 0xffffffff)
+	rtf = binary.LittleEndian.AppendUint32(rtf, rtfCompressed)
+	rtf = append(rtf, 0, 0, 0, 0, 0, 'a')
+
+	_, err = DecompressRTF(rtf)
+	assert.ErrorIs(t, err, ErrInvalidRTF)
+}
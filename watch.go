@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	i "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Delay before reconnecting a watcher, it doubles up to watchMaxRetryDelay
+const (
+	watchRetryDelay    = 5 * time.Second
+	watchMaxRetryDelay = 5 * time.Minute
+)
+
+// watcher keeps a connection to a single mailbox open and pushes new
+// messages through the handler pipeline as soon as the server announces them
+type watcher struct {
+	config   *Config
+	mailbox  string
+	handlers []MailHandler
+	index    *messageIndex
+	mailList *mailList
+	// next and uidValidity are kept across reconnects, so mails arriving in
+	// between are fetched once the mailbox is selected again
+	next        uint32
+	uidValidity uint32
+	connected   bool
+	retryDelay  time.Duration
+}
+
+func runWatch(args []string) {
+	// flags
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	configPath := flags.String("config", "", "config path")
+	_ = flags.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailboxes := config.Watch.Mailboxes
+	if len(mailboxes) == 0 {
+		mailboxes = []string{"INBOX"}
+	}
+
+	new(imap).enableCharsetReader()
+
+	storage, err := newStorage(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStorage(storage)
+
+	// Create mail list for metadata tracking
+	username := config.account()
+	mailRoot := fmt.Sprintf("mail/%s", username)
+	mailList, err := newMailList(storage, username, "imap", config.Imap.Server, mailRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handlers, err := newHandlers(config, storage, mailList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	index, err := loadMessageIndex(config, storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	wg := new(sync.WaitGroup)
+
+	for _, mailbox := range mailboxes {
+		w := &watcher{
+			config:     config,
+			mailbox:    mailbox,
+			handlers:   handlers,
+			index:      index,
+			mailList:   mailList,
+			retryDelay: watchRetryDelay,
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.watch(ctx)
+		}()
+	}
+
+	fmt.Printf("Watching %s...\n", strings.Join(mailboxes, ", "))
+	wg.Wait()
+
+	if err := mailList.flush(); err != nil {
+		log.Printf("Failed to save metadata: %v", err)
+	}
+	saveMessageIndex(index)
+
+	// done
+	fmt.Println("Done")
+}
+
+// watch runs the watcher until ctx is cancelled. A lost connection is opened
+// again after retryDelay, which doubles while connecting keeps failing.
+func (w *watcher) watch(ctx context.Context) {
+	delay := w.retryDelay
+	for {
+		w.connected = false
+		err := w.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if w.connected {
+			delay = w.retryDelay
+		}
+
+		log.Printf("Watch error for mailbox %s, reconnecting in %s: %v", w.mailbox, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		delay = min(2*delay, watchMaxRetryDelay)
+	}
+}
+
+func (w *watcher) run(ctx context.Context) error {
+	imap := newImap(w.config)
+
+	if err := imap.connect(ctx); err != nil {
+		return err
+	}
+
+	// Updates must always be drained, otherwise the client blocks
+	updates := make(chan client.Update, 16)
+	notify := make(chan struct{}, 1)
+	quit := make(chan struct{})
+	imap.Client.Updates = updates
+
+	go func() {
+		for {
+			select {
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); !ok {
+					continue
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		if imap.Client.State() != i.LogoutState {
+			if err := imap.logout(); err != nil {
+				log.Printf("Logout error for mailbox %s: %v", w.mailbox, err)
+			}
+		}
+		close(quit)
+	}()
+
+	if err := imap.login(ctx); err != nil {
+		return err
+	}
+
+	status, err := imap.selectMailbox(ctx, w.mailbox)
+	if err != nil {
+		return err
+	}
+
+	pollInterval := w.config.Watch.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Minute
+	}
+
+	if ok, err := imap.Client.Support("IDLE"); err != nil {
+		return err
+	} else if !ok {
+		log.Printf("Server does not support IDLE, polling %s every %s", w.mailbox, pollInterval)
+	}
+
+	if w.next == 0 || w.uidValidity != status.UidValidity {
+		w.next, w.uidValidity = status.UidNext, status.UidValidity
+	} else if w.next < status.UidNext {
+		if w.next, err = w.fetchNew(ctx, imap, w.next); err != nil {
+			return err
+		}
+	}
+	w.connected = true
+
+	for {
+		idleStop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- imap.Client.Idle(idleStop, &client.IdleOptions{PollInterval: pollInterval})
+		}()
+
+		select {
+		case <-notify:
+			close(idleStop)
+			if err := <-idleDone; err != nil {
+				return err
+			}
+
+			if w.next, err = w.fetchNew(ctx, imap, w.next); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			close(idleStop)
+			if err := <-idleDone; err != nil {
+				return err
+			}
+			return ctx.Err()
+		case err := <-idleDone:
+			close(idleStop)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fetchNew processes all messages from uid next onwards and returns the next uid to wait for
+func (w *watcher) fetchNew(ctx context.Context, imap *imap, next uint32) (uint32, error) {
+	uids, err := imap.searchFrom(ctx, next)
+	if err != nil {
+		return next, err
+	}
+
+	if len(uids) == 0 {
+		return next, nil
+	}
+
+	mailsChan := make(chan *mail)
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- imap.fetchMessages(ctx, uids, mailsChan)
+		close(mailsChan)
+	}()
+
+	for mail := range mailsChan {
+		err := processMail(ctx, w.config, w.handlers, w.index, mail)
+		if err != nil {
+			log.Printf("Failed to process mail %d: %v", mail.Uid, err)
+		}
+
+		if err := recordResult(ctx, w.config.account(), w.mailList, mail, err); err != nil {
+			log.Printf("Failed to update metadata for mail %d: %v", mail.Uid, err)
+		}
+
+		if mail.Uid >= next {
+			next = mail.Uid + 1
+		}
+	}
+
+	if err := w.mailList.flush(); err != nil {
+		log.Printf("Failed to save metadata: %v", err)
+	}
+	saveMessageIndex(w.index)
+
+	return next, <-errs
+}
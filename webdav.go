@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+// webdavStorage writes below a collection of a WebDAV server, e.g. a Nextcloud folder
+type webdavStorage struct {
+	url        *url.URL
+	username   string
+	password   string
+	client     *http.Client
+	retryDelay time.Duration
+	mutex      sync.Mutex
+	// collections holds the collections which are known to exist
+	collections map[string]bool
+}
+
+// webdavError is an unexpected response status
+type webdavError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (err *webdavError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: %d %s", err.Method, err.Path, err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+func (err *webdavError) Is(target error) bool {
+	return target == fs.ErrNotExist && err.StatusCode == http.StatusNotFound
+}
+
+func newWebdavStorage(config *Config) (*webdavStorage, error) {
+	u, err := url.Parse(config.Storage.Webdav.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid webdav url: %s", config.Storage.Webdav.URL)
+	}
+
+	return &webdavStorage{
+		url:         u,
+		username:    config.Storage.Webdav.Username,
+		password:    config.Storage.Webdav.Password,
+		client:      http.DefaultClient,
+		retryDelay:  storageRetryDelay,
+		collections: make(map[string]bool),
+	}, nil
+}
+
+// Write uploads data to a temporary name and moves it to name once it is complete
+func (s *webdavStorage) Write(ctx context.Context, name string, data []byte) error {
+	dir, base := path.Split(name)
+	tmpName := dir + "." + base + ".tmp"
+
+	return withRetry(ctx, s.retryDelay, func() error {
+		if err := s.mkcolAll(ctx, path.Clean(dir)); err != nil {
+			return err
+		}
+
+		if _, err := s.do(ctx, http.MethodPut, tmpName, nil, data); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+
+		header := http.Header{"Destination": {s.url.JoinPath(name).String()}, "Overwrite": {"T"}}
+		if _, err := s.do(ctx, "MOVE", tmpName, header, nil); err != nil {
+			return fmt.Errorf("failed to move %s: %w", name, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *webdavStorage) Read(ctx context.Context, name string) ([]byte, error) {
+	var data []byte
+	err := withRetry(ctx, s.retryDelay, func() error {
+		var err error
+		data, err = s.do(ctx, http.MethodGet, name, nil, nil)
+		return err
+	})
+
+	return data, err
+}
+
+func (s *webdavStorage) Remove(ctx context.Context, name string) error {
+	return withRetry(ctx, s.retryDelay, func() error {
+		if _, err := s.do(ctx, http.MethodDelete, name, nil, nil); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+
+		return nil
+	})
+}
+
+// mkcolAll creates dir and its parents, existing collections are skipped
+func (s *webdavStorage) mkcolAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	exists := s.collections[dir]
+	s.mutex.Unlock()
+	if exists {
+		return nil
+	}
+
+	if err := s.mkcolAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+
+	// MKCOL fails with 405 Method Not Allowed if the collection exists
+	_, err := s.do(ctx, "MKCOL", dir+"/", nil, nil)
+	var webdavErr *webdavError
+	if errors.As(err, &webdavErr) && webdavErr.StatusCode == http.StatusMethodNotAllowed {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create collection %s: %w", dir, err)
+	}
+
+	s.mutex.Lock()
+	s.collections[dir] = true
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// do sends a request for name and returns the response body. Network errors,
+// 5xx and 429 responses are transient.
+func (s *webdavStorage) do(ctx context.Context, method, name string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url.JoinPath(name).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, &transientError{err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &transientError{err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if resp.StatusCode >= 300 {
+		err := &webdavError{Method: method, Path: name, StatusCode: resp.StatusCode}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &transientError{err: err}
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
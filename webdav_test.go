@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// flakyHandler answers the first request of a method with 503 Service Unavailable
+type flakyHandler struct {
+	http.Handler
+	mutex   sync.Mutex
+	fail    map[string]bool
+	methods []string
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	h.methods = append(h.methods, r.Method+" "+r.URL.Path)
+	fail := h.fail[r.Method]
+	h.fail[r.Method] = false
+	h.mutex.Unlock()
+
+	if user, password, _ := r.BasicAuth(); user != "accountant" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestWebdavStorage(t *testing.T) {
+	files := webdav.NewMemFS()
+	handler := &flakyHandler{
+		Handler: &webdav.Handler{Prefix: "/dav", FileSystem: files, LockSystem: webdav.NewMemLS()},
+		fail:    map[string]bool{http.MethodPut: true},
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	config := new(Config)
+	config.Storage.Type = "webdav"
+	config.Storage.Webdav.URL = server.URL + "/dav/"
+	config.Storage.Webdav.Username = "accountant"
+	config.Storage.Webdav.Password = "secret"
+
+	storage, err := newStorage(config)
+	assert.NoError(t, err)
+	storage.(*webdavStorage).retryDelay = 0
+
+	ctx := context.Background()
+	assert.NoError(t, files.Mkdir(ctx, "/mail", os.ModePerm))
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/Invoice 1.pdf", []byte("pdf")))
+	assert.NoError(t, storage.Write(ctx, "mail/user/202403/Invoice 1.pdf", []byte("new")))
+
+	data, err := storage.Read(ctx, "mail/user/202403/Invoice 1.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), data)
+
+	// The temporary file was moved
+	dir, err := files.OpenFile(ctx, "/mail/user/202403", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	entries, err := dir.Readdir(-1)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// Known collections are only created once
+	mkcols := 0
+	for _, method := range handler.methods {
+		if strings.HasPrefix(method, "MKCOL") {
+			mkcols++
+		}
+	}
+	assert.Equal(t, 3, mkcols)
+
+	_, err = storage.Read(ctx, "mail/user/data.json")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, storage.Remove(ctx, "mail/user/202403/Invoice 1.pdf"))
+	assert.NoError(t, storage.Remove(ctx, "mail/user/202403/Invoice 1.pdf"))
+	_, err = storage.Read(ctx, "mail/user/202403/Invoice 1.pdf")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	config.Storage.Webdav.Password = "wrong"
+	storage, err = newStorage(config)
+	assert.NoError(t, err)
+
+	var webdavErr *webdavError
+	assert.ErrorAs(t, storage.Write(ctx, "mail/user/data.json", []byte("{}")), &webdavErr)
+	assert.Equal(t, http.StatusUnauthorized, webdavErr.StatusCode)
+}
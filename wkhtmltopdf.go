@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/SebastiaanKlippert/go-wkhtmltopdf"
+)
+
+// wkhtmltopdfBlockingProxy doesn't accept connections, so wkhtmltopdf can only
+// reach the allowed hosts which bypass it
+const wkhtmltopdfBlockingProxy = "http://127.0.0.1:1"
+
+// wkhtmltopdfRenderer renders pages with the wkhtmltopdf binary. Requests to
+// other hosts than allowedHosts are sent to a proxy which doesn't exist.
+// wkhtmltopdf only bypasses exact hosts, "*.example.com" patterns stay blocked.
+type wkhtmltopdfRenderer struct {
+	allowedHosts []string
+}
+
+func (r *wkhtmltopdfRenderer) Render(ctx context.Context, pages [][]byte, options *PageOptions) ([]byte, error) {
+	pdfg, err := wkhtmltopdf.NewPDFGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	pdfg.LowQuality.Set(true)
+	pdfg.PageSize.Set(options.Size)
+	pdfg.Orientation.Set(wkhtmltopdf.OrientationPortrait)
+	if options.Landscape {
+		pdfg.Orientation.Set(wkhtmltopdf.OrientationLandscape)
+	}
+
+	pdfg.MarginTopUnit.Set(millimeters(options.Margins.Top))
+	pdfg.MarginRightUnit.Set(millimeters(options.Margins.Right))
+	pdfg.MarginBottomUnit.Set(millimeters(options.Margins.Bottom))
+	pdfg.MarginLeftUnit.Set(millimeters(options.Margins.Left))
+
+	for _, html := range pages {
+		page := wkhtmltopdf.NewPageReader(bytes.NewReader(html))
+		page.DisableJavascript.Set(true)
+		page.DisableLocalFileAccess.Set(true)
+		page.Proxy.Set(wkhtmltopdfBlockingProxy)
+		page.ProxyHostnameLookup.Set(true)
+		for _, host := range r.allowedHosts {
+			if !strings.HasPrefix(host, "*.") {
+				page.BypassProxyFor.Set(host)
+			}
+		}
+		page.Encoding.Set("UTF-8")
+
+		pdfg.AddPage(page)
+	}
+
+	if err := pdfg.CreateContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return pdfg.Bytes(), nil
+}
+
+func millimeters(margin float64) string {
+	return strconv.FormatFloat(math.Max(margin, 0), 'f', -1, 64) + "mm"
+}